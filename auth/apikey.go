@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/oneness/erc-4337-api/store"
+	"golang.org/x/time/rate"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Scope string
+
+const (
+	ScopeInfo  Scope = "info"
+	ScopeBuild Scope = "build"
+	ScopeSend  Scope = "send"
+	// admin implies every other scope
+	ScopeAdmin Scope = "admin"
+)
+
+var AllScopes = []Scope{ScopeInfo, ScopeBuild, ScopeSend, ScopeAdmin}
+
+func ParseScopes(s string) (scopes []Scope, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		found := false
+		for _, scope := range AllScopes {
+			if string(scope) == part {
+				scopes = append(scopes, scope)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown scope '%v'", part)
+		}
+	}
+	if len(scopes) == 0 {
+		err = fmt.Errorf("at least one scope is required")
+	}
+	return
+}
+
+// APIKey is the stored record of an issued key. Only the SHA-256 hash of the secret
+// part is kept.
+type APIKey struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []Scope    `json:"scopes"`
+	RateLimit int        `json:"rateLimit"` // requests per minute, 0 for unlimited
+	DailyOps  int        `json:"dailyOps"`  // ops built per UTC day, 0 for unlimited
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+var apiKeyPrefix = "apikey/"
+var apiKeyQuotaPrefix = "apikey-quota/"
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// APIKeys manages API keys in the local store and enforces their rate limits and
+// daily op quotas.
+type APIKeys struct {
+	store *store.Store
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func NewAPIKeys(s *store.Store) *APIKeys {
+	return &APIKeys{store: s, limiters: make(map[string]*rate.Limiter)}
+}
+
+// Create issues a new key, returning the full key string. It is only available here;
+// afterwards only its hash is known.
+func (a *APIKeys) Create(name string, scopes []Scope, rateLimit, dailyOps int) (keyString string, key *APIKey, err error) {
+	var id, secret string
+	if id, err = randHex(6); err != nil {
+		return
+	}
+	if secret, err = randHex(24); err != nil {
+		return
+	}
+	key = &APIKey{
+		Id:        id,
+		Name:      name,
+		Hash:      hashSecret(secret),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+		DailyOps:  dailyOps,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err = a.store.Put(apiKeyPrefix+id, key); err != nil {
+		return
+	}
+	keyString = fmt.Sprintf("ak_%v_%v", id, secret)
+	return
+}
+
+func (a *APIKeys) List() (keys []*APIKey, err error) {
+	err = a.store.List(apiKeyPrefix, func(_ string, val []byte) error {
+		k := &APIKey{}
+		if err := json.Unmarshal(val, k); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	return
+}
+
+func (a *APIKeys) Revoke(id string) error {
+	k := &APIKey{}
+	if found, err := a.store.Get(apiKeyPrefix+id, k); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("no api key with id '%v'", id)
+	}
+	now := time.Now().UTC()
+	k.RevokedAt = &now
+	if err := a.store.Put(apiKeyPrefix+id, k); err != nil {
+		return err
+	}
+	// a revoked key never gets past Authenticate again
+	a.mu.Lock()
+	delete(a.limiters, id)
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate looks up the key for a full key string.
+func (a *APIKeys) Authenticate(keyString string) (*APIKey, error) {
+	parts := strings.Split(keyString, "_")
+	if len(parts) != 3 || parts[0] != "ak" {
+		return nil, fmt.Errorf("malformed api key")
+	}
+	k := &APIKey{}
+	if found, err := a.store.Get(apiKeyPrefix+parts[1], k); err != nil {
+		return nil, err
+	} else if !found || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashSecret(parts[2]))) != 1 {
+		return nil, fmt.Errorf("unknown api key")
+	}
+	if k.RevokedAt != nil {
+		return nil, fmt.Errorf("api key has been revoked")
+	}
+	return k, nil
+}
+
+// Allow applies the per-key request rate limit.
+func (a *APIKeys) Allow(k *APIKey) bool {
+	if k.RateLimit <= 0 {
+		return true
+	}
+	a.mu.Lock()
+	l, ok := a.limiters[k.Id]
+	if !ok {
+		l = rate.NewLimiter(rate.Every(time.Minute/time.Duration(k.RateLimit)), k.RateLimit)
+		a.limiters[k.Id] = l
+	}
+	a.mu.Unlock()
+	return l.Allow()
+}
+
+func quotaKey(id string, day time.Time) string {
+	return apiKeyQuotaPrefix + id + "/" + day.UTC().Format("2006-01-02")
+}
+
+// OpCharge is an op counted against a key's daily quota, until it's known whether the
+// op was built.
+type OpCharge struct {
+	store *store.Store
+	key   string
+}
+
+// Refund gives the op back to the quota, for requests that failed.
+func (ch *OpCharge) Refund() error {
+	if ch == nil {
+		return nil
+	}
+	_, err := ch.store.Incr(ch.key, -1, 48*time.Hour)
+	return err
+}
+
+// ConsumeOp counts one op against the key's daily quota, failing once it is used up.
+// The charge is nil for keys without a quota.
+func (a *APIKeys) ConsumeOp(k *APIKey) (*OpCharge, error) {
+	if k.DailyOps <= 0 {
+		return nil, nil
+	}
+	ch := &OpCharge{store: a.store, key: quotaKey(k.Id, time.Now())}
+	n, err := a.store.Incr(ch.key, 1, 48*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(k.DailyOps) {
+		// refused ops don't count
+		_ = ch.Refund()
+		return nil, fmt.Errorf("daily op quota of %v exceeded", k.DailyOps)
+	}
+	return ch, nil
+}
+
+// OpsToday returns how many ops the key has used today.
+func (a *APIKeys) OpsToday(k *APIKey) (int64, error) {
+	return a.store.Counter(quotaKey(k.Id, time.Now()))
+}
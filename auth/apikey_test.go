@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	defer st.Close()
+	keys := NewAPIKeys(st)
+
+	keyString, k, err := keys.Create("test", []Scope{ScopeInfo, ScopeBuild}, 0, 2)
+	require.NoError(t, err)
+	require.NotContains(t, k.Hash, keyString)
+
+	checkKey, err := keys.Authenticate(keyString)
+	require.NoError(t, err)
+	require.Equal(t, k.Id, checkKey.Id)
+	require.True(t, checkKey.HasScope(ScopeBuild))
+	require.False(t, checkKey.HasScope(ScopeSend))
+
+	_, err = keys.Authenticate(keyString + "0")
+	require.Error(t, err)
+
+	_, err = keys.ConsumeOp(k)
+	require.NoError(t, err)
+	charge, err := keys.ConsumeOp(k)
+	require.NoError(t, err)
+	_, err = keys.ConsumeOp(k)
+	require.Error(t, err)
+	// a refused op isn't counted, and a refunded one frees its place
+	n, err := keys.OpsToday(k)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	require.NoError(t, charge.Refund())
+	_, err = keys.ConsumeOp(k)
+	require.NoError(t, err)
+
+	require.NoError(t, keys.Revoke(k.Id))
+	_, err = keys.Authenticate(keyString)
+	require.Error(t, err)
+
+	list, err := keys.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.NotNil(t, list[0].RevokedAt)
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	defer st.Close()
+	keys := NewAPIKeys(st)
+
+	infoKey, _, err := keys.Create("info", []Scope{ScopeInfo}, 1, 0)
+	require.NoError(t, err)
+	adminKey, _, err := keys.Create("admin", []Scope{ScopeAdmin}, 0, 0)
+	require.NoError(t, err)
+	buildKey, _, err := keys.Create("build", []Scope{ScopeBuild}, 0, 1)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	r.GET("/info", RequireAPIKey(keys, ScopeInfo, false), ok)
+	r.GET("/send", RequireAPIKey(keys, ScopeSend, true), ok)
+	r.GET("/build", RequireAPIKey(keys, ScopeBuild, true), func(c *gin.Context) {
+		if len(c.Query("to")) == 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		ok(c)
+	})
+	r.POST("/revoke/:id", RequireAPIKey(keys, ScopeAdmin, false), keys.HandleRevoke)
+
+	do := func(path, key string) int {
+		method := http.MethodGet
+		if strings.HasPrefix(path, "/revoke/") {
+			method = http.MethodPost
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", key)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do("/info", ""))
+	require.Equal(t, http.StatusForbidden, do("/send", infoKey))
+	require.Equal(t, http.StatusOK, do("/send", adminKey))
+	require.Equal(t, http.StatusOK, do("/info", infoKey))
+	require.Equal(t, http.StatusTooManyRequests, do("/info", infoKey))
+
+	// invalid requests don't use up the op quota
+	require.Equal(t, http.StatusBadRequest, do("/build", buildKey))
+	require.Equal(t, http.StatusOK, do("/build?to=0x01", buildKey))
+	require.Equal(t, http.StatusTooManyRequests, do("/build?to=0x01", buildKey))
+
+	// revoked through the api, without the server going down
+	infoId := strings.Split(infoKey, "_")[1]
+	require.Equal(t, http.StatusForbidden, do("/revoke/"+infoId, infoKey))
+	require.Equal(t, http.StatusNotFound, do("/revoke/unknown", adminKey))
+	require.Equal(t, http.StatusOK, do("/revoke/"+infoId, adminKey))
+	require.Equal(t, http.StatusUnauthorized, do("/info", infoKey))
+	// and its rate limiter is let go
+	require.NotContains(t, keys.limiters, infoId)
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// SIWEHandler serves the nonce and verify endpoints of the SIWE login flow.
+type SIWEHandler struct {
+	Verifier *SIWEVerifier
+	Sessions *SessionIssuer
+}
+
+// GET auth/siwe/nonce
+func (h *SIWEHandler) HandleNonce(c *gin.Context) {
+	if nonce, err := h.Verifier.Nonces.New(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, map[string]string{"nonce": nonce})
+	}
+}
+
+type siweVerifyRequest struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+// POST auth/siwe/verify {"message": "...", "signature": "0x..."}
+func (h *SIWEHandler) HandleVerify(c *gin.Context) {
+	req := siweVerifyRequest{}
+	if err := c.BindJSON(&req); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	sig, err := hexutil.Decode(req.Signature)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid signature encoding"))
+		return
+	}
+
+	addr, err := h.Verifier.Verify(req.Message, sig)
+	if err != nil {
+		c.AbortWithError(http.StatusUnauthorized, err)
+		return
+	}
+	token, expiresAt, err := h.Sessions.Issue(addr)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]any{
+		"token":     token,
+		"address":   addr.String(),
+		"expiresAt": expiresAt.Unix(),
+	})
+}
+
+// HandleRevoke revokes an API key while the server runs, for keys that leak.
+// POST admin/apikeys/:id/revoke
+func (a *APIKeys) HandleRevoke(c *gin.Context) {
+	id := c.Param("id")
+	if err := a.Revoke(id); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]string{"revoked": id})
+}
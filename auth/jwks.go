@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var DefaultJWKSRefreshInterval = time.Hour
+
+// minimum time between two refreshes triggered by an unknown key id, so a flood of
+// bogus tokens can't hammer the JWKS endpoint
+var minJWKSRefreshInterval = time.Minute
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// JWKS is a cached set of RSA verification keys loaded from either a URL or a local
+// file. The set is reloaded periodically and whenever a token references a key id we
+// haven't seen, which picks up key rotation on the issuer side.
+type JWKS struct {
+	url  string
+	file string
+
+	refreshInterval time.Duration
+	httpClient      *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time
+	// the last refresh, whether it succeeded or not
+	lastAttempt time.Time
+
+	// one refresh at a time, the others wait for it or use the keys they have
+	refreshMu sync.Mutex
+}
+
+func NewJWKS(url, file string, refreshInterval time.Duration) (*JWKS, error) {
+	if len(url) == 0 && len(file) == 0 {
+		return nil, fmt.Errorf("jwks requires a url or a file")
+	}
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultJWKSRefreshInterval
+	}
+	j := &JWKS{
+		url:             url,
+		file:            file,
+		refreshInterval: refreshInterval,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := j.Refresh(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *JWKS) fetch() (body []byte, err error) {
+	if len(j.file) != 0 {
+		return os.ReadFile(j.file)
+	}
+
+	var resp *http.Response
+	if resp, err = j.httpClient.Get(j.url); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("jwks fetch from '%v' failed with status %v", j.url, resp.StatusCode)
+		return
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func parseJWKS(body []byte) (keys map[string]*rsa.PublicKey, err error) {
+	var set jsonWebKeySet
+	if err = json.Unmarshal(body, &set); err != nil {
+		return
+	}
+
+	keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (len(k.Use) != 0 && k.Use != "sig") {
+			continue
+		}
+		var nBytes, eBytes []byte
+		if nBytes, err = base64.RawURLEncoding.DecodeString(k.N); err != nil {
+			return nil, fmt.Errorf("invalid modulus for key '%v': %v", k.Kid, err.Error())
+		}
+		if eBytes, err = base64.RawURLEncoding.DecodeString(k.E); err != nil {
+			return nil, fmt.Errorf("invalid exponent for key '%v': %v", k.Kid, err.Error())
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		err = fmt.Errorf("jwks contains no usable RSA signing keys")
+	}
+	return
+}
+
+// Refresh reloads the key set from its source. On failure the previous keys are kept.
+func (j *JWKS) Refresh() error {
+	keys, err := j.load()
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lastAttempt = now
+	if err != nil {
+		return err
+	}
+	j.keys = keys
+	j.lastRefresh = now
+	return nil
+}
+
+func (j *JWKS) load() (map[string]*rsa.PublicKey, error) {
+	body, err := j.fetch()
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+// Key returns the public key for the given key id, refreshing the set if it is stale or
+// the key id is unknown. After a failed refresh the next is tried minJWKSRefreshInterval
+// later, and concurrent callers share one refresh.
+func (j *JWKS) Key(kid string) (*rsa.PublicKey, error) {
+	key, ok, due := j.cached(kid)
+	if due {
+		if ok {
+			// a known key doesn't wait for someone else's refresh
+			if j.refreshMu.TryLock() {
+				j.refreshDue(kid)
+				j.refreshMu.Unlock()
+			}
+		} else {
+			j.refreshMu.Lock()
+			j.refreshDue(kid)
+			j.refreshMu.Unlock()
+		}
+		key, ok, _ = j.cached(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown jwks key id '%v'", kid)
+	}
+	return key, nil
+}
+
+// cached returns the key for kid, and whether the set is due a refresh for it.
+func (j *JWKS) cached(kid string) (key *rsa.PublicKey, ok, due bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok = j.keys[kid]
+	sinceRefresh := time.Since(j.lastRefresh)
+	due = time.Since(j.lastAttempt) >= minJWKSRefreshInterval &&
+		((ok && sinceRefresh >= j.refreshInterval) || (!ok && sinceRefresh >= minJWKSRefreshInterval))
+	return
+}
+
+// refreshDue refreshes the set unless a refresh that ran while waiting for the lock
+// made it unnecessary. The caller holds refreshMu.
+func (j *JWKS) refreshDue(kid string) {
+	if _, _, due := j.cached(kid); !due {
+		return
+	}
+	if err := j.Refresh(); err != nil {
+		log.Warnf("jwks refresh failed: %v", err.Error())
+	}
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testWalletAddr = "0xE57bFE9F44b819898F47BF37E5AF72a0783e1141"
+
+func writeTestJWKS(t *testing.T, kid string, pub *rsa.PublicKey) string {
+	set := jsonWebKeySet{Keys: []jsonWebKey{{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+	setBytes, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, setBytes, 0600))
+	return path
+}
+
+func makeTestToken(t *testing.T, sk *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(sk)
+	require.NoError(t, err)
+	return signed
+}
+
+func makeTestClaims(exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "stytch.com/project-test",
+		"aud": []string{"project-test"},
+		"exp": exp.Unix(),
+		"nbf": time.Now().Add(-time.Minute).Unix(),
+		"https://stytch.com/session": map[string]any{
+			"authentication_factors": []any{map[string]any{
+				"crypto_wallet_factor": map[string]any{"crypto_wallet_address": testWalletAddr},
+			}},
+		},
+	}
+}
+
+func makeTestVerifier(t *testing.T) (*JWTVerifier, *rsa.PrivateKey) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keys, err := NewJWKS("", writeTestJWKS(t, "test-kid", &sk.PublicKey), 0)
+	require.NoError(t, err)
+	return NewJWTVerifier(keys, "stytch.com/project-test", "project-test"), sk
+}
+
+func TestJWTVerify(t *testing.T) {
+	v, sk := makeTestVerifier(t)
+
+	_, addr, err := v.Verify(makeTestToken(t, sk, "test-kid", makeTestClaims(time.Now().Add(time.Hour))))
+	require.NoError(t, err)
+	require.Equal(t, testWalletAddr, addr.String())
+
+	_, _, err = v.Verify(makeTestToken(t, sk, "test-kid", makeTestClaims(time.Now().Add(-time.Hour))))
+	require.Error(t, err)
+
+	_, _, err = v.Verify(makeTestToken(t, sk, "other-kid", makeTestClaims(time.Now().Add(time.Hour))))
+	require.Error(t, err)
+
+	badAud := makeTestClaims(time.Now().Add(time.Hour))
+	badAud["aud"] = []string{"another-project"}
+	_, _, err = v.Verify(makeTestToken(t, sk, "test-kid", badAud))
+	require.Error(t, err)
+
+	otherSK, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, _, err = v.Verify(makeTestToken(t, otherSK, "test-kid", makeTestClaims(time.Now().Add(time.Hour))))
+	require.Error(t, err)
+}
+
+func TestJWKSRefreshOutage(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	setBytes, err := os.ReadFile(writeTestJWKS(t, "test-kid", &sk.PublicKey))
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(setBytes)
+	}))
+	t.Cleanup(srv.Close)
+
+	keys, err := NewJWKS(srv.URL, "", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fetches.Load())
+
+	// the set is stale and the endpoint down: one refresh is tried, the cached key still works
+	down.Store(true)
+	keys.lastRefresh = time.Now().Add(-2 * time.Hour)
+	keys.lastAttempt = keys.lastRefresh
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key("other-kid")
+			require.Error(t, err)
+			key, err := keys.Key("test-kid")
+			require.NoError(t, err)
+			require.Equal(t, sk.PublicKey.N, key.N)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), fetches.Load())
+}
+
+func TestRequireOwner(t *testing.T) {
+	v, sk := makeTestVerifier(t)
+	token := makeTestToken(t, sk, "test-kid", makeTestClaims(time.Now().Add(time.Hour)))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/userop", RequireToken(v), RequireOwner(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	do := func(owner, token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/userop?owner="+owner, nil)
+		if len(token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, do(testWalletAddr, token))
+	require.Equal(t, http.StatusOK, do("e57bfe9f44b819898f47bf37e5af72a0783e1141", token))
+	require.Equal(t, http.StatusForbidden, do("0x6D64a4aF99563a82B212124604f6d1759376F37F", token))
+	require.Equal(t, http.StatusUnauthorized, do(testWalletAddr, ""))
+}
+
+func TestRequireStaticToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/metrics", RequireStaticToken("scrape-token"), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	do := func(header string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		if len(header) != 0 {
+			req.Header.Set("Authorization", header)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, do("Bearer scrape-token"))
+	require.Equal(t, http.StatusUnauthorized, do("Bearer other-token"))
+	require.Equal(t, http.StatusUnauthorized, do("scrape-token"))
+	require.Equal(t, http.StatusUnauthorized, do(""))
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/umbracle/ethgo"
+	"net/http"
+	"strings"
+)
+
+// AddressKey is the gin context key holding the authenticated wallet address
+const AddressKey = "authAddress"
+
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// TokenVerifier checks a bearer token and returns the wallet address it authenticates.
+type TokenVerifier interface {
+	VerifyToken(token string) (ethgo.Address, error)
+}
+
+// AuthenticatedAddress returns the wallet address set by RequireToken, if any.
+func AuthenticatedAddress(c *gin.Context) (addr ethgo.Address, ok bool) {
+	var v any
+	if v, ok = c.Get(AddressKey); ok {
+		addr, ok = v.(ethgo.Address)
+	}
+	return
+}
+
+// RequireToken rejects requests without a bearer token accepted by one of the
+// verifiers, and stores the authenticated wallet address in the context.
+func RequireToken(verifiers ...TokenVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if len(token) == 0 {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("missing bearer token"))
+			return
+		}
+		var err error
+		for _, v := range verifiers {
+			var addr ethgo.Address
+			if addr, err = v.VerifyToken(token); err == nil {
+				c.Set(AddressKey, addr)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("invalid token: %v", err))
+	}
+}
+
+// RequireStaticToken rejects requests whose bearer token isn't token, for machine
+// clients such as a metrics scraper.
+func RequireStaticToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireOwner checks that the 'owner' query parameter is the authenticated address.
+// Must run after RequireToken.
+func RequireOwner() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, ok := AuthenticatedAddress(c)
+		if !ok {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("not authenticated"))
+			return
+		}
+		owner := c.Query("owner")
+		if !strings.HasPrefix(owner, "0x") {
+			owner = "0x" + owner
+		}
+		if !strings.EqualFold(owner, addr.String()) {
+			c.AbortWithError(http.StatusForbidden, fmt.Errorf("owner '%v' does not match authenticated address '%v'", c.Query("owner"), addr.String()))
+			return
+		}
+		c.Next()
+	}
+}
+
+// APIKeyKey is the gin context key holding the *APIKey of the request
+const APIKeyKey = "apiKey"
+
+// RequireAPIKey checks the X-API-Key header for a key with the given scope, applies its
+// rate limit and, for routes that build ops, its daily op quota.
+func RequireAPIKey(keys *APIKeys, scope Scope, countsOp bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyString := c.GetHeader("X-API-Key")
+		if len(keyString) == 0 {
+			c.AbortWithError(http.StatusUnauthorized, fmt.Errorf("missing api key"))
+			return
+		}
+		k, err := keys.Authenticate(keyString)
+		if err != nil {
+			c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+		if !k.HasScope(scope) {
+			c.AbortWithError(http.StatusForbidden, fmt.Errorf("api key lacks scope '%v'", scope))
+			return
+		}
+		if !keys.Allow(k) {
+			c.AbortWithError(http.StatusTooManyRequests, fmt.Errorf("api key rate limit exceeded"))
+			return
+		}
+		// the op is counted up front, so concurrent requests can't overrun the quota,
+		// and given back when the request fails, e.g. on invalid input
+		var charge *OpCharge
+		if countsOp {
+			if charge, err = keys.ConsumeOp(k); err != nil {
+				c.AbortWithError(http.StatusTooManyRequests, err)
+				return
+			}
+		}
+		c.Set(APIKeyKey, k)
+		c.Next()
+		if c.Writer.Status() >= http.StatusBadRequest {
+			if err = charge.Refund(); err != nil {
+				log.Warnf("failed to refund the op quota of api key '%v': %v", k.Id, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/umbracle/ethgo"
+	"time"
+)
+
+var DefaultSessionTTL = 15 * time.Minute
+
+var sessionIssuer = "erc4337-api-server"
+
+// SessionIssuer mints and checks the short-lived HS256 session tokens handed out after
+// a successful SIWE login.
+type SessionIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewSessionIssuer uses the given secret, or a random one if it is empty; in the
+// latter case sessions don't survive a restart.
+func NewSessionIssuer(secret []byte, ttl time.Duration) (*SessionIssuer, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &SessionIssuer{secret: secret, ttl: ttl}, nil
+}
+
+func (s *SessionIssuer) Issue(addr ethgo.Address) (token string, expiresAt time.Time, err error) {
+	now := time.Now()
+	expiresAt = now.Add(s.ttl)
+	claims := jwt.RegisteredClaims{
+		Issuer:    sessionIssuer,
+		Subject:   addr.String(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	return
+}
+
+func (s *SessionIssuer) VerifyToken(tokenString string) (addr ethgo.Address, err error) {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	claims := &jwt.RegisteredClaims{}
+	if _, err = parser.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return s.secret, nil
+	}); err != nil {
+		return
+	}
+	if claims.Issuer != sessionIssuer || claims.ExpiresAt == nil {
+		err = fmt.Errorf("not a session token")
+		return
+	}
+	if len(claims.Subject) != len(ethgo.ZeroAddress.String()) {
+		err = fmt.Errorf("session token has invalid subject")
+		return
+	}
+	addr = ethgo.HexToAddress(claims.Subject)
+	return
+}
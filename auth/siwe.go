@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SIWEMessage is a parsed EIP-4361 'Sign-In with Ethereum' message.
+type SIWEMessage struct {
+	Domain         string
+	Address        ethgo.Address
+	Statement      string
+	URI            string
+	Version        string
+	ChainId        *big.Int
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestId      string
+	Resources      []string
+}
+
+var siweHeaderSuffix = " wants you to sign in with your Ethereum account:"
+
+func parseSIWETime(field, value string) (t time.Time, err error) {
+	if t, err = time.Parse(time.RFC3339, value); err != nil {
+		err = fmt.Errorf("invalid siwe '%v' timestamp: %v", field, value)
+	}
+	return
+}
+
+// ParseSIWEMessage parses the EIP-4361 plain text message format.
+func ParseSIWEMessage(msg string) (m *SIWEMessage, err error) {
+	lines := strings.Split(strings.ReplaceAll(msg, "\r\n", "\n"), "\n")
+	if len(lines) < 3 || !strings.HasSuffix(lines[0], siweHeaderSuffix) {
+		return nil, fmt.Errorf("invalid siwe message header")
+	}
+	m = &SIWEMessage{Domain: strings.TrimSuffix(lines[0], siweHeaderSuffix)}
+	if i := strings.Index(m.Domain, "://"); i >= 0 {
+		m.Domain = m.Domain[i+3:]
+	}
+
+	addrHex := lines[1]
+	if !strings.HasPrefix(addrHex, "0x") || len(addrHex) != len(ethgo.ZeroAddress.String()) {
+		return nil, fmt.Errorf("invalid siwe address '%v'", addrHex)
+	}
+	m.Address = ethgo.HexToAddress(addrHex)
+	if m.Address.String() != addrHex {
+		return nil, fmt.Errorf("siwe address '%v' is not EIP-55 checksummed", addrHex)
+	}
+
+	i := 2
+	for i < len(lines) && len(lines[i]) == 0 {
+		i++
+	}
+	if i < len(lines) && !strings.HasPrefix(lines[i], "URI: ") {
+		m.Statement = lines[i]
+		i++
+	}
+	for i < len(lines) && len(lines[i]) == 0 {
+		i++
+	}
+
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if len(line) == 0 {
+			continue
+		}
+		if line == "Resources:" {
+			for i++; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+				m.Resources = append(m.Resources, strings.TrimPrefix(lines[i], "- "))
+			}
+			break
+		}
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			return nil, fmt.Errorf("invalid siwe message line '%v'", line)
+		}
+		switch key {
+		case "URI":
+			m.URI = value
+		case "Version":
+			m.Version = value
+		case "Chain ID":
+			var ok bool
+			if m.ChainId, ok = new(big.Int).SetString(value, 10); !ok {
+				return nil, fmt.Errorf("invalid siwe chain id '%v'", value)
+			}
+		case "Nonce":
+			m.Nonce = value
+		case "Issued At":
+			if m.IssuedAt, err = parseSIWETime(key, value); err != nil {
+				return nil, err
+			}
+		case "Expiration Time":
+			var t time.Time
+			if t, err = parseSIWETime(key, value); err != nil {
+				return nil, err
+			}
+			m.ExpirationTime = &t
+		case "Not Before":
+			var t time.Time
+			if t, err = parseSIWETime(key, value); err != nil {
+				return nil, err
+			}
+			m.NotBefore = &t
+		case "Request ID":
+			m.RequestId = value
+		default:
+			return nil, fmt.Errorf("unknown siwe message field '%v'", key)
+		}
+	}
+
+	if len(m.URI) == 0 || m.Version != "1" || m.ChainId == nil || len(m.Nonce) < 8 || m.IssuedAt.IsZero() {
+		return nil, fmt.Errorf("siwe message is missing required fields")
+	}
+	return m, nil
+}
+
+// RecoverSigner returns the address that produced the personal_sign signature over msg.
+func RecoverSigner(msg []byte, signature []byte) (addr ethgo.Address, err error) {
+	return crypto.Ecrecover(crypto.EthPersonalMessageHash(msg), signature)
+}
+
+// DefaultMaxNonces bounds the nonces a NonceStore holds; handing them out needs no auth.
+const DefaultMaxNonces = 100_000
+
+// NonceStore hands out single use nonces for SIWE messages. It holds at most max
+// nonces, past that the oldest are forgotten.
+type NonceStore struct {
+	ttl    time.Duration
+	max    int
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	// the nonces in the order they were handed out, which with one ttl is expiry order
+	order []string
+}
+
+func NewNonceStore(ttl time.Duration, max int) *NonceStore {
+	return &NonceStore{ttl: ttl, max: max, nonces: make(map[string]time.Time)}
+}
+
+func (s *NonceStore) New() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b[:])
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// only the oldest can have expired, so this stops at the first live nonce
+	for len(s.order) != 0 {
+		oldest := s.order[0]
+		if expiry, ok := s.nonces[oldest]; ok && now.Before(expiry) && len(s.order) < s.max {
+			break
+		}
+		delete(s.nonces, oldest)
+		s.order = s.order[1:]
+	}
+	s.nonces[nonce] = now.Add(s.ttl)
+	s.order = append(s.order, nonce)
+	return nonce, nil
+}
+
+// Consume returns true and forgets the nonce if it was issued and has not expired.
+func (s *NonceStore) Consume(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return ok && time.Now().Before(expiry)
+}
+
+// SIWEVerifier checks signed SIWE messages against the expected domain and chain.
+type SIWEVerifier struct {
+	Domain  string
+	ChainId *big.Int
+	Nonces  *NonceStore
+
+	// tolerated clock difference for 'Issued At' in the future
+	ClockSkew time.Duration
+}
+
+// Verify checks the message fields and signature, and consumes the nonce. It returns
+// the signing address.
+func (v *SIWEVerifier) Verify(msg string, signature []byte) (addr ethgo.Address, err error) {
+	var m *SIWEMessage
+	if m, err = ParseSIWEMessage(msg); err != nil {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case m.Domain != v.Domain:
+		err = fmt.Errorf("siwe domain mismatch: '%v'", m.Domain)
+	case m.ChainId.Cmp(v.ChainId) != 0:
+		err = fmt.Errorf("siwe chain id mismatch: %v", m.ChainId.String())
+	case m.IssuedAt.After(now.Add(v.ClockSkew)):
+		err = fmt.Errorf("siwe message issued in the future")
+	case m.ExpirationTime != nil && now.After(*m.ExpirationTime):
+		err = fmt.Errorf("siwe message expired")
+	case m.NotBefore != nil && now.Before(*m.NotBefore):
+		err = fmt.Errorf("siwe message not yet valid")
+	}
+	if err != nil {
+		return
+	}
+
+	if addr, err = RecoverSigner([]byte(msg), signature); err != nil {
+		return
+	}
+	if addr != m.Address {
+		err = fmt.Errorf("siwe signature does not match address '%v'", m.Address.String())
+		return
+	}
+	// consume the nonce last, so a bad signature can't burn someone else's nonce
+	if !v.Nonces.Consume(m.Nonce) {
+		err = fmt.Errorf("unknown or expired siwe nonce")
+	}
+	return
+}
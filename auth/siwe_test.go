@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func makeTestSIWEMessage(domain, addr, nonce string, chainId int, expiry time.Time) string {
+	return fmt.Sprintf(`%v wants you to sign in with your Ethereum account:
+%v
+
+Sign in to the ERC-4337 API.
+
+URI: https://%v/login
+Version: 1
+Chain ID: %v
+Nonce: %v
+Issued At: %v
+Expiration Time: %v
+Resources:
+- https://%v/terms`, domain, addr, domain, chainId, nonce,
+		time.Now().UTC().Format(time.RFC3339), expiry.UTC().Format(time.RFC3339), domain)
+}
+
+func signTestMessage(t *testing.T, k *chain.EcdsaKey, msg string) []byte {
+	sig, err := k.Sign(crypto.EthPersonalMessageHash([]byte(msg)))
+	require.NoError(t, err)
+	sig[64] += 27
+	return sig
+}
+
+func TestParseSIWEMessage(t *testing.T) {
+	msg := makeTestSIWEMessage("api.example.com", testWalletAddr, "abcdef0123456789", 137, time.Now().Add(time.Hour))
+	m, err := ParseSIWEMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, "api.example.com", m.Domain)
+	require.Equal(t, testWalletAddr, m.Address.String())
+	require.Equal(t, "Sign in to the ERC-4337 API.", m.Statement)
+	require.Equal(t, int64(137), m.ChainId.Int64())
+	require.Equal(t, "abcdef0123456789", m.Nonce)
+	require.NotNil(t, m.ExpirationTime)
+	require.Equal(t, []string{"https://api.example.com/terms"}, m.Resources)
+
+	// lowercase addresses aren't EIP-55
+	_, err = ParseSIWEMessage(makeTestSIWEMessage("api.example.com", "0xe57bfe9f44b819898f47bf37e5af72a0783e1141", "abcdef0123456789", 137, time.Now()))
+	require.Error(t, err)
+}
+
+func TestSIWEVerify(t *testing.T) {
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	k := &chain.EcdsaKey{SK: sk}
+
+	v := &SIWEVerifier{Domain: "api.example.com", ChainId: big.NewInt(137), Nonces: NewNonceStore(time.Minute, DefaultMaxNonces)}
+
+	nonce, err := v.Nonces.New()
+	require.NoError(t, err)
+	msg := makeTestSIWEMessage("api.example.com", k.Address().String(), nonce, 137, time.Now().Add(time.Hour))
+
+	// wrong signer doesn't burn the nonce
+	otherSK, err := crypto.RandSK()
+	require.NoError(t, err)
+	_, err = v.Verify(msg, signTestMessage(t, &chain.EcdsaKey{SK: otherSK}, msg))
+	require.Error(t, err)
+
+	addr, err := v.Verify(msg, signTestMessage(t, k, msg))
+	require.NoError(t, err)
+	require.Equal(t, k.Address(), addr)
+
+	// nonces are single use
+	_, err = v.Verify(msg, signTestMessage(t, k, msg))
+	require.Error(t, err)
+
+	nonce, err = v.Nonces.New()
+	require.NoError(t, err)
+	wrongChain := makeTestSIWEMessage("api.example.com", k.Address().String(), nonce, 1, time.Now().Add(time.Hour))
+	_, err = v.Verify(wrongChain, signTestMessage(t, k, wrongChain))
+	require.Error(t, err)
+
+	expired := makeTestSIWEMessage("api.example.com", k.Address().String(), nonce, 137, time.Now().Add(-time.Minute))
+	_, err = v.Verify(expired, signTestMessage(t, k, expired))
+	require.Error(t, err)
+}
+
+func TestNonceStoreBound(t *testing.T) {
+	s := NewNonceStore(time.Minute, 2)
+	var issued []string
+	for i := 0; i < 3; i++ {
+		nonce, err := s.New()
+		require.NoError(t, err)
+		issued = append(issued, nonce)
+	}
+	// the oldest made room for the newest
+	require.False(t, s.Consume(issued[0]))
+	require.True(t, s.Consume(issued[1]))
+	require.True(t, s.Consume(issued[2]))
+	require.Len(t, s.order, 2)
+}
+
+func TestSessionToken(t *testing.T) {
+	sessions, err := NewSessionIssuer(nil, time.Minute)
+	require.NoError(t, err)
+
+	token, _, err := sessions.Issue(ethgo.HexToAddress(testWalletAddr))
+	require.NoError(t, err)
+
+	addr, err := sessions.VerifyToken(token)
+	require.NoError(t, err)
+	require.Equal(t, testWalletAddr, addr.String())
+
+	otherSessions, err := NewSessionIssuer(nil, time.Minute)
+	require.NoError(t, err)
+	_, err = otherSessions.VerifyToken(token)
+	require.Error(t, err)
+}
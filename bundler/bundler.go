@@ -0,0 +1,403 @@
+package bundler
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/replace"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/entrypoint/reverts"
+	"github.com/stackup-wallet/stackup-bundler/pkg/mempool"
+	"github.com/stackup-wallet/stackup-bundler/pkg/modules"
+	"github.com/stackup-wallet/stackup-bundler/pkg/modules/batch"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const opPrefix = "bundler/op/"
+
+// op records are kept this long after the op leaves the mempool
+var opRecordTTL = 7 * 24 * time.Hour
+
+var handleOpsMethod, _ = abi.NewMethod("function handleOps((address sender, uint256 nonce, bytes initCode, bytes callData, uint256 callGasLimit, uint256 verificationGasLimit, uint256 preVerificationGas, uint256 maxFeePerGas, uint256 maxPriorityFeePerGas, bytes paymasterAndData, bytes signature)[] ops, address beneficiary)")
+
+var DefaultMaxBatchGasLimit = big.NewInt(10_000_000)
+
+// op statuses
+const (
+	OpPending   = "pending"
+	OpSubmitted = "submitted"
+	OpIncluded  = "included"
+	// reverted in handleOps, or the op's own call reverted
+	OpFailed = "failed"
+	// dropped from the mempool without being sent
+	OpDropped = "dropped"
+	// another op at the same sender and nonce took its place in the mempool
+	OpReplaced = "replaced"
+)
+
+type OpRecord struct {
+	OpHash    string    `json:"opHash"`
+	Status    string    `json:"status"`
+	Success   *bool     `json:"success,omitempty"`
+	TxHash    string    `json:"txHash,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type Config struct {
+	// how often a batch is sent, about a block
+	Interval         time.Duration
+	MaxBatchGasLimit *big.Int
+	// receives the batch's gas refunds
+	Beneficiary ethgo.Address
+	// how much an op at the sender and nonce of one in the mempool must raise both
+	// its fees by to replace it
+	MinFeeBumpPercent int64
+	// called for ops that leave the mempool without using their nonce, when set, with
+	// OpDropped or OpFailed
+	OnDrop func(op *userop.UserOperation, status string)
+}
+
+// Bundler accepts ops into a mempool persisted in the store, and sends them to the
+// entry point in handleOps batches.
+type Bundler struct {
+	// the chain, through a client whose calls stop with their context
+	client     *rpc.Client
+	entryPoint ethgo.Address
+	chainId    *big.Int
+	submitters *chain.SignerPool
+	store      *store.Store
+	cfg        Config
+
+	// the stackup mempool isn't safe for concurrent use
+	mu      sync.Mutex
+	mempool *mempool.Mempool
+}
+
+func New(client *rpc.Client, entryPoint ethgo.Address, chainId *big.Int, submitters *chain.SignerPool, st *store.Store, cfg Config) (*Bundler, error) {
+	if submitters.Next() == nil {
+		return nil, fmt.Errorf("the bundler needs a key to submit batches")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 12 * time.Second
+	}
+	if cfg.MaxBatchGasLimit == nil {
+		cfg.MaxBatchGasLimit = DefaultMaxBatchGasLimit
+	}
+	if cfg.MinFeeBumpPercent <= 0 {
+		cfg.MinFeeBumpPercent = replace.MinFeeBumpPercent
+	}
+	mp, err := mempool.New(st.DB())
+	if err != nil {
+		return nil, err
+	}
+	return &Bundler{client: client, entryPoint: entryPoint, chainId: chainId, submitters: submitters, store: st, cfg: cfg, mempool: mp}, nil
+}
+
+func (b *Bundler) opHash(op *userop.UserOperation) string {
+	return op.GetUserOpHash(common.Address(b.entryPoint), b.chainId).String()
+}
+
+func (b *Bundler) record(opHash, status string, fn func(r *OpRecord)) error {
+	r := &OpRecord{OpHash: opHash, Status: status, UpdatedAt: time.Now().UTC()}
+	if fn != nil {
+		fn(r)
+	}
+	return b.store.PutWithTTL(opPrefix+opHash, r, opRecordTTL)
+}
+
+func (b *Bundler) dropped(op *userop.UserOperation, status string) {
+	if b.cfg.OnDrop != nil {
+		b.cfg.OnDrop(op, status)
+	}
+}
+
+// Add accepts op into the mempool, replacing the op with the same sender and nonce.
+func (b *Bundler) Add(op *userop.UserOperation) (opHash string, err error) {
+	if op.GetMaxGasAvailable().Cmp(b.cfg.MaxBatchGasLimit) >= 0 {
+		return "", fmt.Errorf("the op's gas limits exceed the batch gas limit of %v", b.cfg.MaxBatchGasLimit.String())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	opHash = b.opHash(op)
+	prev, err := b.queued(op)
+	if err != nil {
+		return "", err
+	}
+	// the same op sent again is left as it is
+	if prev != nil && b.opHash(prev) == opHash {
+		prev = nil
+	}
+	if prev != nil {
+		if err = replace.Replaces(prev, op, b.cfg.MinFeeBumpPercent); err != nil {
+			return "", err
+		}
+	}
+	if err = b.mempool.AddOp(common.Address(b.entryPoint), op); err != nil {
+		return
+	}
+	if prev != nil {
+		if err = b.record(b.opHash(prev), OpReplaced, func(r *OpRecord) { r.Reason = "replaced by " + opHash }); err != nil {
+			return
+		}
+	}
+	err = b.record(opHash, OpPending, nil)
+	return
+}
+
+// queued returns the op in the mempool at op's sender and nonce, if there is one.
+func (b *Bundler) queued(op *userop.UserOperation) (*userop.UserOperation, error) {
+	ops, err := b.mempool.GetOps(common.Address(b.entryPoint), op.Sender)
+	if err != nil {
+		return nil, err
+	}
+	for _, queued := range ops {
+		if queued.Nonce.Cmp(op.Nonce) == 0 {
+			return queued, nil
+		}
+	}
+	return nil, nil
+}
+
+// Status returns what happened to the op, found is false for ops this bundler
+// hasn't seen.
+func (b *Bundler) Status(opHash string) (r *OpRecord, found bool, err error) {
+	r = &OpRecord{}
+	found, err = b.store.Get(opPrefix+opHash, r)
+	return
+}
+
+// Pending returns the ops in the mempool, in the order they arrived.
+func (b *Bundler) Pending() ([]*userop.UserOperation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mempool.Dump(common.Address(b.entryPoint))
+}
+
+// Size returns the number of ops in the mempool.
+func (b *Bundler) Size() int {
+	ops, _ := b.Pending()
+	return len(ops)
+}
+
+// Run sends a batch every interval until ctx is done.
+func (b *Bundler) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.Bundle(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("bundler: %v", err.Error())
+			}
+		}
+	}
+}
+
+// failedOp decodes the entry point's FailedOp revert.
+func failedOp(err error) (*reverts.FailedOpRevert, bool) {
+	failed, decodeErr := reverts.NewFailedOp(err)
+	return failed, decodeErr == nil
+}
+
+func (b *Bundler) encode(ops []*userop.UserOperation) ([]byte, error) {
+	var opMaps []map[string]any
+	for _, op := range ops {
+		opMap, err := op.ToMap()
+		if err != nil {
+			return nil, err
+		}
+		opMaps = append(opMaps, opMap)
+	}
+	return handleOpsMethod.Encode([]any{opMaps, b.cfg.Beneficiary})
+}
+
+// dropFailedOps simulates handleOps, dropping each op the entry point fails with
+// FailedOp until the rest go through.
+func (b *Bundler) dropFailedOps(ctx context.Context, from ethgo.Address) modules.BatchHandlerFunc {
+	return func(batchCtx *modules.BatchHandlerCtx) error {
+		for len(batchCtx.Batch) != 0 {
+			data, err := b.encode(batchCtx.Batch)
+			if err != nil {
+				return err
+			}
+			msg := map[string]any{"from": from.String(), "to": b.entryPoint.String(), "data": hexutil.Encode(data)}
+			err = b.client.CallContext(ctx, nil, "eth_call", msg, "latest")
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			failed, ok := failedOp(err)
+			if !ok || failed.OpIndex < 0 || failed.OpIndex >= len(batchCtx.Batch) {
+				return fmt.Errorf("handleOps simulation: %v", err.Error())
+			}
+			opHash := b.opHash(batchCtx.Batch[failed.OpIndex])
+			log.Infof("bundler: dropping op '%v': %v", opHash, failed.Reason)
+			if err = b.record(opHash, OpDropped, func(r *OpRecord) { r.Reason = failed.Reason }); err != nil {
+				return err
+			}
+			b.dropped(batchCtx.Batch[failed.OpIndex], OpDropped)
+			batchCtx.MarkOpIndexForRemoval(failed.OpIndex)
+		}
+		return nil
+	}
+}
+
+// Bundle settles the batches sent in earlier rounds that have been mined since, and
+// sends one handleOps batch of the ops in the mempool that aren't in a pending batch.
+func (b *Bundler) Bundle(ctx context.Context) error {
+	ops, err := b.Pending()
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	if ops, err = b.resolveSubmitted(ctx, ops); err != nil || len(ops) == 0 {
+		return err
+	}
+	submitter := b.submitters.Next()
+
+	batchCtx := modules.NewBatchHandlerContext(ops, common.Address(b.entryPoint), b.chainId, nil, nil, nil)
+	err = modules.ComposeBatchHandlerFunc(
+		batch.SortByNonce(),
+		batch.MaintainGasLimit(b.cfg.MaxBatchGasLimit),
+		b.dropFailedOps(ctx, submitter.Address()),
+	)(batchCtx)
+	if len(batchCtx.PendingRemoval) != 0 {
+		b.mu.Lock()
+		removeErr := b.mempool.RemoveOps(common.Address(b.entryPoint), batchCtx.PendingRemoval...)
+		b.mu.Unlock()
+		if removeErr != nil {
+			return removeErr
+		}
+	}
+	if err != nil || len(batchCtx.Batch) == 0 {
+		return err
+	}
+
+	data, err := b.encode(batchCtx.Batch)
+	if err != nil {
+		return err
+	}
+	txn := chain.SignerTxn(b.client, submitter, b.entryPoint, nil, data)
+	if err = chain.DoContext(ctx, txn); err != nil {
+		return err
+	}
+	txHash := txn.Hash().String()
+	log.Infof("bundler: sent %v ops in '%v' from '%v'", len(batchCtx.Batch), txHash, submitter.Address().String())
+	// the batch is settled by resolveSubmitted on a later round once it's mined, rather
+	// than holding up the loop while it waits for a block
+	for _, op := range batchCtx.Batch {
+		if err = b.record(b.opHash(op), OpSubmitted, func(r *OpRecord) { r.TxHash = txHash }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle takes a mined batch's ops out of the mempool and records their outcomes.
+func (b *Bundler) settle(ops []*userop.UserOperation, txHash string, receipt *ethgo.Receipt) error {
+	b.mu.Lock()
+	err := b.mempool.RemoveOps(common.Address(b.entryPoint), ops...)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	outcomes := opOutcomes(receipt)
+	for _, op := range ops {
+		opHash := b.opHash(op)
+		status := OpIncluded
+		success, found := outcomes[opHash]
+		if receipt.Status == 0 || !found {
+			status = OpFailed
+		}
+		if err = b.record(opHash, status, func(r *OpRecord) {
+			r.TxHash = txHash
+			if found {
+				r.Success = &success
+			}
+			if receipt.Status == 0 {
+				r.Reason = "handleOps reverted"
+			}
+		}); err != nil {
+			return err
+		}
+		// a reverted batch doesn't use its ops' nonces
+		if receipt.Status == 0 {
+			b.dropped(op, OpFailed)
+		}
+	}
+	return nil
+}
+
+// resolveSubmitted sorts out mempool ops already submitted in a batch. Ops of a batch
+// mined since are settled, ops of a batch still pending are held back, and the rest,
+// whose batch the node no longer knows, are returned with the unsubmitted ops to
+// batch again.
+func (b *Bundler) resolveSubmitted(ctx context.Context, ops []*userop.UserOperation) ([]*userop.UserOperation, error) {
+	var ret []*userop.UserOperation
+	submitted := map[string][]*userop.UserOperation{}
+	for _, op := range ops {
+		r, found, err := b.Status(b.opHash(op))
+		if err != nil {
+			return nil, err
+		}
+		if !found || r.Status != OpSubmitted || len(r.TxHash) == 0 {
+			ret = append(ret, op)
+			continue
+		}
+		submitted[r.TxHash] = append(submitted[r.TxHash], op)
+	}
+
+	for txHash, txOps := range submitted {
+		var receipt *ethgo.Receipt
+		var txn *ethgo.Transaction
+		err := b.client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash)
+		if err == nil && receipt == nil {
+			err = b.client.CallContext(ctx, &txn, "eth_getTransactionByHash", txHash)
+		}
+		switch {
+		case err != nil:
+			return nil, err
+		case receipt != nil:
+			if err = b.settle(txOps, txHash, receipt); err != nil {
+				return nil, err
+			}
+		case txn != nil:
+			log.Infof("bundler: batch '%v' is still pending, holding back its %v ops", txHash, len(txOps))
+		default:
+			log.Infof("bundler: batch '%v' is gone, sending its %v ops again", txHash, len(txOps))
+			ret = append(ret, txOps...)
+		}
+	}
+	return ret, nil
+}
+
+var userOperationEvent = abi.MustNewEvent("event UserOperationEvent(bytes32 indexed userOpHash, address indexed sender, address indexed paymaster, uint256 nonce, bool success, uint256 actualGasCost, uint256 actualGasUsed)")
+
+// opOutcomes returns whether each op in the receipt succeeded, by op hash.
+func opOutcomes(receipt *ethgo.Receipt) map[string]bool {
+	outcomes := map[string]bool{}
+	for _, l := range receipt.Logs {
+		if !userOperationEvent.Match(l) {
+			continue
+		}
+		res, err := userOperationEvent.ParseLog(l)
+		if err != nil {
+			continue
+		}
+		opHash, _ := res["userOpHash"].([32]byte)
+		success, _ := res["success"].(bool)
+		outcomes[ethgo.Hash(opHash).String()] = success
+	}
+	return outcomes
+}
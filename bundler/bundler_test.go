@@ -0,0 +1,273 @@
+package bundler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/oneness/erc-4337-api/internal/testutil"
+	"github.com/oneness/erc-4337-api/replace"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+var testEntryPoint = ethgo.HexToAddress("0x5FF137D4b0FDCD49DcA30c7CF57E578a026d2789")
+var testChainId = big.NewInt(1337)
+
+var failedOpType = abi.MustNewType("tuple(uint256 opIndex, string reason)")
+
+type rpcRequest struct {
+	Id     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// stands in for a node whose entry point fails every op from badSender; batches aren't
+// mined while included returns nil. Counts the batches sent in sent.
+func makeTestNode(t *testing.T, badSender ethgo.Address, included func() *ethgo.Log) (srv *httptest.Server, sent *atomic.Int32) {
+	txHash := ethgo.HexToHash("0x01")
+	sent = &atomic.Int32{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := rpcRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.Id}
+		switch req.Method {
+		case "eth_call":
+			var msg struct {
+				Data hexutil.Bytes `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(req.Params[0], &msg))
+			decoded, err := abi.Decode(handleOpsMethod.Inputs, msg.Data[4:])
+			require.NoError(t, err)
+			ops := decoded.(map[string]interface{})["ops"].([]map[string]interface{})
+			resp["result"] = "0x"
+			for i, op := range ops {
+				if op["sender"].(ethgo.Address) == badSender {
+					data, err := failedOpType.Encode(map[string]any{"opIndex": big.NewInt(int64(i)), "reason": "AA23 reverted"})
+					require.NoError(t, err)
+					selector := ethgo.Keccak256([]byte("FailedOp(uint256,string)"))[:4]
+					resp["error"] = map[string]any{"code": 3, "message": "execution reverted", "data": hexutil.Encode(append(selector, data...))}
+					delete(resp, "result")
+					break
+				}
+			}
+		case "eth_gasPrice":
+			resp["result"] = "0x3b9aca00"
+		case "eth_estimateGas":
+			resp["result"] = "0x186a0"
+		case "eth_getTransactionCount":
+			resp["result"] = "0x0"
+		case "eth_chainId":
+			resp["result"] = hexutil.EncodeBig(testChainId)
+		case "eth_sendRawTransaction":
+			sent.Add(1)
+			resp["result"] = txHash.String()
+		case "eth_getTransactionByHash":
+			// sent batches stay pending until they're mined
+			resp["result"] = nil
+			if sent.Load() != 0 {
+				resp["result"] = map[string]any{
+					"hash":     txHash.String(),
+					"from":     ethgo.ZeroAddress.String(),
+					"to":       testEntryPoint.String(),
+					"input":    "0x",
+					"value":    "0x0",
+					"gas":      "0x186a0",
+					"gasPrice": "0x3b9aca00",
+					"nonce":    "0x0",
+					"v":        "0x0",
+					"r":        "0x0",
+					"s":        "0x0",
+				}
+			}
+		case "eth_getTransactionReceipt":
+			l := included()
+			if l == nil {
+				resp["result"] = nil
+				break
+			}
+			logJson, err := l.MarshalJSON()
+			require.NoError(t, err)
+			resp["result"] = map[string]any{
+				"transactionHash":   txHash.String(),
+				"blockHash":         txHash.String(),
+				"blockNumber":       "0x1",
+				"transactionIndex":  "0x0",
+				"from":              ethgo.ZeroAddress.String(),
+				"to":                testEntryPoint.String(),
+				"gasUsed":           "0x186a0",
+				"cumulativeGasUsed": "0x186a0",
+				"logsBloom":         hexutil.Encode(make([]byte, 256)),
+				"status":            "0x1",
+				"logs":              []json.RawMessage{logJson},
+			}
+		default:
+			t.Fatalf("unexpected call %v", req.Method)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return
+}
+
+// includedLog is the entry point's UserOperationEvent for op succeeding.
+func includedLog(t *testing.T, b *Bundler, op *userop.UserOperation) *ethgo.Log {
+	opHash := ethgo.HexToHash(b.opHash(op))
+	data, err := abi.MustNewType("tuple(uint256 nonce, bool success, uint256 actualGasCost, uint256 actualGasUsed)").Encode(
+		map[string]any{"nonce": big.NewInt(0), "success": true, "actualGasCost": big.NewInt(1), "actualGasUsed": big.NewInt(1)})
+	require.NoError(t, err)
+	return &ethgo.Log{
+		Address: testEntryPoint,
+		Topics:  []ethgo.Hash{userOperationEvent.ID(), opHash, ethgo.BytesToHash(op.Sender.Bytes()), {}},
+		Data:    data,
+	}
+}
+
+func TestBundleDropsFailedOps(t *testing.T) {
+	badSender := ethgo.HexToAddress("0x00000000000000000000000000000000000000bb")
+	goodSender := ethgo.HexToAddress("0x00000000000000000000000000000000000000aa")
+	goodOp := testutil.MakeOp(t, goodSender, nil)
+	badOp := testutil.MakeOp(t, badSender, nil)
+
+	var b *Bundler
+	srv, _ := makeTestNode(t, badSender, func() *ethgo.Log { return includedLog(t, b, goodOp) })
+	client, err := rpc.Dial(srv.URL)
+	require.NoError(t, err)
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+
+	var dropped []ethgo.Address
+	b, err = New(client, testEntryPoint, testChainId, chain.NewSignerPool(&chain.EcdsaKey{SK: sk}), st, Config{
+		OnDrop: func(op *userop.UserOperation, _ string) { dropped = append(dropped, ethgo.Address(op.Sender)) },
+	})
+	require.NoError(t, err)
+
+	badHash, err := b.Add(badOp)
+	require.NoError(t, err)
+	goodHash, err := b.Add(goodOp)
+	require.NoError(t, err)
+	require.Equal(t, 2, b.Size())
+
+	require.NoError(t, b.Bundle(context.Background()))
+	// the good op's batch is sent, and settled on the next round
+	require.Equal(t, 1, b.Size())
+	require.NoError(t, b.Bundle(context.Background()))
+	require.Equal(t, 0, b.Size())
+
+	r, found, err := b.Status(badHash)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, OpDropped, r.Status)
+	require.Equal(t, "AA23 reverted", r.Reason)
+	require.Equal(t, []ethgo.Address{badSender}, dropped)
+
+	r, found, err = b.Status(goodHash)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, OpIncluded, r.Status)
+	require.True(t, *r.Success)
+}
+
+func TestBundleResolvesSubmittedOps(t *testing.T) {
+	sender := ethgo.HexToAddress("0x00000000000000000000000000000000000000aa")
+	op := testutil.MakeOp(t, sender, nil)
+
+	var b *Bundler
+	var mined atomic.Bool
+	srv, sent := makeTestNode(t, ethgo.ZeroAddress, func() *ethgo.Log {
+		if !mined.Load() {
+			return nil
+		}
+		return includedLog(t, b, op)
+	})
+	client, err := rpc.Dial(srv.URL)
+	require.NoError(t, err)
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+
+	var dropped []ethgo.Address
+	b, err = New(client, testEntryPoint, testChainId, chain.NewSignerPool(&chain.EcdsaKey{SK: sk}), st, Config{
+		OnDrop: func(op *userop.UserOperation, _ string) { dropped = append(dropped, ethgo.Address(op.Sender)) },
+	})
+	require.NoError(t, err)
+	opHash, err := b.Add(op)
+	require.NoError(t, err)
+
+	// the round returns once the batch is sent, leaving the op submitted
+	require.NoError(t, b.Bundle(context.Background()))
+	r, _, err := b.Status(opHash)
+	require.NoError(t, err)
+	require.Equal(t, OpSubmitted, r.Status)
+
+	// while the batch is pending its op is held back
+	require.NoError(t, b.Bundle(context.Background()))
+	require.Equal(t, int32(1), sent.Load())
+	require.Equal(t, 1, b.Size())
+
+	// once mined, the next round settles it rather than sending it again
+	mined.Store(true)
+	require.NoError(t, b.Bundle(context.Background()))
+	require.Equal(t, int32(1), sent.Load())
+	require.Equal(t, 0, b.Size())
+	require.Empty(t, dropped)
+	r, _, err = b.Status(opHash)
+	require.NoError(t, err)
+	require.Equal(t, OpIncluded, r.Status)
+}
+
+func TestAddReplacesOp(t *testing.T) {
+	sender := ethgo.HexToAddress("0x00000000000000000000000000000000000000aa")
+	op := testutil.MakeOp(t, sender, nil)
+	srv, _ := makeTestNode(t, ethgo.ZeroAddress, func() *ethgo.Log { return nil })
+	client, err := rpc.Dial(srv.URL)
+	require.NoError(t, err)
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	b, err := New(client, testEntryPoint, testChainId, chain.NewSignerPool(&chain.EcdsaKey{SK: sk}), st, Config{MinFeeBumpPercent: 20})
+	require.NoError(t, err)
+
+	opHash, err := b.Add(op)
+	require.NoError(t, err)
+	// sent again, it's still pending
+	_, err = b.Add(op)
+	require.NoError(t, err)
+
+	// the bundler's bump is required
+	short, err := replace.Speedup(op, nil, replace.MinFeeBumpPercent)
+	require.NoError(t, err)
+	_, err = b.Add(short)
+	require.ErrorContains(t, err, "at least 20%")
+
+	newOp, err := replace.Speedup(op, nil, 20)
+	require.NoError(t, err)
+	newHash, err := b.Add(newOp)
+	require.NoError(t, err)
+	require.Equal(t, 1, b.Size())
+	r, _, err := b.Status(opHash)
+	require.NoError(t, err)
+	require.Equal(t, OpReplaced, r.Status)
+	require.Equal(t, "replaced by "+newHash, r.Reason)
+	r, _, err = b.Status(newHash)
+	require.NoError(t, err)
+	require.Equal(t, OpPending, r.Status)
+}
@@ -1,22 +1,115 @@
 package chain
 
 import (
+	"context"
 	"fmt"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/umbracle/ethgo"
 	"github.com/umbracle/ethgo/contract"
+	"time"
 )
 
 var maybeTxOutput func(string)
 
+// SetTxOutput sets where TxnDoWait reports mined transactions, nil for nowhere.
+func SetTxOutput(fn func(string)) {
+	maybeTxOutput = fn
+}
+
+// DefaultTxnTimeout bounds waiting for a transaction to be mined when the caller
+// hasn't set a deadline.
+var DefaultTxnTimeout = 5 * time.Minute
+
+// Await runs an ethgo call, which can't take a context, and stops waiting for it when
+// ctx is done; the call itself runs on until its upstream times out. Calls that
+// should stop with ctx go through a go-ethereum rpc.Client's CallContext instead.
+func Await(ctx context.Context, call func() error) error {
+	if ctx.Done() == nil {
+		return call()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitReceipt polls for the transaction's receipt until it's mined or ctx is done.
+func WaitReceipt(ctx context.Context, client *rpc.Client, hash ethgo.Hash) (*ethgo.Receipt, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var receipt *ethgo.Receipt
+		if err := client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", hash.String()); err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("transaction %v not mined: %w", hash.String(), ctx.Err())
+			}
+			return nil, err
+		}
+		if receipt != nil {
+			return receipt, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("transaction %v not mined: %w", hash.String(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// contextTxn is a transaction that can be sent and waited for with a context
+type contextTxn interface {
+	DoContext(ctx context.Context) error
+	WaitContext(ctx context.Context) (*ethgo.Receipt, error)
+}
+
+// DoContext sends the transaction until ctx is done. ethgo's own transactions can't be
+// stopped, their send is only abandoned.
+func DoContext(ctx context.Context, txn contract.Txn) error {
+	if ct, ok := txn.(contextTxn); ok {
+		return ct.DoContext(ctx)
+	}
+	return Await(ctx, txn.Do)
+}
+
+// WaitContext waits for the sent transaction to be mined until ctx is done. ethgo's
+// own transactions can't be stopped, their wait is only abandoned.
+func WaitContext(ctx context.Context, txn contract.Txn) (receipt *ethgo.Receipt, err error) {
+	if ct, ok := txn.(contextTxn); ok {
+		return ct.WaitContext(ctx)
+	}
+	err = Await(ctx, func() (err error) {
+		receipt, err = txn.Wait()
+		return
+	})
+	return
+}
+
 func TxnDoWait(txn contract.Txn, errIn error) error {
+	return TxnDoWaitContext(context.Background(), txn, errIn)
+}
+
+// TxnDoWaitContext sends the transaction and waits for it until ctx is done, or for
+// DefaultTxnTimeout when ctx has no deadline.
+func TxnDoWaitContext(ctx context.Context, txn contract.Txn, errIn error) error {
 	if errIn != nil {
 		return errIn
 	}
-	if err := txn.Do(); err != nil {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTxnTimeout)
+		defer cancel()
+	}
+	if err := DoContext(ctx, txn); err != nil {
 		return err
 	} else {
 		var rcpt *ethgo.Receipt
-		if rcpt, err = txn.Wait(); err != nil {
+		if rcpt, err = WaitContext(ctx, txn); err != nil {
 			return err
 		}
 		if maybeTxOutput != nil {
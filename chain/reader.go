@@ -0,0 +1,205 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"sync"
+)
+
+// Multicall3 is where Multicall3 is deployed, at the same address on most chains.
+var Multicall3 = ethgo.HexToAddress("0xcA11bde05977b3631167028862bE2a173976CA11")
+
+var (
+	aggregate3Method    = abi.MustNewMethod("function aggregate3(tuple(address target, bool allowFailure, bytes callData)[] calls) payable returns (tuple(bool success, bytes returnData)[] returnData)")
+	getEthBalanceMethod = abi.MustNewMethod("function getEthBalance(address addr) view returns (uint256 balance)")
+)
+
+// Call is an eth_call of a contract, or a read of Target's ether balance when Data is
+// nil.
+type Call struct {
+	Target ethgo.Address
+	Data   []byte
+}
+
+// CallResult is what a Call returned, ABI encoded; a balance is encoded as a uint256.
+type CallResult struct {
+	Data []byte
+	// a *RevertError when the call reverted
+	Err error
+}
+
+// RevertError is a call's revert, with the data it reverted with.
+type RevertError struct {
+	Data []byte
+}
+
+func (e *RevertError) Error() string {
+	return fmt.Sprintf("execution reverted: %v", hexutil.Encode(e.Data))
+}
+
+// ErrorData gives the revert data the way JSON-RPC errors do.
+func (e *RevertError) ErrorData() interface{} {
+	return hexutil.Encode(e.Data)
+}
+
+// Reader makes chain reads in as few round trips as it can: independent JSON-RPC
+// requests go in one batch, and contract reads are aggregated through Multicall3.
+type Reader struct {
+	client    *rpc.Client
+	multicall ethgo.Address
+
+	mu sync.Mutex
+	// whether the multicall contract is deployed, nil until checked
+	deployed *bool
+}
+
+// NewReader returns a reader aggregating through the multicall contract, or making
+// calls one at a time when multicall is the zero address or isn't deployed.
+func NewReader(client *rpc.Client, multicall ethgo.Address) *Reader {
+	return &Reader{client: client, multicall: multicall}
+}
+
+// Client returns the client the reader calls through.
+func (r *Reader) Client() *rpc.Client {
+	return r.client
+}
+
+// CallElem is an eth_call at the latest block for Batch; the revert of a failed call is
+// left in the element's Error.
+func CallElem(to ethgo.Address, data []byte, result *hexutil.Bytes) rpc.BatchElem {
+	msg := map[string]any{"to": to.String(), "data": hexutil.Encode(data)}
+	return rpc.BatchElem{Method: "eth_call", Args: []any{msg, "latest"}, Result: result}
+}
+
+// Batch sends the requests in one JSON-RPC batch. The error is only for the batch as a
+// whole, each request's is left in its element.
+func (r *Reader) Batch(ctx context.Context, reqs []rpc.BatchElem) error {
+	if len(reqs) == 1 {
+		reqs[0].Error = r.client.CallContext(ctx, reqs[0].Result, reqs[0].Method, reqs[0].Args...)
+		return ctx.Err()
+	}
+	return r.client.BatchCallContext(ctx, reqs)
+}
+
+// AsRevert returns the call's error as a *RevertError if the node says it reverted.
+func AsRevert(err error) (*RevertError, bool) {
+	var dataErr rpc.DataError
+	if !errors.As(err, &dataErr) {
+		return nil, false
+	}
+	s, ok := dataErr.ErrorData().(string)
+	if !ok {
+		return nil, false
+	}
+	data, decodeErr := hexutil.Decode(s)
+	if decodeErr != nil {
+		return nil, false
+	}
+	return &RevertError{Data: data}, true
+}
+
+func (r *Reader) hasMulticall(ctx context.Context) (bool, error) {
+	if r.multicall == ethgo.ZeroAddress {
+		return false, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deployed != nil {
+		return *r.deployed, nil
+	}
+	var code hexutil.Bytes
+	if err := r.client.CallContext(ctx, &code, "eth_getCode", r.multicall.String(), "latest"); err != nil {
+		return false, err
+	}
+	deployed := len(code) != 0
+	r.deployed = &deployed
+	return deployed, nil
+}
+
+// Aggregate makes the calls in one eth_call through Multicall3, or one at a time when
+// it isn't deployed. A call's revert is in its result, the error is for the reads
+// failing.
+func (r *Reader) Aggregate(ctx context.Context, calls []Call) ([]CallResult, error) {
+	deployed, err := r.hasMulticall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !deployed {
+		return r.sequential(ctx, calls)
+	}
+
+	var encoded []map[string]any
+	for _, c := range calls {
+		target, data := c.Target, c.Data
+		if data == nil {
+			target = r.multicall
+			if data, err = getEthBalanceMethod.Encode([]any{c.Target}); err != nil {
+				return nil, err
+			}
+		}
+		encoded = append(encoded, map[string]any{"target": target, "allowFailure": true, "callData": data})
+	}
+	input, err := aggregate3Method.Encode([]any{encoded})
+	if err != nil {
+		return nil, err
+	}
+	var out hexutil.Bytes
+	reqs := []rpc.BatchElem{CallElem(r.multicall, input, &out)}
+	if err = r.Batch(ctx, reqs); err != nil {
+		return nil, err
+	}
+	if reqs[0].Error != nil {
+		return nil, fmt.Errorf("aggregate3: %w", reqs[0].Error)
+	}
+	res, err := aggregate3Method.Decode(out)
+	if err != nil {
+		return nil, err
+	}
+	returned, ok := res["returnData"].([]map[string]interface{})
+	if !ok || len(returned) != len(calls) {
+		return nil, fmt.Errorf("unexpected - aggregate3 returned %v results for %v calls", len(returned), len(calls))
+	}
+	results := make([]CallResult, len(calls))
+	for i, ret := range returned {
+		data, _ := ret["returnData"].([]byte)
+		if success, _ := ret["success"].(bool); success {
+			results[i].Data = data
+		} else {
+			results[i].Err = &RevertError{Data: data}
+		}
+	}
+	return results, nil
+}
+
+func (r *Reader) sequential(ctx context.Context, calls []Call) ([]CallResult, error) {
+	results := make([]CallResult, len(calls))
+	for i, c := range calls {
+		if c.Data == nil {
+			var balance hexutil.Big
+			if err := r.client.CallContext(ctx, &balance, "eth_getBalance", c.Target.String(), "latest"); err != nil {
+				return nil, err
+			}
+			results[i].Data = ethgo.BytesToHash((*big.Int)(&balance).Bytes()).Bytes()
+			continue
+		}
+		var out hexutil.Bytes
+		reqs := []rpc.BatchElem{CallElem(c.Target, c.Data, &out)}
+		if err := r.Batch(ctx, reqs); err != nil {
+			return nil, err
+		}
+		if reqs[0].Error == nil {
+			results[i].Data = out
+		} else if revert, ok := AsRevert(reqs[0].Error); ok {
+			results[i].Err = revert
+		} else {
+			return nil, reqs[0].Error
+		}
+	}
+	return results, nil
+}
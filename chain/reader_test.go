@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var (
+	testToken    = ethgo.HexToAddress("0x00000000000000000000000000000000000000aa")
+	testReverter = ethgo.HexToAddress("0x00000000000000000000000000000000000000bb")
+	testHolder   = ethgo.HexToAddress("0x00000000000000000000000000000000000000cc")
+)
+
+// stands in for a node, with Multicall3 deployed when multicall is set
+func makeTestReaderNode(t *testing.T, multicall bool, requests *int) *httptest.Server {
+	uint256 := func(n int64) []byte { return ethgo.BytesToHash(big.NewInt(n).Bytes()).Bytes() }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		req := rpcRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.Id}
+		switch req.Method {
+		case "eth_getCode":
+			resp["result"] = "0x"
+			if multicall {
+				resp["result"] = "0x01"
+			}
+		case "eth_getBalance":
+			resp["result"] = "0x64"
+		case "eth_call":
+			msg := struct {
+				To   ethgo.Address `json:"to"`
+				Data hexutil.Bytes `json:"data"`
+			}{}
+			require.NoError(t, json.Unmarshal(req.Params[0], &msg))
+			switch msg.To {
+			case testToken:
+				resp["result"] = hexutil.Encode(uint256(7))
+			case testReverter:
+				resp["error"] = map[string]any{"code": 3, "message": "execution reverted", "data": "0xdeadbeef"}
+			case Multicall3:
+				args, err := aggregate3Method.Inputs.Decode(msg.Data[4:])
+				require.NoError(t, err)
+				var returned []map[string]any
+				for _, c := range args.(map[string]interface{})["calls"].([]map[string]interface{}) {
+					switch c["target"].(ethgo.Address) {
+					case Multicall3:
+						returned = append(returned, map[string]any{"success": true, "returnData": uint256(100)})
+					case testToken:
+						returned = append(returned, map[string]any{"success": true, "returnData": uint256(7)})
+					default:
+						returned = append(returned, map[string]any{"success": false, "returnData": []byte{0xde, 0xad, 0xbe, 0xef}})
+					}
+				}
+				out, err := aggregate3Method.Outputs.Encode([]any{returned})
+				require.NoError(t, err)
+				resp["result"] = hexutil.Encode(out)
+			}
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReaderAggregate(t *testing.T) {
+	calls := []Call{
+		{Target: testToken, Data: []byte{0x01}},
+		{Target: testReverter, Data: []byte{0x02}},
+		{Target: testHolder},
+	}
+	for _, multicall := range []bool{true, false} {
+		requests := 0
+		srv := makeTestReaderNode(t, multicall, &requests)
+		client, err := rpc.Dial(srv.URL)
+		require.NoError(t, err)
+		r := NewReader(client, Multicall3)
+
+		results, err := r.Aggregate(context.Background(), calls)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		require.NoError(t, results[0].Err)
+		require.Equal(t, int64(7), new(big.Int).SetBytes(results[0].Data).Int64())
+		require.Equal(t, &RevertError{Data: []byte{0xde, 0xad, 0xbe, 0xef}}, results[1].Err)
+		require.NoError(t, results[2].Err)
+		require.Equal(t, int64(100), new(big.Int).SetBytes(results[2].Data).Int64())
+
+		// the deploy check is made once, then each aggregate is one round trip
+		requests = 0
+		_, err = r.Aggregate(context.Background(), calls)
+		require.NoError(t, err)
+		if multicall {
+			require.Equal(t, 1, requests)
+		} else {
+			require.Equal(t, len(calls), requests)
+		}
+	}
+}
+
+func TestReaderBatchRevert(t *testing.T) {
+	requests := 0
+	srv := makeTestReaderNode(t, false, &requests)
+	client, err := rpc.Dial(srv.URL)
+	require.NoError(t, err)
+
+	var out hexutil.Bytes
+	reqs := []rpc.BatchElem{CallElem(testReverter, nil, &out)}
+	require.NoError(t, NewReader(client, ethgo.ZeroAddress).Batch(context.Background(), reqs))
+	revert, ok := AsRevert(reqs[0].Error)
+	require.True(t, ok)
+	require.True(t, strings.HasSuffix(revert.Error(), "0xdeadbeef"))
+}
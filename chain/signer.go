@@ -0,0 +1,222 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/wallet"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// Signer signs for an address, either with a key held in this process or through
+// a remote signer that holds it instead.
+type Signer interface {
+	Address() ethgo.Address
+	// SignHash returns the eth_sign signature of a 32 byte hash, that is over
+	// crypto.EthSignedMessageHash(hash), with v as 27 or 28
+	SignHash(hash []byte) ([]byte, error)
+	// SignTx returns the RLP encoding of the signed legacy transaction
+	SignTx(tx *ethgo.Transaction) ([]byte, error)
+}
+
+var _ Signer = &EcdsaKey{}
+var _ Signer = &RemoteSigner{}
+
+func (e *EcdsaKey) SignHash(hash []byte) ([]byte, error) {
+	sig, err := crypto.Sign(e.SK, crypto.EthSignedMessageHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+func (e *EcdsaKey) SignTx(tx *ethgo.Transaction) ([]byte, error) {
+	signed, err := wallet.NewEIP155Signer(tx.ChainID.Uint64()).SignTx(tx, e)
+	if err != nil {
+		return nil, err
+	}
+	return signed.MarshalRLPTo(nil)
+}
+
+// RemoteSigner signs through a Web3Signer compatible JSON-RPC API: eth_accounts,
+// eth_sign and eth_signTransaction.
+type RemoteSigner struct {
+	rpc     *rpc.Client
+	address ethgo.Address
+	timeout time.Duration
+}
+
+// DefaultSignerTimeout bounds each remote signer call when no timeout is given.
+const DefaultSignerTimeout = 10 * time.Second
+
+// NewRemoteSigner connects to the signer at url, signing as addr, or as the first
+// account the signer lists when addr is the zero address. Each call to the signer
+// gives up after timeout.
+func NewRemoteSigner(url string, addr ethgo.Address, timeout time.Duration) (*RemoteSigner, error) {
+	if timeout <= 0 {
+		timeout = DefaultSignerTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	r := &RemoteSigner{rpc: client, timeout: timeout}
+	var accounts []ethgo.Address
+	if err = r.call(&accounts, "eth_accounts"); err != nil {
+		return nil, fmt.Errorf("remote signer at %v: %w", url, err)
+	}
+	if addr == ethgo.ZeroAddress {
+		if len(accounts) == 0 {
+			return nil, fmt.Errorf("remote signer at %v has no accounts", url)
+		}
+		addr = accounts[0]
+	} else {
+		found := false
+		for _, account := range accounts {
+			found = found || account == addr
+		}
+		if !found {
+			return nil, fmt.Errorf("remote signer at %v has no account %v", url, addr.String())
+		}
+	}
+	r.address = addr
+	return r, nil
+}
+
+// call is a JSON-RPC call to the signer that gives up after the signer's timeout, so
+// a hung signer doesn't hold up the bundler or the handler waiting on it.
+func (r *RemoteSigner) call(result any, method string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return r.rpc.CallContext(ctx, result, method, args...)
+}
+
+func (r *RemoteSigner) Address() ethgo.Address {
+	return r.address
+}
+
+// SignHash checks the remote signature the way local ones are: canonical, and by
+// the signer's address.
+func (r *RemoteSigner) SignHash(hash []byte) ([]byte, error) {
+	var sig hexutil.Bytes
+	if err := r.call(&sig, "eth_sign", r.address, hexutil.Bytes(hash)); err != nil {
+		return nil, err
+	}
+	signer, err := crypto.Ecrecover(crypto.EthSignedMessageHash(hash), sig)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer returned an invalid signature: %w", err)
+	}
+	if signer != r.address {
+		return nil, fmt.Errorf("remote signer signed as %v, not %v", signer.String(), r.address.String())
+	}
+	if sig[64] < 27 {
+		sig[64] += 27
+	}
+	return sig, nil
+}
+
+// SignTx has the remote signer sign tx for its chain id, and checks the transaction
+// it returns is tx, signed for that chain by the signer's address.
+func (r *RemoteSigner) SignTx(tx *ethgo.Transaction) ([]byte, error) {
+	if tx.ChainID == nil || !tx.ChainID.IsUint64() {
+		return nil, fmt.Errorf("remote signing needs the transaction's chain id")
+	}
+	req := map[string]any{
+		"from":     r.address,
+		"gas":      hexutil.Uint64(tx.Gas),
+		"gasPrice": hexutil.Uint64(tx.GasPrice),
+		"nonce":    hexutil.Uint64(tx.Nonce),
+		"value":    (*hexutil.Big)(new(big.Int)),
+		"data":     hexutil.Bytes(tx.Input),
+		"chainId":  (*hexutil.Big)(tx.ChainID),
+	}
+	if tx.To != nil {
+		req["to"] = *tx.To
+	}
+	if tx.Value != nil {
+		req["value"] = (*hexutil.Big)(tx.Value)
+	}
+	var raw hexutil.Bytes
+	if err := r.call(&raw, "eth_signTransaction", req); err != nil {
+		return nil, err
+	}
+	if err := r.checkSignedTx(tx, raw); err != nil {
+		return nil, fmt.Errorf("remote signer returned a bad transaction: %w", err)
+	}
+	return raw, nil
+}
+
+func (r *RemoteSigner) checkSignedTx(tx *ethgo.Transaction, raw []byte) error {
+	signed := &ethgo.Transaction{}
+	if err := signed.UnmarshalRLP(raw); err != nil {
+		return err
+	}
+	value := tx.Value
+	if value == nil {
+		value = new(big.Int)
+	}
+	if signed.Type != ethgo.TransactionLegacy || signed.Nonce != tx.Nonce || signed.Gas != tx.Gas ||
+		signed.GasPrice != tx.GasPrice || signed.Value.Cmp(value) != 0 || !bytes.Equal(signed.Input, tx.Input) ||
+		(signed.To == nil) != (tx.To == nil) || (tx.To != nil && *signed.To != *tx.To) {
+		return fmt.Errorf("it isn't the transaction that was asked for")
+	}
+
+	// EIP-155: v is chainId * 2 + 35 + the recovery id
+	chainId := tx.ChainID.Uint64()
+	v := new(big.Int).SetBytes(signed.V)
+	recId := new(big.Int).Sub(v, new(big.Int).SetUint64(chainId*2+35))
+	if recId.Sign() < 0 || recId.Cmp(big.NewInt(1)) > 0 {
+		return fmt.Errorf("it isn't signed for chain %v", chainId)
+	}
+	if len(signed.R) > 32 || len(signed.S) > 32 {
+		return crypto.ErrSignatureRange
+	}
+	sig := make([]byte, 65)
+	new(big.Int).SetBytes(signed.R).FillBytes(sig[:32])
+	new(big.Int).SetBytes(signed.S).FillBytes(sig[32:64])
+	sig[64] = byte(recId.Uint64())
+	if err := crypto.ValidateSignature(sig); err != nil {
+		return err
+	}
+	sender, err := wallet.NewEIP155Signer(chainId).RecoverSender(signed)
+	if err != nil {
+		return err
+	}
+	if sender != r.address {
+		return fmt.Errorf("it's signed by %v, not %v", sender.String(), r.address.String())
+	}
+	return nil
+}
+
+// SignerPool hands out its signers round robin, so transactions from different
+// signers don't queue behind each other's nonces.
+type SignerPool struct {
+	signers []Signer
+	next    uint32
+}
+
+func NewSignerPool(signers ...Signer) *SignerPool {
+	return &SignerPool{signers: signers}
+}
+
+// Next returns the next signer, nil if the pool is empty.
+func (p *SignerPool) Next() Signer {
+	if len(p.signers) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&p.next, 1) - 1
+	return p.signers[int(i)%len(p.signers)]
+}
+
+func (p *SignerPool) Signers() []Signer {
+	return p.signers
+}
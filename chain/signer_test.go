@@ -0,0 +1,184 @@
+package chain
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/wallet"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testChainId = 1337
+
+type rpcRequest struct {
+	Id     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type signTxRequest struct {
+	From     ethgo.Address  `json:"from"`
+	To       *ethgo.Address `json:"to"`
+	Gas      hexutil.Uint64 `json:"gas"`
+	GasPrice hexutil.Uint64 `json:"gasPrice"`
+	Nonce    hexutil.Uint64 `json:"nonce"`
+	Value    *hexutil.Big   `json:"value"`
+	Data     hexutil.Bytes  `json:"data"`
+	ChainId  *hexutil.Big   `json:"chainId"`
+}
+
+// stands in for Web3Signer, holding key
+func makeTestSignerServer(t *testing.T, key *EcdsaKey) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := rpcRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		var result any
+		switch req.Method {
+		case "eth_accounts":
+			result = []ethgo.Address{key.Address()}
+		case "eth_sign":
+			var data hexutil.Bytes
+			require.NoError(t, json.Unmarshal(req.Params[1], &data))
+			sig, err := crypto.Sign(key.SK, crypto.EthPersonalMessageHash(data))
+			require.NoError(t, err)
+			sig[64] += 27
+			result = hexutil.Bytes(sig)
+		case "eth_signTransaction":
+			txReq := signTxRequest{}
+			require.NoError(t, json.Unmarshal(req.Params[0], &txReq))
+			tx, err := wallet.NewEIP155Signer(txReq.ChainId.ToInt().Uint64()).SignTx(&ethgo.Transaction{
+				To:       txReq.To,
+				Gas:      uint64(txReq.Gas),
+				GasPrice: uint64(txReq.GasPrice),
+				Nonce:    uint64(txReq.Nonce),
+				Value:    txReq.Value.ToInt(),
+				Input:    txReq.Data,
+			}, key)
+			require.NoError(t, err)
+			raw, err := tx.MarshalRLPTo(nil)
+			require.NoError(t, err)
+			result = hexutil.Bytes(raw)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.Id, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRemoteSigner(t *testing.T) {
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	key := &EcdsaKey{SK: sk}
+	srv := makeTestSignerServer(t, key)
+
+	_, err = NewRemoteSigner(srv.URL, ethgo.HexToAddress("0x0000000000000000000000000000000000000001"), 0)
+	require.Error(t, err)
+	remote, err := NewRemoteSigner(srv.URL, ethgo.ZeroAddress, 0)
+	require.NoError(t, err)
+	require.Equal(t, key.Address(), remote.Address())
+
+	// both sign the same way
+	hash := ethgo.Keccak256([]byte("hello"))
+	localSig, err := key.SignHash(hash)
+	require.NoError(t, err)
+	remoteSig, err := remote.SignHash(hash)
+	require.NoError(t, err)
+	require.Equal(t, localSig, remoteSig)
+
+	recoverSig := append([]byte{}, remoteSig...)
+	recoverSig[64] -= 27
+	addr, err := wallet.Ecrecover(crypto.EthSignedMessageHash(hash), recoverSig)
+	require.NoError(t, err)
+	require.Equal(t, key.Address(), addr)
+
+	to := ethgo.HexToAddress("0x0000000000000000000000000000000000000002")
+	raw, err := remote.SignTx(&ethgo.Transaction{
+		To:       &to,
+		Gas:      21000,
+		GasPrice: 1e9,
+		Nonce:    3,
+		Value:    big.NewInt(5),
+		Input:    []byte{1, 2},
+		ChainID:  big.NewInt(testChainId),
+	})
+	require.NoError(t, err)
+	tx := &ethgo.Transaction{}
+	require.NoError(t, tx.UnmarshalRLP(raw))
+	require.Equal(t, uint64(3), tx.Nonce)
+	sender, err := wallet.NewEIP155Signer(testChainId).RecoverSender(tx)
+	require.NoError(t, err)
+	require.Equal(t, key.Address(), sender)
+}
+
+// a signer that signs with high s, and transactions for chain 1 whatever it's asked
+func TestRemoteSignerChecks(t *testing.T) {
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	key := &EcdsaKey{SK: sk}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := rpcRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		var result any
+		switch req.Method {
+		case "eth_accounts":
+			result = []ethgo.Address{key.Address()}
+		case "eth_sign":
+			var data hexutil.Bytes
+			require.NoError(t, json.Unmarshal(req.Params[1], &data))
+			sig, err := crypto.Sign(key.SK, crypto.EthPersonalMessageHash(data))
+			require.NoError(t, err)
+			highS := new(big.Int).Sub(crypto.S256.N, new(big.Int).SetBytes(sig[32:64]))
+			highS.FillBytes(sig[32:64])
+			sig[64] = 1 - sig[64] + 27
+			result = hexutil.Bytes(sig)
+		case "eth_signTransaction":
+			txReq := signTxRequest{}
+			require.NoError(t, json.Unmarshal(req.Params[0], &txReq))
+			tx, err := wallet.NewEIP155Signer(1).SignTx(&ethgo.Transaction{
+				To:       txReq.To,
+				Gas:      uint64(txReq.Gas),
+				GasPrice: uint64(txReq.GasPrice),
+				Nonce:    uint64(txReq.Nonce),
+				Value:    txReq.Value.ToInt(),
+				Input:    txReq.Data,
+			}, key)
+			require.NoError(t, err)
+			raw, err := tx.MarshalRLPTo(nil)
+			require.NoError(t, err)
+			result = hexutil.Bytes(raw)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.Id, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+
+	remote, err := NewRemoteSigner(srv.URL, ethgo.ZeroAddress, 0)
+	require.NoError(t, err)
+	_, err = remote.SignHash(ethgo.Keccak256([]byte("hello")))
+	require.ErrorIs(t, err, crypto.ErrSignatureHighS)
+
+	to := ethgo.HexToAddress("0x0000000000000000000000000000000000000002")
+	_, err = remote.SignTx(&ethgo.Transaction{To: &to, Gas: 21000, GasPrice: 1e9, ChainID: big.NewInt(testChainId)})
+	require.ErrorContains(t, err, "isn't signed for chain")
+}
+
+func TestRemoteSignerTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(hung) })
+
+	start := time.Now()
+	_, err := NewRemoteSigner(srv.URL, ethgo.ZeroAddress, 100*time.Millisecond)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
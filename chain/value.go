@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+)
+
+// signerTxn is a transaction signed by a Signer; contract.Contract can only send
+// method calls signed by a local ethgo.Key. Its calls go through a go-ethereum client,
+// so they stop when their context is done.
+type signerTxn struct {
+	client *rpc.Client
+	signer Signer
+	to     ethgo.Address
+	data   []byte
+	opts   *contract.TxnOpts
+	hash   ethgo.Hash
+}
+
+// ValueTxn returns a transaction sending value from signer to the address, for TxnDoWait.
+func ValueTxn(client *rpc.Client, signer Signer, to ethgo.Address, value *big.Int) contract.Txn {
+	return SignerTxn(client, signer, to, value, nil)
+}
+
+// SignerTxn returns a transaction from signer calling the address with data.
+func SignerTxn(client *rpc.Client, signer Signer, to ethgo.Address, value *big.Int, data []byte) contract.Txn {
+	if value == nil {
+		value = new(big.Int)
+	}
+	return &signerTxn{client: client, signer: signer, to: to, data: data, opts: &contract.TxnOpts{Value: value}}
+}
+
+func (t *signerTxn) Hash() ethgo.Hash {
+	return t.hash
+}
+
+func (t *signerTxn) WithOpts(opts *contract.TxnOpts) {
+	t.opts = opts
+}
+
+func (t *signerTxn) Do() error {
+	return t.DoContext(context.Background())
+}
+
+// DoContext signs and sends the transaction, until ctx is done.
+func (t *signerTxn) DoContext(ctx context.Context) error {
+	from := t.signer.Address()
+	var num hexutil.Uint64
+	if t.opts.GasPrice == 0 {
+		if err := t.client.CallContext(ctx, &num, "eth_gasPrice"); err != nil {
+			return err
+		}
+		t.opts.GasPrice = uint64(num)
+	}
+	if t.opts.GasLimit == 0 {
+		msg := map[string]any{"from": from.String(), "to": t.to.String(), "data": hexutil.Encode(t.data), "value": (*hexutil.Big)(t.opts.Value)}
+		if err := t.client.CallContext(ctx, &num, "eth_estimateGas", msg); err != nil {
+			return err
+		}
+		t.opts.GasLimit = uint64(num)
+	}
+	if t.opts.Nonce == 0 {
+		if err := t.client.CallContext(ctx, &num, "eth_getTransactionCount", from.String(), "pending"); err != nil {
+			return fmt.Errorf("failed to get nonce: %v", err)
+		}
+		t.opts.Nonce = uint64(num)
+	}
+	var chainId hexutil.Big
+	if err := t.client.CallContext(ctx, &chainId, "eth_chainId"); err != nil {
+		return err
+	}
+
+	raw, err := t.signer.SignTx(&ethgo.Transaction{
+		From:     from,
+		To:       &t.to,
+		Input:    t.data,
+		Value:    t.opts.Value,
+		GasPrice: t.opts.GasPrice,
+		Gas:      t.opts.GasLimit,
+		Nonce:    t.opts.Nonce,
+		ChainID:  chainId.ToInt(),
+	})
+	if err != nil {
+		return err
+	}
+	return t.client.CallContext(ctx, &t.hash, "eth_sendRawTransaction", hexutil.Encode(raw))
+}
+
+// Wait waits up to DefaultTxnTimeout for the transaction to be mined.
+func (t *signerTxn) Wait() (*ethgo.Receipt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTxnTimeout)
+	defer cancel()
+	return t.WaitContext(ctx)
+}
+
+func (t *signerTxn) WaitContext(ctx context.Context) (*ethgo.Receipt, error) {
+	return WaitReceipt(ctx, t.client, t.hash)
+}
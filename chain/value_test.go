@@ -0,0 +1,40 @@
+package chain
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignerTxnCancel(t *testing.T) {
+	// a node that never answers, noting when the request is given up
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only sees the client go once the request is read
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := rpc.Dial(srv.URL)
+	require.NoError(t, err)
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+
+	txn := SignerTxn(client, &EcdsaKey{SK: sk}, ethgo.ZeroAddress, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, DoContext(ctx, txn), context.DeadlineExceeded)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the call went on after its context was done")
+	}
+}
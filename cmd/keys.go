@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/oneness/erc-4337-api/auth"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manages API keys, keystore files and the HD wallet mnemonic",
+	Long: `The API key commands operate on the local store directly, so the server must not be running.
+A running server revokes keys with POST admin/apikeys/<id>/revoke, authenticated with an admin key.
+generate, import and export-address write and read the v3 keystore files used by
+ERC4337_API_ETH_CLIENT_KEYSTORE and ERC4337_API_PAYMASTER_VERIFIER_KEYSTORE.
+The mnemonic commands manage the HD wallet the server keys can be derived from.`,
+}
+
+func withAPIKeys(fn func(keys *auth.APIKeys) error) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	st, err := store.Open(cfg.StoreDir)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	return fn(auth.NewAPIKeys(st))
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates an API key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		scopesFlag, _ := cmd.Flags().GetString("scopes")
+		rateLimit, _ := cmd.Flags().GetInt("rate-limit")
+		dailyOps, _ := cmd.Flags().GetInt("daily-ops")
+
+		scopes, err := auth.ParseScopes(scopesFlag)
+		if err != nil {
+			return err
+		}
+		return withAPIKeys(func(keys *auth.APIKeys) error {
+			keyString, k, err := keys.Create(name, scopes, rateLimit, dailyOps)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("created api key '%v' (id %v)\n", k.Name, k.Id)
+			fmt.Printf("%v\n", keyString)
+			fmt.Println("store it now - it can't be shown again")
+			return nil
+		})
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists API keys",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAPIKeys(func(keys *auth.APIKeys) error {
+			list, err := keys.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tSCOPES\tRATE/MIN\tDAILY OPS\tUSED TODAY\tCREATED\tSTATUS")
+			for _, k := range list {
+				var scopes []string
+				for _, s := range k.Scopes {
+					scopes = append(scopes, string(s))
+				}
+				used, _ := keys.OpsToday(k)
+				status := "active"
+				if k.RevokedAt != nil {
+					status = "revoked " + k.RevokedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", k.Id, k.Name, strings.Join(scopes, ","),
+					k.RateLimit, k.DailyOps, used, k.CreatedAt.Format(time.RFC3339), status)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revokes an API key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAPIKeys(func(keys *auth.APIKeys) error {
+			if err := keys.Revoke(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("revoked api key %v\n", args[0])
+			return nil
+		})
+	},
+}
+
+var keysMnemonicCmd = &cobra.Command{
+	Use:   "mnemonic",
+	Short: "Generates a mnemonic into a new file, for ERC4337_API_MNEMONIC_FILE",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, _ := cmd.Flags().GetString("out")
+		if _, err := os.Stat(out); err == nil {
+			return fmt.Errorf("%v already exists", out)
+		}
+		mnemonic, err := crypto.NewMnemonic()
+		if err != nil {
+			return err
+		}
+		w, err := crypto.NewHDWallet(mnemonic, "", "")
+		if err != nil {
+			return err
+		}
+		sk, err := w.Key(config.HDIndexRelayer)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(out, []byte(mnemonic+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("wrote mnemonic to %v, relayer address %v\n", out, crypto.PubKeyToAddress(&sk.PublicKey).String())
+		return nil
+	},
+}
+
+var keysHDAddressesCmd = &cobra.Command{
+	Use:   "hd-addresses",
+	Short: "Prints the addresses derived from the mnemonic",
+	Long:  "Prints the relayer, verifier, faucet and submitter addresses derived from ERC4337_API_MNEMONIC(_FILE), or from --mnemonic-file. Keys are never printed.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		if mnemonicFile, _ := cmd.Flags().GetString("mnemonic-file"); len(mnemonicFile) != 0 {
+			if cfg.Mnemonic, err = crypto.ReadSecretFile(mnemonicFile); err != nil {
+				return err
+			}
+		}
+		if cmd.Flags().Changed("submitters") {
+			cfg.SubmitterCount, _ = cmd.Flags().GetInt("submitters")
+		}
+		w, err := cfg.HDWallet()
+		if err != nil {
+			return err
+		}
+
+		type role struct {
+			name  string
+			index uint32
+		}
+		roles := []role{{"relayer", config.HDIndexRelayer}, {"verifier", config.HDIndexVerifier}, {"faucet", config.HDIndexFaucet}}
+		for i := 0; i < cfg.SubmitterCount; i++ {
+			roles = append(roles, role{fmt.Sprintf("submitter %v", i), uint32(config.HDIndexSubmitters + i)})
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROLE\tPATH\tADDRESS")
+		for _, r := range roles {
+			sk, err := w.Key(r.index)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", r.name, w.Path(r.index), crypto.PubKeyToAddress(&sk.PublicKey).String())
+		}
+		return tw.Flush()
+	},
+}
+
+func init() {
+	keysMnemonicCmd.Flags().StringP("out", "o", "", "file to write the mnemonic to")
+	_ = keysMnemonicCmd.MarkFlagRequired("out")
+	keysHDAddressesCmd.Flags().String("mnemonic-file", "", "file holding the mnemonic, instead of the configured one")
+	keysHDAddressesCmd.Flags().Int("submitters", 0, "number of submitter addresses, defaults to ERC4337_API_SUBMITTER_KEYS")
+
+	keysCreateCmd.Flags().String("name", "", "name to identify the key by")
+	keysCreateCmd.Flags().String("scopes", string(auth.ScopeInfo), "comma separated scopes: info, build, send, admin")
+	keysCreateCmd.Flags().Int("rate-limit", 60, "requests per minute, 0 for unlimited")
+	keysCreateCmd.Flags().Int("daily-ops", 1000, "ops built per day, 0 for unlimited")
+	_ = keysCreateCmd.MarkFlagRequired("name")
+
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd, keysMnemonicCmd, keysHDAddressesCmd)
+	rootCmd.AddCommand(keysCmd)
+}
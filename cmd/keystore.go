@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+)
+
+// keystorePassphrase reads the passphrase from --password-file, else
+// ERC4337_API_KEYSTORE_PASSWORD(_FILE), else prompts for it, twice if confirm.
+func keystorePassphrase(cmd *cobra.Command, prompt string, confirm bool) (string, error) {
+	if passwordFile, _ := cmd.Flags().GetString("password-file"); len(passwordFile) != 0 {
+		return crypto.ReadSecretFile(passwordFile)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.KeystorePassword) != 0 {
+		return cfg.KeystorePassword, nil
+	}
+	passphrase, err := crypto.PromptPassphrase(prompt)
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+	again, err := crypto.PromptPassphrase("repeat the passphrase")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", fmt.Errorf("the passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func writeKeystore(cmd *cobra.Command, sk *ecdsa.PrivateKey) error {
+	out, _ := cmd.Flags().GetString("out")
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%v already exists", out)
+	}
+	passphrase, err := keystorePassphrase(cmd, "passphrase for the new keystore", true)
+	if err != nil {
+		return err
+	}
+	scryptN, scryptP := crypto.StandardScryptN, crypto.StandardScryptP
+	if light, _ := cmd.Flags().GetBool("light"); light {
+		scryptN, scryptP = crypto.LightScryptN, crypto.LightScryptP
+	}
+	keyJSON, err := crypto.EncryptKeystore(sk, passphrase, scryptN, scryptP)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(out, keyJSON, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote keystore for %v to %v\n", crypto.PubKeyToAddress(&sk.PublicKey).String(), out)
+	return nil
+}
+
+var keystoreGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generates a key into a new keystore file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sk, err := crypto.RandSK()
+		if err != nil {
+			return err
+		}
+		return writeKeystore(cmd, sk)
+	},
+}
+
+var keystoreImportCmd = &cobra.Command{
+	Use:   "import <hex key file>",
+	Short: "Encrypts a raw hex key into a new keystore file",
+	Long:  "Reads the key from the file, or from stdin when the file is '-', so it doesn't end up in the shell history.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var keyHex string
+		if args[0] == "-" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			keyHex = strings.TrimSpace(line)
+		} else {
+			keyBytes, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			keyHex = strings.TrimSpace(string(keyBytes))
+		}
+		sk, err := crypto.SKFromHex(strings.TrimPrefix(keyHex, "0x"))
+		if err != nil {
+			return fmt.Errorf("invalid hex key: %v", err.Error())
+		}
+		return writeKeystore(cmd, sk)
+	},
+}
+
+var keystoreExportAddressCmd = &cobra.Command{
+	Use:   "export-address <keystore file>",
+	Short: "Prints a keystore's address",
+	Long:  "Prints the address without a passphrase, or with --verify decrypts the keystore to check it.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if verify, _ := cmd.Flags().GetBool("verify"); verify {
+			passphrase, err := keystorePassphrase(cmd, "passphrase for "+args[0], false)
+			if err != nil {
+				return err
+			}
+			sk, err := crypto.LoadKeystore(args[0], passphrase)
+			if err != nil {
+				return err
+			}
+			fmt.Println(crypto.PubKeyToAddress(&sk.PublicKey).String())
+			return nil
+		}
+		addr, err := crypto.KeystoreAddress(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(addr.String())
+		return nil
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{keystoreGenerateCmd, keystoreImportCmd} {
+		c.Flags().StringP("out", "o", "", "keystore file to write")
+		c.Flags().Bool("light", false, "use light scrypt parameters, for test keys only")
+		_ = c.MarkFlagRequired("out")
+	}
+	for _, c := range []*cobra.Command{keystoreGenerateCmd, keystoreImportCmd, keystoreExportAddressCmd} {
+		c.Flags().String("password-file", "", "file holding the keystore passphrase")
+	}
+	keystoreExportAddressCmd.Flags().Bool("verify", false, "decrypt the keystore to check the passphrase and address")
+
+	keysCmd.AddCommand(keystoreGenerateCmd, keystoreImportCmd, keystoreExportAddressCmd)
+}
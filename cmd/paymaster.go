@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/spf13/cobra"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+	"strconv"
+)
+
+var paymasterCmd = &cobra.Command{
+	Use:   "paymaster",
+	Short: "Administers the VerifyingPaymaster and its EntryPoint deposit",
+	Long: "The paymaster commands send transactions to the VerifyingPaymaster at --address, or the configured " +
+		"paymaster address, signed with the configured chain key. With --dry-run the calldata is printed instead.",
+}
+
+func parseAddressArg(s string) (ethgo.Address, error) {
+	if len(s) != len(ethgo.ZeroAddress.String()) {
+		return ethgo.ZeroAddress, fmt.Errorf("invalid address '%v'", s)
+	}
+	return ethgo.HexToAddress(s), nil
+}
+
+func parseWeiArg(s string) (*big.Int, error) {
+	if wei, ok := new(big.Int).SetString(s, 10); !ok || wei.Sign() < 0 {
+		return nil, fmt.Errorf("invalid wei amount '%v'", s)
+	} else {
+		return wei, nil
+	}
+}
+
+func paymasterAddress(cmd *cobra.Command, cfg config.Config) (ethgo.Address, error) {
+	addr, _ := cmd.Flags().GetString("address")
+	if len(addr) == 0 {
+		addr = cfg.PaymasterAddress
+	}
+	if len(addr) == 0 {
+		return ethgo.ZeroAddress, fmt.Errorf("no paymaster address - set --address or ERC4337_API_PAYMASTER_ADDRESS")
+	}
+	return parseAddressArg(addr)
+}
+
+// loadPaymaster binds the paymaster contract, with the configured chain key as sender
+// when withKey is set.
+func loadPaymaster(cmd *cobra.Command, withKey bool) (*contract.Contract, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := paymasterAddress(cmd, cfg)
+	if err != nil {
+		return nil, err
+	}
+	ec, _, err := erc4337.DialChain(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var key ethgo.Key
+	if withKey {
+		sk, err := cfg.ChainKey()
+		if err != nil {
+			return nil, err
+		}
+		if sk == nil {
+			return nil, fmt.Errorf("no chain key configured - set ERC4337_API_ETH_CLIENT_KEYSTORE or ERC4337_API_ETH_CLIENT_SK")
+		}
+		key = &chain.EcdsaKey{SK: sk}
+	}
+	return paymaster.LoadContract(ec, addr, key)
+}
+
+// paymasterTxn sends method with value, or prints its calldata on --dry-run.
+func paymasterTxn(cmd *cobra.Command, method string, value *big.Int, args ...interface{}) error {
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		addr, err := paymasterAddress(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		theAbi, err := paymaster.LoadPaymasterABI()
+		if err != nil {
+			return err
+		}
+		callData, err := theAbi.GetMethod(method).Encode(args)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			value = big.NewInt(0)
+		}
+		fmt.Printf("to:       %v\n", addr.String())
+		fmt.Printf("value:    %v\n", value.String())
+		fmt.Printf("calldata: %v\n", hexutil.Encode(callData))
+		return nil
+	}
+
+	c, err := loadPaymaster(cmd, true)
+	if err != nil {
+		return err
+	}
+	txn, err := c.Txn(method, args...)
+	if err == nil && value != nil {
+		txn.WithOpts(&contract.TxnOpts{Value: value})
+	}
+	chain.SetTxOutput(func(s string) { fmt.Println(s) })
+	return chain.TxnDoWait(txn, err)
+}
+
+var paymasterDepositCmd = &cobra.Command{
+	Use:   "deposit <wei>",
+	Short: "Adds to the paymaster's EntryPoint deposit",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		amount, err := parseWeiArg(args[0])
+		if err != nil {
+			return err
+		}
+		return paymasterTxn(cmd, "deposit", amount)
+	},
+}
+
+var paymasterGetDepositCmd = &cobra.Command{
+	Use:   "getDeposit",
+	Short: "Shows the paymaster's EntryPoint deposit",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := loadPaymaster(cmd, false)
+		if err != nil {
+			return err
+		}
+		res, err := c.Call("getDeposit", ethgo.Latest)
+		if err != nil {
+			return err
+		}
+		deposit, ok := res["0"].(*big.Int)
+		if !ok {
+			return fmt.Errorf("unexpected - expected *big.Int for getDeposit return value")
+		}
+		fmt.Printf("%v\n", deposit.String())
+		return nil
+	},
+}
+
+var paymasterAddStakeCmd = &cobra.Command{
+	Use:   "addStake <unstake delay secs> <wei>",
+	Short: "Stakes the paymaster in the EntryPoint",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		delay, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid unstake delay '%v'", args[0])
+		}
+		amount, err := parseWeiArg(args[1])
+		if err != nil {
+			return err
+		}
+		return paymasterTxn(cmd, "addStake", amount, uint32(delay))
+	},
+}
+
+var paymasterUnlockStakeCmd = &cobra.Command{
+	Use:   "unlockStake",
+	Short: "Starts the unstake delay",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return paymasterTxn(cmd, "unlockStake", nil)
+	},
+}
+
+var paymasterWithdrawStakeCmd = &cobra.Command{
+	Use:   "withdrawStake <to>",
+	Short: "Withdraws the unlocked stake",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, err := parseAddressArg(args[0])
+		if err != nil {
+			return err
+		}
+		return paymasterTxn(cmd, "withdrawStake", nil, to)
+	},
+}
+
+var paymasterWithdrawToCmd = &cobra.Command{
+	Use:   "withdrawTo <to> <wei>",
+	Short: "Withdraws from the paymaster's EntryPoint deposit",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, err := parseAddressArg(args[0])
+		if err != nil {
+			return err
+		}
+		amount, err := parseWeiArg(args[1])
+		if err != nil {
+			return err
+		}
+		return paymasterTxn(cmd, "withdrawTo", nil, to, amount)
+	},
+}
+
+// makeSetAddressCmd makes a command for an owner-only setter taking one address.
+func makeSetAddressCmd(method, arg, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   fmt.Sprintf("%v <%v>", method, arg),
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := parseAddressArg(args[0])
+			if err != nil {
+				return err
+			}
+			return paymasterTxn(cmd, method, nil, addr)
+		},
+	}
+}
+
+func init() {
+	paymasterCmd.PersistentFlags().String("address", "", "paymaster address, defaults to ERC4337_API_PAYMASTER_ADDRESS")
+	paymasterCmd.PersistentFlags().Bool("dry-run", false, "print the transaction calldata instead of sending it")
+
+	paymasterCmd.AddCommand(paymasterDepositCmd, paymasterGetDepositCmd, paymasterAddStakeCmd, paymasterUnlockStakeCmd,
+		paymasterWithdrawStakeCmd, paymasterWithdrawToCmd,
+		makeSetAddressCmd("setVerifier", "verifier", "Sets the key sponsorships must be signed with"),
+		makeSetAddressCmd("setVault", "vault", "Sets where token gas payments are sent"),
+		makeSetAddressCmd("transferOwnership", "new owner", "Transfers ownership of the paymaster"))
+	rootCmd.AddCommand(paymasterCmd)
+}
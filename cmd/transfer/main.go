@@ -1,93 +0,0 @@
-package main
-
-import (
-	"context"
-	"crypto/ecdsa"
-	"fmt"
-	"golang.org/x/crypto/sha3"
-	"log"
-	"math/big"
-
-	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
-)
-
-func main() {
-	client, err := ethclient.Dial("https://rpc.devnet.onenesslabs.io/")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	privateKey, err := crypto.HexToECDSA("cec327609d36790502f393464b6cd9de2ba228b295bce9779f8bdffe3f5787d4")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	publicKey := privateKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		log.Fatal("error casting public key to ECDSA")
-	}
-
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Printf("From address: %s\n", hexutil.Encode(fromAddress.Bytes()))
-
-	value := big.NewInt(0) // in wei (0 eth)
-	gasPrice, err := client.SuggestGasPrice(context.Background())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	toAddress := common.HexToAddress("0xC31f1aAa80433339177557Ba704E52FDB22010CA")
-	tokenAddress := common.HexToAddress("0x9bf054279893c80c84cd8c74c3be299bab9c8a29")
-
-	transferFnSignature := []byte("transfer(address,uint256)")
-	hash := sha3.NewLegacyKeccak256()
-	hash.Write(transferFnSignature)
-	methodID := hash.Sum(nil)[:4]
-	fmt.Printf("Method ID: %s\n", hexutil.Encode(methodID))
-
-	paddedAddress := common.LeftPadBytes(toAddress.Bytes(), 32)
-	fmt.Printf("To address: %s\n", hexutil.Encode(paddedAddress))
-
-	amount := new(big.Int)
-	amount.SetString("20000000000000000000", 10) // 1 tokens
-	paddedAmount := common.LeftPadBytes(amount.Bytes(), 32)
-	fmt.Printf("Token amount: %s\n", hexutil.Encode(paddedAmount))
-
-	var data []byte
-	data = append(data, methodID...)
-	data = append(data, paddedAddress...)
-	data = append(data, paddedAmount...)
-
-	gasLimit, err := client.EstimateGas(context.Background(), ethereum.CallMsg{
-		From: fromAddress,
-		To:   &tokenAddress,
-		Data: data,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Printf("Gas limit: %d\n", gasLimit)
-
-	tx := types.NewTransaction(nonce, tokenAddress, value, gasLimit, gasPrice, data)
-	signedTx, err := types.SignTx(tx, types.HomesteadSigner{}, privateKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = client.SendTransaction(context.Background(), signedTx)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Printf("Tokens sent at TX: %s", signedTx.Hash().Hex())
-}
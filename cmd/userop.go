@@ -0,0 +1,422 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/spf13/cobra"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+var useropCmd = &cobra.Command{
+	Use:   "userop",
+	Short: "Builds, signs and sends user operations",
+	Long: "The userop commands work directly against the configured chain, bundler and paymaster, or against a " +
+		"running server with --server. Ops are read from and written to JSON files, '-' being stdin/stdout. " +
+		"Ops sponsored directly skip the server's sponsorship policy.",
+}
+
+var useropBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Builds a sponsored op for an owner's account",
+}
+
+func readOp(path string) (*userop.UserOperation, error) {
+	var opBytes []byte
+	var err error
+	if path == "-" {
+		opBytes, err = io.ReadAll(os.Stdin)
+	} else {
+		opBytes, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var opMap map[string]any
+	if err = json.Unmarshal(opBytes, &opMap); err != nil {
+		return nil, fmt.Errorf("invalid op file %v: %v", path, err.Error())
+	}
+	// accept the builders' {"op": ..., "quote": ...} responses as well
+	if inner, ok := opMap["op"].(map[string]any); ok {
+		opMap = inner
+	}
+	return userop.New(opMap)
+}
+
+func writeOp(cmd *cobra.Command, op *userop.UserOperation) error {
+	opMap, err := op.ToMap()
+	if err != nil {
+		return err
+	}
+	opBytes, err := json.MarshalIndent(opMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	opBytes = append(opBytes, '\n')
+	if out, _ := cmd.Flags().GetString("out"); len(out) != 0 && out != "-" {
+		return os.WriteFile(out, opBytes, 0600)
+	}
+	_, err = os.Stdout.Write(opBytes)
+	return err
+}
+
+func printJSON(v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// useropChainId is --chain-id, or else the configured chain's.
+func useropChainId(cmd *cobra.Command) (*big.Int, error) {
+	if id, _ := cmd.Flags().GetInt64("chain-id"); id != 0 {
+		return big.NewInt(id), nil
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	ec, _, err := erc4337.DialChain(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ec.Eth().ChainID()
+}
+
+func optionalAddressFlag(cmd *cobra.Command, name string) (*ethgo.Address, error) {
+	s, _ := cmd.Flags().GetString(name)
+	if len(s) == 0 {
+		return nil, nil
+	}
+	addr, err := parseAddressArg(s)
+	if err != nil {
+		return nil, fmt.Errorf("--%v: %v", name, err.Error())
+	}
+	return &addr, nil
+}
+
+func requiredAddressFlag(cmd *cobra.Command, name string) (ethgo.Address, error) {
+	addr, err := optionalAddressFlag(cmd, name)
+	if err == nil && addr == nil {
+		err = fmt.Errorf("--%v is required", name)
+	}
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	return *addr, nil
+}
+
+func bigFlag(cmd *cobra.Command, name string) (*big.Int, error) {
+	s, _ := cmd.Flags().GetString(name)
+	if n, ok := new(big.Int).SetString(s, 10); !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("invalid --%v '%v'", name, s)
+	} else {
+		return n, nil
+	}
+}
+
+func parseBuildParams(cmd *cobra.Command, kind string) (p *buildParams, err error) {
+	p = &buildParams{kind: kind}
+	if p.owner, err = requiredAddressFlag(cmd, "owner"); err != nil {
+		return
+	}
+	if p.salt, err = bigFlag(cmd, "salt"); err != nil {
+		return
+	}
+	if p.gasToken, err = optionalAddressFlag(cmd, "gas-token"); err != nil {
+		return
+	}
+	p.noSponsor, _ = cmd.Flags().GetBool("no-sponsor")
+
+	switch kind {
+	case "transfer":
+		if p.target, err = requiredAddressFlag(cmd, "token"); err != nil {
+			return
+		}
+		if p.to, err = requiredAddressFlag(cmd, "to"); err != nil {
+			return
+		}
+		p.amount, err = bigFlag(cmd, "amount")
+	case "approve":
+		if p.target, err = requiredAddressFlag(cmd, "token"); err != nil {
+			return
+		}
+		if p.to, err = requiredAddressFlag(cmd, "spender"); err != nil {
+			return
+		}
+		p.amount, err = bigFlag(cmd, "amount")
+	case "call":
+		if p.target, err = requiredAddressFlag(cmd, "target"); err != nil {
+			return
+		}
+		if p.amount, err = bigFlag(cmd, "value"); err != nil {
+			return
+		}
+		if p.callGas, err = bigFlag(cmd, "call-gas"); err != nil {
+			return
+		}
+		data, _ := cmd.Flags().GetString("data")
+		if p.data, err = hexutil.Decode(data); err != nil {
+			err = fmt.Errorf("invalid --data: %v", err.Error())
+		}
+	}
+	return
+}
+
+func makeBuildCmd(kind, short string) *cobra.Command {
+	c := &cobra.Command{
+		Use:   kind,
+		Short: short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := parseBuildParams(cmd, kind)
+			if err != nil {
+				return err
+			}
+			backend, err := makeOpBackend(cmd)
+			if err != nil {
+				return err
+			}
+			op, quote, err := backend.build(cmd.Context(), p)
+			if err != nil {
+				return err
+			}
+			if quote != nil {
+				quoteBytes, _ := json.Marshal(quote)
+				fmt.Fprintf(os.Stderr, "gas is paid in token, quote: %v\n", string(quoteBytes))
+			}
+			return writeOp(cmd, op)
+		},
+	}
+	c.Flags().String("owner", "", "owner of the account")
+	c.Flags().String("salt", "0", "account salt")
+	c.Flags().String("gas-token", "", "pay for gas in this ERC-20 token")
+	c.Flags().Bool("no-sponsor", false, "leave the op unsponsored (direct mode only)")
+	c.Flags().StringP("out", "o", "-", "op file to write")
+	switch kind {
+	case "transfer":
+		c.Flags().String("token", "", "ERC-20 token to transfer")
+		c.Flags().String("to", "", "recipient")
+		c.Flags().String("amount", "", "amount in token base units")
+	case "approve":
+		c.Flags().String("token", "", "ERC-20 token to approve")
+		c.Flags().String("spender", "", "spender")
+		c.Flags().String("amount", "", "allowance in token base units")
+	case "call":
+		c.Flags().String("target", "", "contract to call")
+		c.Flags().String("data", "0x", "call data")
+		c.Flags().String("value", "0", "wei to send with the call")
+		c.Flags().String("call-gas", erc4337.DefaultCallGasLimit.String(), "call gas limit")
+	}
+	return c
+}
+
+var useropHashCmd = &cobra.Command{
+	Use:   "hash <op file>",
+	Short: "Prints the op hash the owner signs",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := readOp(args[0])
+		if err != nil {
+			return err
+		}
+		chainId, err := useropChainId(cmd)
+		if err != nil {
+			return err
+		}
+		fmt.Println(op.GetUserOpHash(common.Address(erc4337.DefaultEntryPoint), chainId).String())
+		return nil
+	},
+}
+
+func loadSigningKey(cmd *cobra.Command) (chain.Signer, error) {
+	if remote, _ := cmd.Flags().GetString("remote-signer"); len(remote) != 0 {
+		addr, _ := cmd.Flags().GetString("signer-address")
+		return chain.NewRemoteSigner(remote, ethgo.HexToAddress(addr), chain.DefaultSignerTimeout)
+	}
+	if keystore, _ := cmd.Flags().GetString("keystore"); len(keystore) != 0 {
+		passphrase, err := keystorePassphrase(cmd, "passphrase for "+keystore, false)
+		if err != nil {
+			return nil, err
+		}
+		sk, err := crypto.LoadKeystore(keystore, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &chain.EcdsaKey{SK: sk}, nil
+	}
+	keyHex, _ := cmd.Flags().GetString("key")
+	if keyFile, _ := cmd.Flags().GetString("key-file"); len(keyFile) != 0 {
+		keyBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyHex = strings.TrimSpace(string(keyBytes))
+	}
+	if len(keyHex) == 0 {
+		return nil, fmt.Errorf("a signing key is required, set --keystore, --key, --key-file or --remote-signer")
+	}
+	sk, err := crypto.SKFromHex(strings.TrimPrefix(keyHex, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	return &chain.EcdsaKey{SK: sk}, nil
+}
+
+var useropSignCmd = &cobra.Command{
+	Use:   "sign <op file>",
+	Short: "Signs an op as its owner",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := readOp(args[0])
+		if err != nil {
+			return err
+		}
+		key, err := loadSigningKey(cmd)
+		if err != nil {
+			return err
+		}
+		chainId, err := useropChainId(cmd)
+		if err != nil {
+			return err
+		}
+		if op, err = erc4337.UserOpSeal(op, chainId, key); err != nil {
+			return err
+		}
+		return writeOp(cmd, op)
+	},
+}
+
+var useropSendCmd = &cobra.Command{
+	Use:   "send <op file>",
+	Short: "Sends a signed op to the bundler",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := readOp(args[0])
+		if err != nil {
+			return err
+		}
+		backend, err := makeOpBackend(cmd)
+		if err != nil {
+			return err
+		}
+		opHash, err := backend.send(cmd.Context(), op)
+		if err != nil {
+			return err
+		}
+		fmt.Println(opHash)
+		return nil
+	},
+}
+
+var useropStatusCmd = &cobra.Command{
+	Use:   "status <op hash>",
+	Short: "Shows whether an op was included",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backend, err := makeOpBackend(cmd)
+		if err != nil {
+			return err
+		}
+		status, err := backend.status(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+	},
+}
+
+type decodedOp struct {
+	Sender    ethgo.Address           `json:"sender"`
+	Nonce     *hexutil.Big            `json:"nonce"`
+	InitCode  map[string]any          `json:"initCode,omitempty"`
+	Calls     []*erc4337.DecodedCall  `json:"calls,omitempty"`
+	CallData  hexutil.Bytes           `json:"callData,omitempty"`
+	Gas       map[string]*hexutil.Big `json:"gas"`
+	Paymaster map[string]any          `json:"paymaster,omitempty"`
+	Signature hexutil.Bytes           `json:"signature"`
+}
+
+var useropDecodeCmd = &cobra.Command{
+	Use:   "decode <op file>",
+	Short: "Decodes an op's init code, calls and paymaster data",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		op, err := readOp(args[0])
+		if err != nil {
+			return err
+		}
+		d := &decodedOp{
+			Sender: ethgo.Address(op.Sender),
+			Nonce:  (*hexutil.Big)(op.Nonce),
+			Gas: map[string]*hexutil.Big{
+				"callGasLimit":         (*hexutil.Big)(op.CallGasLimit),
+				"verificationGasLimit": (*hexutil.Big)(op.VerificationGasLimit),
+				"preVerificationGas":   (*hexutil.Big)(op.PreVerificationGas),
+				"maxFeePerGas":         (*hexutil.Big)(op.MaxFeePerGas),
+				"maxPriorityFeePerGas": (*hexutil.Big)(op.MaxPriorityFeePerGas),
+			},
+			Signature: op.Signature,
+		}
+		if len(op.InitCode) != 0 {
+			if factory, owner, salt, err := erc4337.DecodeInitCode(op.InitCode); err != nil {
+				d.InitCode = map[string]any{"raw": hexutil.Bytes(op.InitCode)}
+			} else {
+				d.InitCode = map[string]any{"factory": factory, "owner": owner, "salt": (*hexutil.Big)(salt)}
+			}
+		}
+		if d.Calls, err = erc4337.DecodeCallData(op.CallData); err != nil {
+			d.CallData = op.CallData
+		}
+		if len(op.PaymasterAndData) != 0 {
+			if pm, sd, sig, err := paymaster.ParsePaymasterAndData(op.PaymasterAndData); err != nil {
+				d.Paymaster = map[string]any{"raw": hexutil.Bytes(op.PaymasterAndData)}
+			} else {
+				d.Paymaster = map[string]any{
+					"address":      pm,
+					"validUntil":   sd.ValidUntil,
+					"validAfter":   sd.ValidAfter,
+					"erc20Token":   sd.ERC20Token,
+					"exchangeRate": (*hexutil.Big)(sd.ExchangeRate),
+					"signature":    hexutil.Bytes(sig),
+				}
+			}
+		}
+		return printJSON(d)
+	},
+}
+
+func init() {
+	useropCmd.PersistentFlags().String("server", "", "url of a running server, e.g. http://localhost:8080; direct when empty")
+	useropCmd.PersistentFlags().String("api-key", "", "server api key")
+	useropCmd.PersistentFlags().String("token", "", "server bearer token (JWT or SIWE session)")
+	useropCmd.PersistentFlags().Int64("chain-id", 0, "chain id for op hashes, defaults to the configured chain's")
+
+	useropSignCmd.Flags().String("key", "", "owner private key, hex")
+	useropSignCmd.Flags().String("key-file", "", "file holding the owner private key, hex")
+	useropSignCmd.Flags().String("keystore", "", "owner keystore file")
+	useropSignCmd.Flags().String("password-file", "", "file holding the keystore passphrase")
+	useropSignCmd.Flags().String("remote-signer", "", "url of a Web3Signer compatible remote signer")
+	useropSignCmd.Flags().String("signer-address", "", "owner address on the remote signer, defaults to its first account")
+	useropSignCmd.Flags().StringP("out", "o", "-", "op file to write")
+
+	useropBuildCmd.AddCommand(
+		makeBuildCmd("transfer", "Builds an ERC-20 transfer"),
+		makeBuildCmd("approve", "Builds an ERC-20 approve"),
+		makeBuildCmd("call", "Builds an arbitrary call"))
+	useropCmd.AddCommand(useropBuildCmd, useropHashCmd, useropSignCmd, useropSendCmd, useropStatusCmd, useropDecodeCmd)
+	rootCmd.AddCommand(useropCmd)
+}
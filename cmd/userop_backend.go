@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/spf13/cobra"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type buildParams struct {
+	kind   string
+	owner  ethgo.Address
+	salt   *big.Int
+	target ethgo.Address
+	// the recipient or spender
+	to ethgo.Address
+	// token amount, or wei for calls
+	amount  *big.Int
+	data    []byte
+	callGas *big.Int
+
+	gasToken  *ethgo.Address
+	noSponsor bool
+}
+
+// opBackend is where the userop commands build, send and track ops.
+type opBackend interface {
+	build(ctx context.Context, p *buildParams) (*userop.UserOperation, *paymaster.Quote, error)
+	send(ctx context.Context, op *userop.UserOperation) (string, error)
+	status(ctx context.Context, opHash string) (*erc4337.OpStatus, error)
+}
+
+func makeOpBackend(cmd *cobra.Command) (opBackend, error) {
+	if server, _ := cmd.Flags().GetString("server"); len(server) != 0 {
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		token, _ := cmd.Flags().GetString("token")
+		return &serverBackend{
+			url:    strings.TrimSuffix(server, "/"),
+			apiKey: apiKey,
+			token:  token,
+			client: &http.Client{Timeout: time.Minute},
+		}, nil
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	// token settlements recorded here aren't kept, the server's store may be locked
+	st, err := store.Open("")
+	if err != nil {
+		return nil, err
+	}
+	hc, err := erc4337.MakeContext(cfg, st)
+	if err != nil {
+		return nil, err
+	}
+	return &directBackend{hc: hc}, nil
+}
+
+type directBackend struct {
+	hc *erc4337.HandlerContext
+}
+
+func (b *directBackend) build(ctx context.Context, p *buildParams) (op *userop.UserOperation, quote *paymaster.Quote, err error) {
+	nonce, sender, err := b.hc.OwnerInfo(ctx, p.owner, p.salt)
+	if err != nil {
+		return
+	}
+	gasPrice, err := b.hc.GasPrice(ctx)
+	if err != nil {
+		return
+	}
+	switch p.kind {
+	case "transfer":
+		op, err = erc4337.UserOpTransfer(nonce, p.owner, sender, p.target, p.to, p.salt, p.amount, gasPrice)
+	case "approve":
+		op, err = erc4337.UserOpApprove(nonce, p.owner, sender, p.target, p.to, p.salt, p.amount)
+	case "call":
+		op, err = erc4337.UserOpCall(nonce, p.owner, sender, p.target, p.salt, p.amount, p.data, p.callGas, gasPrice)
+	default:
+		err = fmt.Errorf("unknown op kind '%v'", p.kind)
+	}
+	if err != nil || p.noSponsor {
+		return
+	}
+	return b.hc.Sponsor(ctx, op, p.owner, p.gasToken)
+}
+
+func (b *directBackend) send(ctx context.Context, op *userop.UserOperation) (string, error) {
+	return b.hc.SendUserOp(ctx, op)
+}
+
+func (b *directBackend) status(ctx context.Context, opHash string) (*erc4337.OpStatus, error) {
+	return b.hc.UserOpStatus(ctx, opHash)
+}
+
+type serverBackend struct {
+	url    string
+	apiKey string
+	token  string
+	client *http.Client
+}
+
+func (b *serverBackend) do(ctx context.Context, method, path string, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(b.apiKey) != 0 {
+		req.Header.Set("X-API-Key", b.apiKey)
+	}
+	if len(b.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %v: %v", resp.Status, strings.TrimSpace(string(respBytes)))
+	}
+	return json.Unmarshal(respBytes, result)
+}
+
+func (b *serverBackend) build(ctx context.Context, p *buildParams) (*userop.UserOperation, *paymaster.Quote, error) {
+	if p.noSponsor {
+		return nil, nil, fmt.Errorf("--no-sponsor only works in direct mode")
+	}
+	q := url.Values{}
+	q.Set("owner", p.owner.String())
+	q.Set("salt", p.salt.String())
+	q.Set("target", p.target.String())
+	switch p.kind {
+	case "transfer":
+		q.Set("to", p.to.String())
+		q.Set("amount", p.amount.String())
+	case "approve":
+		q.Set("spender", p.to.String())
+		q.Set("amount", p.amount.String())
+	case "call":
+		q.Set("value", p.amount.String())
+		q.Set("data", hexutil.Encode(p.data))
+		q.Set("callGas", p.callGas.String())
+	}
+	if p.gasToken != nil {
+		q.Set("gasToken", p.gasToken.String())
+	}
+
+	var resp map[string]any
+	if err := b.do(ctx, http.MethodGet, "/erc4337/userop/"+p.kind+"?"+q.Encode(), nil, &resp); err != nil {
+		return nil, nil, err
+	}
+	opMap := resp
+	var quote *paymaster.Quote
+	if inner, ok := resp["op"].(map[string]any); ok {
+		opMap = inner
+		quoteBytes, _ := json.Marshal(resp["quote"])
+		quote = &paymaster.Quote{}
+		if err := json.Unmarshal(quoteBytes, quote); err != nil {
+			return nil, nil, err
+		}
+	}
+	op, err := userop.New(opMap)
+	return op, quote, err
+}
+
+func (b *serverBackend) send(ctx context.Context, op *userop.UserOperation) (string, error) {
+	opMap, err := op.ToMap()
+	if err != nil {
+		return "", err
+	}
+	// the server replies with its result JSON as a string
+	var reply string
+	req := map[string]any{"entryPoint": erc4337.DefaultEntryPoint.String(), "op": opMap}
+	if err = b.do(ctx, http.MethodPost, "/erc4337/userop/send", req, &reply); err != nil {
+		return "", err
+	}
+	var result map[string]string
+	if err = json.Unmarshal([]byte(reply), &result); err != nil {
+		return "", fmt.Errorf("unexpected server reply '%v'", reply)
+	}
+	return result["op hash"], nil
+}
+
+func (b *serverBackend) status(ctx context.Context, opHash string) (*erc4337.OpStatus, error) {
+	status := &erc4337.OpStatus{}
+	if err := b.do(ctx, http.MethodGet, "/erc4337/userop/status?hash="+url.QueryEscape(opHash), nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
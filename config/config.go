@@ -1,10 +1,460 @@
 package config
 
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/spf13/viper"
+	"strings"
+	"time"
+)
+
 type Config struct {
-	ChainRpcUrl string
+	// the upstream urls are comma separated lists of equivalent endpoints, failed
+	// over between and probed every UpstreamProbeInterval; failed idempotent calls
+	// are retried UpstreamRetries times, waiting UpstreamBackoff, doubled each time
+	ChainRpcUrl           string
+	UpstreamProbeInterval time.Duration
+	UpstreamRetries       int
+	UpstreamBackoff       time.Duration
+	// how long each call to the upstream may take
+	ChainTimeout     time.Duration
+	BundlerTimeout   time.Duration
+	PaymasterTimeout time.Duration
+	// account reads are aggregated through the Multicall3 contract here, when it's
+	// deployed; empty to make them one at a time
+	MulticallAddress string
+
+	// the server key, either as hex or as a v3 keystore file; KeystorePassword
+	// unlocks keystores and is prompted for when empty
+	ChainSKHex       string
+	ChainKeystore    string
+	KeystorePassword string
 
-	ChainSKHex string
+	// a BIP-39 mnemonic the server keys are derived from when they aren't set
+	// otherwise, see the HDIndex consts; SubmitterCount more keys are derived to
+	// submit transactions from
+	Mnemonic           string
+	MnemonicPassphrase string
+	HDPath             string
+	SubmitterCount     int
+
+	// a Web3Signer compatible remote signer, used for the server key and the paymaster
+	// verifier when they aren't configured locally; the server signs as
+	// ChainSignerAddress, or as the signer's first account when that is empty
+	RemoteSignerUrl    string
+	ChainSignerAddress string
 
 	SUNodeUrl      string
 	SUPayMasterUrl string
+
+	// JWT auth for the userop builder routes; disabled when no JWKS source is set
+	JWKSUrl     string
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+
+	// Sign-In with Ethereum; enabled when a domain is set
+	SIWEDomain    string
+	SessionSecret string
+	SessionTTL    time.Duration
+
+	// local badger store for api keys etc.
+	StoreDir string
+
+	RequireAPIKey bool
+	CORSOrigins   []string
+	// bearer token /metrics is scraped with; without it metrics need an admin api key
+	MetricsToken string
+
+	// "external" sends ops to the bundler at SUNodeUrl, "local" bundles them in-process,
+	// submitting handleOps from the submitter keys, or the server key if there are none
+	BundlerMode        string
+	BundleInterval     time.Duration
+	MaxBatchGasLimit   uint64
+	BundlerBeneficiary string
+	// how much sped up and cancelled ops raise both fees by, in percent: the bundler's
+	// minimum for a replacement, which the in-process bundler also requires
+	FeeBumpPercent int64
+
+	// sponsorship policy file (yaml/json); no policy when empty
+	PolicyFile string
+
+	// ops are checked with simulateValidation before they're sent; the stake is in wei
+	ValidateOps       bool
+	ValidUntilMargin  time.Duration
+	MinPaymasterStake string
+	MinUnstakeDelay   time.Duration
+
+	// the session key validator plugin accounts enable session keys on, implementing
+	// session/abi/ISessionKeyPlugin.json; session keys are disabled when empty
+	SessionKeyPlugin string
+
+	// nonces handed out to builds are free again after NonceTTL unless the op is sent,
+	// and after NonceSentTTL if it's sent but never included
+	NonceTTL     time.Duration
+	NonceSentTTL time.Duration
+
+	// "external" asks SUPayMasterUrl to sponsor ops, "local" signs them in-process
+	// for the VerifyingPaymaster at PaymasterAddress
+	PaymasterMode       string
+	PaymasterAddress    string
+	PaymasterVerifierSK string
+	// a keystore for the verifier instead of PaymasterVerifierSK, or the verifier's
+	// address on the remote signer
+	PaymasterVerifierKeystore string
+	PaymasterVerifierAddress  string
+	PaymasterValidity         time.Duration
+	PaymasterCrossCheck       bool
+
+	// ERC-20 gas payment through the local paymaster, with exchange rates either
+	// fixed as "token=rate,..." or read from a JSON price file
+	TokenRates     string
+	TokenRatesFile string
+
+	// paymaster deposit monitoring, on when a paymaster address is set; amounts in wei
+	DepositMonitorInterval time.Duration
+	DepositAlertThreshold  string
+	DepositAlertWebhook    string
+	DepositAlertLevel      string
+	DepositTopUpAmount     string
+	DepositTopUpDailyCap   string
+
+	// the faucet only runs on these chain ids; amounts in wei or token base units
+	FaucetChainIds        []string
+	FaucetKind            string
+	FaucetToken           string
+	FaucetAmount          string
+	FaucetAddressCooldown time.Duration
+	FaucetIPCooldown      time.Duration
+	FaucetDailyBudget     string
+}
+
+const (
+	PaymasterModeExternal = "external"
+	PaymasterModeLocal    = "local"
+)
+
+func (c Config) LocalPaymaster() bool {
+	return c.PaymasterMode == PaymasterModeLocal
+}
+
+const (
+	BundlerModeExternal = "external"
+	BundlerModeLocal    = "local"
+)
+
+func (c Config) LocalBundler() bool {
+	return c.BundlerMode == BundlerModeLocal
+}
+
+func (c Config) ChainRpcUrls() []string {
+	return splitList(c.ChainRpcUrl)
+}
+
+func (c Config) BundlerUrls() []string {
+	return splitList(c.SUNodeUrl)
+}
+
+func (c Config) PaymasterUrls() []string {
+	return splitList(c.SUPayMasterUrl)
+}
+
+var DefaultStoreDir = "data"
+
+// indexes of the keys derived from the mnemonic, on HDPath/i
+const (
+	HDIndexRelayer  = 0
+	HDIndexVerifier = 1
+	HDIndexFaucet   = 2
+	// submitter i is at HDIndexSubmitters + i
+	HDIndexSubmitters = 100
+)
+
+// Load reads the config from the .env file, if there is one, and the environment.
+func Load() (cfg Config, err error) {
+	// Read in from .env file if available
+	viper.SetConfigName(".env")
+	viper.SetConfigType("env")
+	viper.AddConfigPath(".")
+	if err = viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			// Config file not found
+			// Can ignore
+			err = nil
+		} else {
+			err = fmt.Errorf("fatal error config file: %w", err)
+			return
+		}
+	}
+
+	// Read in from environment variables
+	_ = viper.BindEnv("ERC4337_API_BUNDLER_URL")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_URL")
+	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_SK")
+	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_KEYSTORE")
+	_ = viper.BindEnv("ERC4337_API_KEYSTORE_PASSWORD")
+	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_URL")
+	_ = viper.BindEnv("ERC4337_API_UPSTREAM_PROBE_INTERVAL")
+	_ = viper.BindEnv("ERC4337_API_UPSTREAM_RETRIES")
+	_ = viper.BindEnv("ERC4337_API_UPSTREAM_BACKOFF")
+	_ = viper.BindEnv("ERC4337_API_CHAIN_TIMEOUT")
+	_ = viper.BindEnv("ERC4337_API_BUNDLER_TIMEOUT")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_TIMEOUT")
+	_ = viper.BindEnv("ERC4337_API_MULTICALL_ADDRESS")
+	_ = viper.BindEnv("ERC4337_API_MNEMONIC")
+	_ = viper.BindEnv("ERC4337_API_MNEMONIC_PASSPHRASE")
+	_ = viper.BindEnv("ERC4337_API_HD_PATH")
+	_ = viper.BindEnv("ERC4337_API_SUBMITTER_KEYS")
+	_ = viper.BindEnv("ERC4337_API_REMOTE_SIGNER_URL")
+	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_ADDRESS")
+	_ = viper.BindEnv("ERC4337_API_JWKS_URL")
+	_ = viper.BindEnv("ERC4337_API_JWKS_FILE")
+	_ = viper.BindEnv("ERC4337_API_JWT_ISSUER")
+	_ = viper.BindEnv("ERC4337_API_JWT_AUDIENCE")
+	_ = viper.BindEnv("ERC4337_API_SIWE_DOMAIN")
+	_ = viper.BindEnv("ERC4337_API_SESSION_SECRET")
+	_ = viper.BindEnv("ERC4337_API_SESSION_TTL")
+	_ = viper.BindEnv("ERC4337_API_STORE_DIR")
+	_ = viper.BindEnv("ERC4337_API_REQUIRE_API_KEY")
+	_ = viper.BindEnv("ERC4337_API_CORS_ORIGINS")
+	_ = viper.BindEnv("ERC4337_API_BUNDLER_MODE")
+	_ = viper.BindEnv("ERC4337_API_BUNDLE_INTERVAL")
+	_ = viper.BindEnv("ERC4337_API_MAX_BATCH_GAS_LIMIT")
+	_ = viper.BindEnv("ERC4337_API_BUNDLER_BENEFICIARY")
+	_ = viper.BindEnv("ERC4337_API_POLICY_FILE")
+	_ = viper.BindEnv("ERC4337_API_VALIDATE_OPS")
+	_ = viper.BindEnv("ERC4337_API_VALID_UNTIL_MARGIN")
+	_ = viper.BindEnv("ERC4337_API_MIN_PAYMASTER_STAKE")
+	_ = viper.BindEnv("ERC4337_API_MIN_UNSTAKE_DELAY")
+	_ = viper.BindEnv("ERC4337_API_SESSION_KEY_PLUGIN")
+	_ = viper.BindEnv("ERC4337_API_NONCE_TTL")
+	_ = viper.BindEnv("ERC4337_API_NONCE_SENT_TTL")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_MODE")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_ADDRESS")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_VERIFIER_SK")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_VERIFIER_KEYSTORE")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_VERIFIER_ADDRESS")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_VALIDITY")
+	_ = viper.BindEnv("ERC4337_API_PAYMASTER_CROSS_CHECK")
+	_ = viper.BindEnv("ERC4337_API_TOKEN_RATES")
+	_ = viper.BindEnv("ERC4337_API_TOKEN_RATES_FILE")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_MONITOR_INTERVAL")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_ALERT_THRESHOLD")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_ALERT_WEBHOOK")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_ALERT_LEVEL")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_TOPUP_AMOUNT")
+	_ = viper.BindEnv("ERC4337_API_DEPOSIT_TOPUP_DAILY_CAP")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_CHAIN_IDS")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_KIND")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_TOKEN")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_AMOUNT")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_ADDRESS_COOLDOWN")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_IP_COOLDOWN")
+	_ = viper.BindEnv("ERC4337_API_FAUCET_DAILY_BUDGET")
+
+	viper.SetDefault("ERC4337_API_STORE_DIR", DefaultStoreDir)
+	viper.SetDefault("ERC4337_API_HD_PATH", crypto.DefaultHDPath)
+	viper.SetDefault("ERC4337_API_UPSTREAM_PROBE_INTERVAL", 15*time.Second)
+	viper.SetDefault("ERC4337_API_UPSTREAM_RETRIES", 2)
+	viper.SetDefault("ERC4337_API_UPSTREAM_BACKOFF", 200*time.Millisecond)
+	viper.SetDefault("ERC4337_API_CHAIN_TIMEOUT", 10*time.Second)
+	viper.SetDefault("ERC4337_API_BUNDLER_TIMEOUT", 10*time.Second)
+	viper.SetDefault("ERC4337_API_PAYMASTER_TIMEOUT", 10*time.Second)
+	viper.SetDefault("ERC4337_API_MULTICALL_ADDRESS", "0xcA11bde05977b3631167028862bE2a173976CA11")
+	viper.SetDefault("ERC4337_API_PAYMASTER_MODE", PaymasterModeExternal)
+	viper.SetDefault("ERC4337_API_BUNDLER_MODE", BundlerModeExternal)
+	viper.SetDefault("ERC4337_API_BUNDLE_INTERVAL", 12*time.Second)
+	viper.SetDefault("ERC4337_API_FEE_BUMP_PERCENT", 10)
+	viper.SetDefault("ERC4337_API_VALIDATE_OPS", true)
+	viper.SetDefault("ERC4337_API_VALID_UNTIL_MARGIN", 30*time.Second)
+	viper.SetDefault("ERC4337_API_NONCE_TTL", 5*time.Minute)
+	viper.SetDefault("ERC4337_API_NONCE_SENT_TTL", 30*time.Minute)
+	viper.SetDefault("ERC4337_API_DEPOSIT_MONITOR_INTERVAL", time.Minute)
+	viper.SetDefault("ERC4337_API_DEPOSIT_ALERT_LEVEL", "warn")
+	viper.SetDefault("ERC4337_API_FAUCET_KIND", "request")
+	viper.SetDefault("ERC4337_API_FAUCET_ADDRESS_COOLDOWN", 24*time.Hour)
+	viper.SetDefault("ERC4337_API_FAUCET_IP_COOLDOWN", time.Hour)
+
+	// secrets can also be read from files, e.g. ERC4337_API_ETH_CLIENT_SK_FILE
+	secrets := map[string]string{}
+	for _, name := range secretVars {
+		_ = viper.BindEnv(name + "_FILE")
+		if secrets[name], err = secret(name); err != nil {
+			return
+		}
+	}
+
+	// TODO: some API's will fail without these url's - should we just fail here...?
+	cfg = Config{
+		ChainSKHex:         secrets["ERC4337_API_ETH_CLIENT_SK"],
+		ChainKeystore:      viper.GetString("ERC4337_API_ETH_CLIENT_KEYSTORE"),
+		KeystorePassword:   secrets["ERC4337_API_KEYSTORE_PASSWORD"],
+		ChainRpcUrl:        viper.GetString("ERC4337_API_ETH_CLIENT_URL"),
+		Mnemonic:           secrets["ERC4337_API_MNEMONIC"],
+		MnemonicPassphrase: secrets["ERC4337_API_MNEMONIC_PASSPHRASE"],
+		HDPath:             viper.GetString("ERC4337_API_HD_PATH"),
+		SubmitterCount:     viper.GetInt("ERC4337_API_SUBMITTER_KEYS"),
+		RemoteSignerUrl:    viper.GetString("ERC4337_API_REMOTE_SIGNER_URL"),
+		ChainSignerAddress: viper.GetString("ERC4337_API_ETH_CLIENT_ADDRESS"),
+		SUNodeUrl:          viper.GetString("ERC4337_API_BUNDLER_URL"),
+		SUPayMasterUrl:     viper.GetString("ERC4337_API_PAYMASTER_URL"),
+		JWKSUrl:            viper.GetString("ERC4337_API_JWKS_URL"),
+		JWKSFile:           viper.GetString("ERC4337_API_JWKS_FILE"),
+		JWTIssuer:          viper.GetString("ERC4337_API_JWT_ISSUER"),
+		JWTAudience:        viper.GetString("ERC4337_API_JWT_AUDIENCE"),
+		SIWEDomain:         viper.GetString("ERC4337_API_SIWE_DOMAIN"),
+		SessionSecret:      secrets["ERC4337_API_SESSION_SECRET"],
+		SessionTTL:         viper.GetDuration("ERC4337_API_SESSION_TTL"),
+		StoreDir:           viper.GetString("ERC4337_API_STORE_DIR"),
+		RequireAPIKey:      viper.GetBool("ERC4337_API_REQUIRE_API_KEY"),
+		MetricsToken:       secrets["ERC4337_API_METRICS_TOKEN"],
+		CORSOrigins:        splitList(viper.GetString("ERC4337_API_CORS_ORIGINS")),
+		BundlerMode:        viper.GetString("ERC4337_API_BUNDLER_MODE"),
+		BundleInterval:     viper.GetDuration("ERC4337_API_BUNDLE_INTERVAL"),
+		MaxBatchGasLimit:   viper.GetUint64("ERC4337_API_MAX_BATCH_GAS_LIMIT"),
+		BundlerBeneficiary: viper.GetString("ERC4337_API_BUNDLER_BENEFICIARY"),
+		FeeBumpPercent:     viper.GetInt64("ERC4337_API_FEE_BUMP_PERCENT"),
+		PolicyFile:         viper.GetString("ERC4337_API_POLICY_FILE"),
+		SessionKeyPlugin:   viper.GetString("ERC4337_API_SESSION_KEY_PLUGIN"),
+		ValidateOps:        viper.GetBool("ERC4337_API_VALIDATE_OPS"),
+		ValidUntilMargin:   viper.GetDuration("ERC4337_API_VALID_UNTIL_MARGIN"),
+		MinPaymasterStake:  viper.GetString("ERC4337_API_MIN_PAYMASTER_STAKE"),
+		MinUnstakeDelay:    viper.GetDuration("ERC4337_API_MIN_UNSTAKE_DELAY"),
+		NonceTTL:           viper.GetDuration("ERC4337_API_NONCE_TTL"),
+		NonceSentTTL:       viper.GetDuration("ERC4337_API_NONCE_SENT_TTL"),
+
+		UpstreamProbeInterval: viper.GetDuration("ERC4337_API_UPSTREAM_PROBE_INTERVAL"),
+		UpstreamRetries:       viper.GetInt("ERC4337_API_UPSTREAM_RETRIES"),
+		UpstreamBackoff:       viper.GetDuration("ERC4337_API_UPSTREAM_BACKOFF"),
+		ChainTimeout:          viper.GetDuration("ERC4337_API_CHAIN_TIMEOUT"),
+		BundlerTimeout:        viper.GetDuration("ERC4337_API_BUNDLER_TIMEOUT"),
+		PaymasterTimeout:      viper.GetDuration("ERC4337_API_PAYMASTER_TIMEOUT"),
+		MulticallAddress:      viper.GetString("ERC4337_API_MULTICALL_ADDRESS"),
+
+		PaymasterMode:             viper.GetString("ERC4337_API_PAYMASTER_MODE"),
+		PaymasterAddress:          viper.GetString("ERC4337_API_PAYMASTER_ADDRESS"),
+		PaymasterVerifierSK:       secrets["ERC4337_API_PAYMASTER_VERIFIER_SK"],
+		PaymasterVerifierKeystore: viper.GetString("ERC4337_API_PAYMASTER_VERIFIER_KEYSTORE"),
+		PaymasterVerifierAddress:  viper.GetString("ERC4337_API_PAYMASTER_VERIFIER_ADDRESS"),
+		PaymasterValidity:         viper.GetDuration("ERC4337_API_PAYMASTER_VALIDITY"),
+		PaymasterCrossCheck:       viper.GetBool("ERC4337_API_PAYMASTER_CROSS_CHECK"),
+
+		TokenRates:     viper.GetString("ERC4337_API_TOKEN_RATES"),
+		TokenRatesFile: viper.GetString("ERC4337_API_TOKEN_RATES_FILE"),
+
+		DepositMonitorInterval: viper.GetDuration("ERC4337_API_DEPOSIT_MONITOR_INTERVAL"),
+		DepositAlertThreshold:  viper.GetString("ERC4337_API_DEPOSIT_ALERT_THRESHOLD"),
+		DepositAlertWebhook:    viper.GetString("ERC4337_API_DEPOSIT_ALERT_WEBHOOK"),
+		DepositAlertLevel:      viper.GetString("ERC4337_API_DEPOSIT_ALERT_LEVEL"),
+		DepositTopUpAmount:     viper.GetString("ERC4337_API_DEPOSIT_TOPUP_AMOUNT"),
+		DepositTopUpDailyCap:   viper.GetString("ERC4337_API_DEPOSIT_TOPUP_DAILY_CAP"),
+
+		FaucetChainIds:        splitList(viper.GetString("ERC4337_API_FAUCET_CHAIN_IDS")),
+		FaucetKind:            viper.GetString("ERC4337_API_FAUCET_KIND"),
+		FaucetToken:           viper.GetString("ERC4337_API_FAUCET_TOKEN"),
+		FaucetAmount:          viper.GetString("ERC4337_API_FAUCET_AMOUNT"),
+		FaucetAddressCooldown: viper.GetDuration("ERC4337_API_FAUCET_ADDRESS_COOLDOWN"),
+		FaucetIPCooldown:      viper.GetDuration("ERC4337_API_FAUCET_IP_COOLDOWN"),
+		FaucetDailyBudget:     viper.GetString("ERC4337_API_FAUCET_DAILY_BUDGET"),
+	}
+	return
+}
+
+var secretVars = []string{
+	"ERC4337_API_ETH_CLIENT_SK",
+	"ERC4337_API_KEYSTORE_PASSWORD",
+	"ERC4337_API_SESSION_SECRET",
+	"ERC4337_API_PAYMASTER_VERIFIER_SK",
+	"ERC4337_API_MNEMONIC",
+	"ERC4337_API_MNEMONIC_PASSPHRASE",
+	"ERC4337_API_METRICS_TOKEN",
+}
+
+// secret reads name, or the file named by name_FILE when that is set.
+func secret(name string) (string, error) {
+	if path := viper.GetString(name + "_FILE"); len(path) != 0 {
+		val, err := crypto.ReadSecretFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading %v_FILE: %w", name, err)
+		}
+		return val, nil
+	}
+	return viper.GetString(name), nil
+}
+
+// ChainKey returns the server (relayer) key, nil when none is configured.
+func (c Config) ChainKey() (*ecdsa.PrivateKey, error) {
+	return c.loadKey(c.ChainSKHex, c.ChainKeystore, HDIndexRelayer)
+}
+
+// VerifierKey returns the local paymaster's verifier key, nil when none is configured.
+func (c Config) VerifierKey() (*ecdsa.PrivateKey, error) {
+	return c.loadKey(c.PaymasterVerifierSK, c.PaymasterVerifierKeystore, HDIndexVerifier)
+}
+
+// FaucetKey returns the faucet's own key, only set with a mnemonic; the faucet
+// uses the server key otherwise.
+func (c Config) FaucetKey() (*ecdsa.PrivateKey, error) {
+	return c.loadKey("", "", HDIndexFaucet)
+}
+
+// SubmitterKeys returns the pool of submitter keys, empty without a mnemonic.
+func (c Config) SubmitterKeys() (ret []*ecdsa.PrivateKey, err error) {
+	if len(c.Mnemonic) == 0 {
+		return
+	}
+	w, err := c.HDWallet()
+	if err != nil {
+		return
+	}
+	for i := 0; i < c.SubmitterCount; i++ {
+		var sk *ecdsa.PrivateKey
+		if sk, err = w.Key(uint32(HDIndexSubmitters + i)); err != nil {
+			return
+		}
+		ret = append(ret, sk)
+	}
+	return
+}
+
+// HDWallet returns the wallet for the configured mnemonic.
+func (c Config) HDWallet() (*crypto.HDWallet, error) {
+	if len(c.Mnemonic) == 0 {
+		return nil, fmt.Errorf("no mnemonic configured")
+	}
+	return crypto.NewHDWallet(c.Mnemonic, c.MnemonicPassphrase, c.HDPath)
+}
+
+func (c Config) loadKey(skHex, keystore string, hdIndex uint32) (*ecdsa.PrivateKey, error) {
+	if len(skHex) != 0 {
+		return crypto.SKFromHex(strings.TrimPrefix(skHex, "0x"))
+	}
+	if len(keystore) == 0 {
+		if len(c.Mnemonic) == 0 {
+			return nil, nil
+		}
+		w, err := c.HDWallet()
+		if err != nil {
+			return nil, err
+		}
+		return w.Key(hdIndex)
+	}
+	passphrase := c.KeystorePassword
+	if len(passphrase) == 0 {
+		var err error
+		if passphrase, err = crypto.PromptPassphrase("passphrase for " + keystore); err != nil {
+			return nil, err
+		}
+	}
+	return crypto.LoadKeystore(keystore, passphrase)
+}
+
+func splitList(s string) (ret []string) {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); len(part) != 0 {
+			ret = append(ret, part)
+		}
+	}
+	return
 }
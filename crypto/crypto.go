@@ -5,6 +5,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/hex"
+	"fmt"
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/umbracle/ethgo"
 	"math/big"
@@ -26,7 +27,7 @@ func PubKeyToAddress(pub *ecdsa.PublicKey) ethgo.Address {
 }
 
 // Sign produces a compact signature of the data in hash with the given
-// private key on the secp256k1 curve.
+// private key on the secp256k1 curve, as r || s || v with low s and v 0 or 1.
 func Sign(priv *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
 	sig, err := btcec.SignCompact(S256, (*btcec.PrivateKey)(priv), hash, false)
 	if err != nil {
@@ -38,7 +39,12 @@ func Sign(priv *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
 		term = 1
 	}
 
-	return append(sig, term)[1:], nil
+	// btcec already produces low s signatures, this guards that
+	ret := append(sig, term)[1:]
+	if err = ValidateSignature(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 func SKFromHex(skHex string) (ret *ecdsa.PrivateKey, err error) {
@@ -82,3 +88,10 @@ var MagicEthBytes = []byte("\x19Ethereum Signed Message:\n32")
 func EthSignedMessageHash(hash []byte) []byte {
 	return ethgo.Keccak256(append(bytes.Clone(MagicEthBytes), hash...))
 }
+
+// EthPersonalMessageHash is the EIP-191 'personal_sign' hash of an arbitrary length
+// message; EthSignedMessageHash is the special case of a 32 byte message.
+func EthPersonalMessageHash(msg []byte) []byte {
+	prefix := fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(msg))
+	return ethgo.Keccak256(append([]byte(prefix), msg...))
+}
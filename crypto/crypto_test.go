@@ -1,11 +1,16 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/hex"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
 	"github.com/umbracle/ethgo/wallet"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -37,3 +42,220 @@ func noTestRecover(t *testing.T) {
 	println(checkAddr.String())
 
 }
+
+// the test vectors from the Web3 Secret Storage definition
+var testKeystoreSK = "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d"
+
+var testKeystorePBKDF2 = `{
+	"crypto": {
+		"cipher": "aes-128-ctr",
+		"cipherparams": {"iv": "6087dab2f9fdbbfaddc31a909735c1e6"},
+		"ciphertext": "5318b4d5bcd28de64ee5559e671353e16f075ecae9f99c7a79a38af5f869aa46",
+		"kdf": "pbkdf2",
+		"kdfparams": {
+			"c": 262144,
+			"dklen": 32,
+			"prf": "hmac-sha256",
+			"salt": "ae3cd4e7013836a3df6bd7241b12db061dbe2c6785853cce422d148a624ce0bd"
+		},
+		"mac": "517ead924a9d0dc3124507e3393d175ce3ff7c1e96529c6c555ce9e51205e9b2"
+	},
+	"id": "3198bc9c-6672-5ab3-d995-4942343ae5b6",
+	"version": 3
+}`
+
+var testKeystoreScrypt = `{
+	"crypto": {
+		"cipher": "aes-128-ctr",
+		"cipherparams": {"iv": "83dbcc02d8ccb40e466191a123791e0e"},
+		"ciphertext": "d172bf743a674da9cdad04534d56926ef8358534d458fffccd4e6ad2fbde479c",
+		"kdf": "scrypt",
+		"kdfparams": {
+			"dklen": 32,
+			"n": 262144,
+			"p": 8,
+			"r": 1,
+			"salt": "ab0c7876052600dd703518d6fc3fe8984592145b591fc8fb5c6d43190334ba19"
+		},
+		"mac": "2103ac29920d71da29f15d75b4a16dbe95cfd7ff8faea1056c33131d846e3097"
+	},
+	"id": "3198bc9c-6672-5ab3-d995-4942343ae5b6",
+	"version": 3
+}`
+
+func TestDecryptKeystore(t *testing.T) {
+	for _, keyJSON := range []string{testKeystorePBKDF2, testKeystoreScrypt} {
+		sk, err := DecryptKeystore([]byte(keyJSON), "testpassword")
+		require.NoError(t, err)
+		require.Equal(t, testKeystoreSK, hex.EncodeToString(sk.D.Bytes()))
+
+		_, err = DecryptKeystore([]byte(keyJSON), "wrong")
+		require.ErrorIs(t, err, ErrKeystorePassphrase)
+	}
+}
+
+func TestEncryptKeystore(t *testing.T) {
+	sk, err := RandSK()
+	require.NoError(t, err)
+	keyJSON, err := EncryptKeystore(sk, "secret", LightScryptN, LightScryptP)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(path, keyJSON, 0600))
+	addr, err := KeystoreAddress(path)
+	require.NoError(t, err)
+	require.Equal(t, PubKeyToAddress(&sk.PublicKey), addr)
+
+	loaded, err := LoadKeystore(path, "secret")
+	require.NoError(t, err)
+	require.Equal(t, sk.D, loaded.D)
+	_, err = LoadKeystore(path, "")
+	require.ErrorIs(t, err, ErrKeystorePassphrase)
+}
+
+func TestHDWallet(t *testing.T) {
+	_, err := NewHDWallet("test test test", "", "")
+	require.Error(t, err)
+	_, err = ParseHDPath("44'/60'")
+	require.Error(t, err)
+
+	// the well known development mnemonic
+	w, err := NewHDWallet("test test test test test test test test test test test junk", "", "")
+	require.NoError(t, err)
+	require.Equal(t, "m/44'/60'/0'/0/1", w.Path(1))
+	for i, addr := range []string{"0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"} {
+		sk, err := w.Key(uint32(i))
+		require.NoError(t, err)
+		require.Equal(t, addr, PubKeyToAddress(&sk.PublicKey).String())
+	}
+
+	mnemonic, err := NewMnemonic()
+	require.NoError(t, err)
+	require.Len(t, strings.Fields(mnemonic), 24)
+	_, err = NewHDWallet(mnemonic, "", "m/44'/60'/1'/0")
+	require.NoError(t, err)
+}
+
+func TestSignatureChecks(t *testing.T) {
+	sk, err := SKFromHex(testKeystoreSK)
+	require.NoError(t, err)
+	addr := PubKeyToAddress(&sk.PublicKey)
+	hash := EthSignedMessageHash(ethgo.Keccak256([]byte("op")))
+
+	sig, err := Sign(sk, hash)
+	require.NoError(t, err)
+	require.NoError(t, ValidateSignature(sig))
+	require.Less(t, sig[64], byte(2))
+
+	// both v conventions recover the signer
+	for _, v := range []byte{sig[64], sig[64] + 27} {
+		withV := append(bytes.Clone(sig[:64]), v)
+		recovered, err := Ecrecover(hash, withV)
+		require.NoError(t, err)
+		require.Equal(t, addr, recovered)
+	}
+
+	// the malleable twin (r, n - s) with v flipped is rejected, and normalizes back
+	highS := bytes.Clone(sig)
+	new(big.Int).Sub(S256.N, new(big.Int).SetBytes(sig[32:64])).FillBytes(highS[32:64])
+	highS[64] ^= 1
+	_, err = Ecrecover(hash, highS)
+	require.ErrorIs(t, err, ErrSignatureHighS)
+	normalized, err := NormalizeSignature(highS)
+	require.NoError(t, err)
+	require.Equal(t, sig, normalized)
+
+	withR := func(r *big.Int) []byte {
+		ret := bytes.Clone(sig)
+		r.FillBytes(ret[:32])
+		return ret
+	}
+	for _, tc := range []struct {
+		sig []byte
+		err error
+	}{
+		{sig[:64], ErrSignatureLength},
+		{append(bytes.Clone(sig), 0), ErrSignatureLength},
+		{append(bytes.Clone(sig[:64]), 2), ErrSignatureV},
+		{append(bytes.Clone(sig[:64]), 29), ErrSignatureV},
+		{withR(big.NewInt(0)), ErrSignatureRange},
+		{withR(S256.N), ErrSignatureRange},
+		{append(append(bytes.Clone(sig[:32]), make([]byte, 32)...), 0), ErrSignatureRange},
+	} {
+		_, err = Ecrecover(hash, tc.sig)
+		require.ErrorIs(t, err, tc.err)
+	}
+}
+
+// the example from the EIP-712 specification
+var testTypedData = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallet", "type": "address"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "string"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+func TestTypedData(t *testing.T) {
+	td, err := ParseTypedData([]byte(testTypedData))
+	require.NoError(t, err)
+
+	encType, err := td.EncodeType("Mail")
+	require.NoError(t, err)
+	require.Equal(t, "Mail(Person from,Person to,string contents)Person(string name,address wallet)", encType)
+
+	domainSeparator, err := td.DomainSeparator()
+	require.NoError(t, err)
+	require.Equal(t, "0xf2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f", hexutil.Encode(domainSeparator))
+	structHash, err := td.HashStruct(td.PrimaryType, td.Message)
+	require.NoError(t, err)
+	require.Equal(t, "0xc52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e", hexutil.Encode(structHash))
+	hash, err := td.Hash()
+	require.NoError(t, err)
+	require.Equal(t, "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2", hexutil.Encode(hash))
+
+	// the domain type can be left out
+	delete(td.Types, "EIP712Domain")
+	inferred, err := td.DomainSeparator()
+	require.NoError(t, err)
+	require.Equal(t, domainSeparator, inferred)
+
+	cow, err := SKFromInt(new(big.Int).SetBytes(ethgo.Keccak256([]byte("cow"))))
+	require.NoError(t, err)
+	require.Equal(t, "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826", PubKeyToAddress(&cow.PublicKey).String())
+	sig, err := SignTypedData(cow, td)
+	require.NoError(t, err)
+	require.Equal(t, "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d"+
+		"07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b91562"+"1c", hexutil.Encode(sig))
+	signer, err := RecoverTypedData(td, sig)
+	require.NoError(t, err)
+	require.Equal(t, PubKeyToAddress(&cow.PublicKey), signer)
+
+	td.Message["contents"] = 1
+	_, err = td.Hash()
+	require.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/umbracle/ethgo"
+)
+
+// TypedData is an EIP-712 payload in the eth_signTypedData_v4 JSON format, hashed
+// by go-ethereum's apitypes.
+type TypedData struct {
+	apitypes.TypedData
+}
+
+const eip712DomainType = "EIP712Domain"
+
+// the domain fields in their canonical order, for domains without explicit types
+var eip712DomainFields = []apitypes.Type{
+	{Name: "name", Type: "string"},
+	{Name: "version", Type: "string"},
+	{Name: "chainId", Type: "uint256"},
+	{Name: "verifyingContract", Type: "address"},
+	{Name: "salt", Type: "bytes32"},
+}
+
+// ParseTypedData decodes JSON typed data, keeping numbers exact.
+func ParseTypedData(data []byte) (*TypedData, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	td := &TypedData{}
+	if err := dec.Decode(&td.TypedData); err != nil {
+		return nil, fmt.Errorf("invalid typed data: %v", err.Error())
+	}
+	if len(td.PrimaryType) == 0 {
+		return nil, fmt.Errorf("invalid typed data: no primaryType")
+	}
+	// apitypes takes big numbers as strings, rather than json.Number
+	td.Message = exactNumbers(td.Message).(map[string]any)
+	return td, nil
+}
+
+func exactNumbers(val any) any {
+	switch v := val.(type) {
+	case json.Number:
+		return v.String()
+	case map[string]any:
+		for k := range v {
+			v[k] = exactNumbers(v[k])
+		}
+	case []any:
+		for i := range v {
+			v[i] = exactNumbers(v[i])
+		}
+	}
+	return val
+}
+
+// inferDomainType sets the domain type from the domain fields that are set, when the
+// payload leaves it out.
+func (td *TypedData) inferDomainType() {
+	if _, ok := td.Types[eip712DomainType]; ok {
+		return
+	}
+	if td.Types == nil {
+		td.Types = apitypes.Types{}
+	}
+	domain := td.Domain.Map()
+	fields := []apitypes.Type{}
+	for _, f := range eip712DomainFields {
+		if _, ok := domain[f.Name]; ok {
+			fields = append(fields, f)
+		}
+	}
+	td.Types[eip712DomainType] = fields
+}
+
+// EncodeType returns the EIP-712 encodeType of a struct type: the type itself,
+// followed by the struct types it references, sorted by name.
+func (td *TypedData) EncodeType(typeName string) (string, error) {
+	if _, ok := td.Types[typeName]; !ok {
+		return "", fmt.Errorf("unknown type '%v'", typeName)
+	}
+	return string(td.TypedData.EncodeType(typeName)), nil
+}
+
+// DomainSeparator returns the hashStruct of the domain.
+func (td *TypedData) DomainSeparator() ([]byte, error) {
+	td.inferDomainType()
+	return td.HashStruct(eip712DomainType, td.Domain.Map())
+}
+
+// Hash returns the digest that is signed: keccak256(0x1901 || domainSeparator || hashStruct(message)).
+func (td *TypedData) Hash() ([]byte, error) {
+	td.inferDomainType()
+	hash, _, err := apitypes.TypedDataAndHash(td.TypedData)
+	return hash, err
+}
+
+// SignTypedData signs the typed data's digest as eth_signTypedData_v4 does, with v as 27 or 28.
+func SignTypedData(sk *ecdsa.PrivateKey, td *TypedData) ([]byte, error) {
+	hash, err := td.Hash()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := Sign(sk, hash)
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27
+	return sig, nil
+}
+
+// RecoverTypedData returns the address that signed the typed data.
+func RecoverTypedData(td *TypedData, sig []byte) (ethgo.Address, error) {
+	hash, err := td.Hash()
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	return Ecrecover(hash, sig)
+}
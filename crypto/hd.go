@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/tyler-smith/go-bip39"
+	"strconv"
+	"strings"
+)
+
+// DefaultHDPath is the standard Ethereum BIP-44 path; keys are derived at DefaultHDPath/i.
+const DefaultHDPath = "m/44'/60'/0'/0"
+
+// HDWallet derives keys from a BIP-39 mnemonic along a BIP-32 path.
+type HDWallet struct {
+	path   string
+	parent *hdkeychain.ExtendedKey
+}
+
+// NewMnemonic returns a new random 24 word mnemonic.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(256)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// ParseHDPath parses a path like m/44'/60'/0'/0, where ' marks hardened indexes.
+func ParseHDPath(path string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimSpace(path), "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("invalid hd path '%v', it must start with m", path)
+	}
+	var ret []uint32
+	for _, part := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(part, "'") {
+			offset = hdkeychain.HardenedKeyStart
+			part = strings.TrimSuffix(part, "'")
+		}
+		i, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hd path '%v': %v", path, err.Error())
+		}
+		ret = append(ret, uint32(i)+offset)
+	}
+	return ret, nil
+}
+
+// NewHDWallet derives the parent key at path, DefaultHDPath when empty, from the
+// mnemonic and its optional BIP-39 passphrase.
+func NewHDWallet(mnemonic, passphrase, path string) (*HDWallet, error) {
+	if len(path) == 0 {
+		path = DefaultHDPath
+	}
+	indexes, err := ParseHDPath(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := bip39.NewSeedWithErrorChecking(strings.Join(strings.Fields(mnemonic), " "), passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err.Error())
+	}
+	key, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range indexes {
+		if key, err = key.Derive(i); err != nil {
+			return nil, err
+		}
+	}
+	return &HDWallet{path: path, parent: key}, nil
+}
+
+// Path returns the path of the i'th key.
+func (w *HDWallet) Path(i uint32) string {
+	return fmt.Sprintf("%v/%v", w.path, i)
+}
+
+// Key derives the i'th key.
+func (w *HDWallet) Key(i uint32) (*ecdsa.PrivateKey, error) {
+	child, err := w.parent.Derive(i)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := child.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	return SKFromInt(sk.D)
+}
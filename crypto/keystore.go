@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/umbracle/ethgo"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Web3 Secret Storage (v3 keystore) parameters, the same as geth's
+const (
+	StandardScryptN = keystore.StandardScryptN
+	StandardScryptP = keystore.StandardScryptP
+	LightScryptN    = keystore.LightScryptN
+	LightScryptP    = keystore.LightScryptP
+)
+
+var ErrKeystorePassphrase = keystore.ErrDecrypt
+
+// DecryptKeystore decrypts a v3 keystore, with either the scrypt or pbkdf2 kdf.
+func DecryptKeystore(keyJSON []byte, passphrase string) (*ecdsa.PrivateKey, error) {
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	// back on the curve the rest of the package signs with
+	return SKFromInt(key.PrivateKey.D)
+}
+
+// LoadKeystore reads and decrypts the keystore file at path.
+func LoadKeystore(path, passphrase string) (*ecdsa.PrivateKey, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptKeystore(keyJSON, passphrase)
+}
+
+// KeystoreAddress returns the address a keystore file is for, without decrypting it.
+func KeystoreAddress(path string) (ethgo.Address, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	ks := struct {
+		Address string `json:"address"`
+	}{}
+	if err = json.Unmarshal(keyJSON, &ks); err != nil {
+		return ethgo.ZeroAddress, fmt.Errorf("invalid keystore: %v", err.Error())
+	}
+	addr := strings.TrimPrefix(ks.Address, "0x")
+	if _, err = hex.DecodeString(addr); err != nil || len(addr) != 40 {
+		return ethgo.ZeroAddress, fmt.Errorf("keystore has no valid address")
+	}
+	return ethgo.HexToAddress(addr), nil
+}
+
+// EncryptKeystore encrypts sk as a v3 keystore with the scrypt kdf, use
+// StandardScryptN/P unless the key is only for testing.
+func EncryptKeystore(sk *ecdsa.PrivateKey, passphrase string, scryptN, scryptP int) ([]byte, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	key := &keystore.Key{
+		Id:         id,
+		Address:    common.Address(PubKeyToAddress(&sk.PublicKey)),
+		PrivateKey: sk,
+	}
+	return keystore.EncryptKey(key, passphrase, scryptN, scryptP)
+}
+
+// ReadSecretFile reads a secret mounted as a file, e.g. a Docker or Kubernetes
+// secret, without the trailing newline.
+func ReadSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// PromptPassphrase asks for a passphrase on the terminal, with echo off where
+// stty is available.
+func PromptPassphrase(prompt string) (string, error) {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("no passphrase given and stdin isn't a terminal to prompt on")
+	}
+	fmt.Fprint(os.Stderr, prompt+": ")
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() { _ = stty("echo") }()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"errors"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/wallet"
+	"math/big"
+)
+
+var (
+	ErrSignatureLength = errors.New("signature must be 65 bytes")
+	ErrSignatureV      = errors.New("signature v must be 0, 1, 27 or 28")
+	ErrSignatureRange  = errors.New("signature r or s is out of range")
+	// the other signature of the same hash, (r, n - s), is the canonical one
+	ErrSignatureHighS = errors.New("signature s is not canonical, it must be in the lower half of the curve order")
+)
+
+var secp256k1HalfN = new(big.Int).Rsh(S256.N, 1)
+
+// NormalizeV returns v as 0 or 1, accepting both that and the 27/28 convention.
+func NormalizeV(v byte) (byte, error) {
+	switch v {
+	case 0, 1:
+		return v, nil
+	case 27, 28:
+		return v - 27, nil
+	}
+	return 0, ErrSignatureV
+}
+
+// ValidateSignature checks a 65 byte r || s || v signature is canonical: r and s in
+// [1, n - 1], s no more than n / 2, and v one of 0, 1, 27 or 28.
+func ValidateSignature(sig []byte) error {
+	if len(sig) != 65 {
+		return ErrSignatureLength
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	if r.Sign() == 0 || s.Sign() == 0 || r.Cmp(S256.N) >= 0 || s.Cmp(S256.N) >= 0 {
+		return ErrSignatureRange
+	}
+	if s.Cmp(secp256k1HalfN) > 0 {
+		return ErrSignatureHighS
+	}
+	_, err := NormalizeV(sig[64])
+	return err
+}
+
+// NormalizeSignature returns the canonical form of a signature that is otherwise
+// valid: low s, with v flipped to match, and v as 0 or 1.
+func NormalizeSignature(sig []byte) ([]byte, error) {
+	if len(sig) != 65 {
+		return nil, ErrSignatureLength
+	}
+	v, err := NormalizeV(sig[64])
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 65)
+	copy(ret, sig)
+	ret[64] = v
+	if s := new(big.Int).SetBytes(sig[32:64]); s.Cmp(secp256k1HalfN) > 0 && s.Cmp(S256.N) < 0 {
+		new(big.Int).Sub(S256.N, s).FillBytes(ret[32:64])
+		ret[64] ^= 1
+	}
+	return ret, ValidateSignature(ret)
+}
+
+// Ecrecover returns the address that signed hash, rejecting signatures that
+// aren't canonical.
+func Ecrecover(hash, sig []byte) (ethgo.Address, error) {
+	if err := ValidateSignature(sig); err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	rsv := make([]byte, 65)
+	copy(rsv, sig)
+	rsv[64], _ = NormalizeV(sig[64])
+	return wallet.Ecrecover(hash, rsv)
+}
@@ -0,0 +1,126 @@
+package erc4337
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+var balanceOfMethod, _ = abi.NewMethod("function balanceOf(address account) view returns (uint256)")
+
+type AccountOverview struct {
+	Sender ethgo.Address `json:"sender"`
+	Nonce  *hexutil.Big  `json:"nonce"`
+	// the account's ether, and its entry point deposit, which pays for ops sent
+	// without a paymaster
+	Balance *hexutil.Big `json:"balance"`
+	Deposit *hexutil.Big `json:"deposit"`
+	// balances of the tokens asked for, by token address
+	Tokens map[string]*hexutil.Big `json:"tokens,omitempty"`
+}
+
+func decodeUint(data []byte) (*big.Int, error) {
+	if len(data) != 32 {
+		return nil, fmt.Errorf("unexpected - expected a uint256, got %v bytes", len(data))
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// ReadAccount reads the owner's account nonce and balances, in one call through
+// Multicall3 when it's deployed.
+func (hc *HandlerContext) ReadAccount(ctx context.Context, owner ethgo.Address, salt *big.Int, tokens []ethgo.Address) (*AccountOverview, error) {
+	initCode, err := MakeInitCode(DefaultAccountFactory, owner, salt)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := hc.getSenderAddress(ctx, initCode)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceData, err := hc.EntryPoint.GetABI().GetMethod("getNonce").Encode([]any{sender, big.NewInt(0)})
+	if err != nil {
+		return nil, err
+	}
+	depositData, err := hc.EntryPoint.GetABI().GetMethod("balanceOf").Encode([]any{sender})
+	if err != nil {
+		return nil, err
+	}
+	tokenData, err := balanceOfMethod.Encode([]any{sender})
+	if err != nil {
+		return nil, err
+	}
+	calls := []chain.Call{
+		{Target: DefaultEntryPoint, Data: nonceData},
+		{Target: DefaultEntryPoint, Data: depositData},
+		{Target: sender},
+	}
+	for _, token := range tokens {
+		calls = append(calls, chain.Call{Target: token, Data: tokenData})
+	}
+	results, err := hc.chainAggregate(ctx, calls)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*big.Int, len(results))
+	for i, res := range results {
+		if res.Err != nil {
+			return nil, fmt.Errorf("reading %v: %w", calls[i].Target.String(), res.Err)
+		}
+		if values[i], err = decodeUint(res.Data); err != nil {
+			return nil, err
+		}
+	}
+	overview := &AccountOverview{
+		Sender:  sender,
+		Nonce:   (*hexutil.Big)(values[0]),
+		Deposit: (*hexutil.Big)(values[1]),
+		Balance: (*hexutil.Big)(values[2]),
+	}
+	if len(tokens) != 0 {
+		overview.Tokens = map[string]*hexutil.Big{}
+		for i, token := range tokens {
+			overview.Tokens[token.String()] = (*hexutil.Big)(values[3+i])
+		}
+	}
+	return overview, nil
+}
+
+// HandleAccount returns the owner's account nonce and balances, with the balances of
+// the comma separated tokens.
+// GET erc4337/account?owner=XXXX&salt=N&tokens=YYYY,ZZZZ
+func (hc *HandlerContext) HandleAccount(c *gin.Context) {
+	q := c.Request.URL.Query()
+	ownerAddr := handleRequiredAddress(q.Get("owner"))
+	salt := handleRequiredSalt(q.Get("salt"))
+	if ownerAddr == nil || salt == nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+	var tokens []ethgo.Address
+	if len(q.Get("tokens")) != 0 {
+		for _, s := range strings.Split(q.Get("tokens"), ",") {
+			token := handleRequiredAddress(strings.TrimSpace(s))
+			if token == nil {
+				c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid token address '%v'", s))
+				return
+			}
+			tokens = append(tokens, *token)
+		}
+	}
+
+	overview, err := hc.ReadAccount(c.Request.Context(), *ownerAddr, salt, tokens)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, overview)
+}
@@ -0,0 +1,98 @@
+package erc4337
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/oneness/erc-4337-api/bundler"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"math/big"
+)
+
+// The exported methods here let the userop cli run the same steps as the handlers,
+// directly against the chain, bundler and paymaster.
+
+func (hc *HandlerContext) OwnerInfo(ctx context.Context, owner ethgo.Address, salt *big.Int) (nonce *big.Int, sender ethgo.Address, err error) {
+	return hc.getOwnerInfo(ctx, owner, salt)
+}
+
+func (hc *HandlerContext) GasPrice(ctx context.Context) (*big.Int, error) {
+	return hc.getGasPrice(ctx)
+}
+
+// Sponsor sponsors the op as the builder routes do, subject to the sponsorship policy.
+func (hc *HandlerContext) Sponsor(ctx context.Context, op *userop.UserOperation, owner ethgo.Address, gasToken *ethgo.Address) (*userop.UserOperation, *paymaster.Quote, error) {
+	return hc.getPaymasterInfo(ctx, op, owner, gasToken)
+}
+
+func (hc *HandlerContext) SendUserOp(ctx context.Context, op *userop.UserOperation) (opHash string, err error) {
+	return hc.sendUserOp(ctx, op)
+}
+
+const (
+	OpStatusUnknown  = "unknown"
+	OpStatusPending  = "pending"
+	OpStatusIncluded = "included"
+	// the in-process bundler dropped the op, or its batch failed
+	OpStatusFailed = "failed"
+	// a sped up or cancelled op took its place in the in-process bundler
+	OpStatusReplaced = "replaced"
+)
+
+type OpStatus struct {
+	Status  string          `json:"status"`
+	Success *bool           `json:"success,omitempty"`
+	Receipt json.RawMessage `json:"receipt,omitempty"`
+	TxHash  string          `json:"txHash,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// localOpStatus reads the op's status from the in-process bundler.
+func (hc *HandlerContext) localOpStatus(opHash string) (*OpStatus, error) {
+	r, found, err := hc.Bundler.Status(opHash)
+	if err != nil || !found {
+		return &OpStatus{Status: OpStatusUnknown}, err
+	}
+	status := &OpStatus{Success: r.Success, TxHash: r.TxHash, Reason: r.Reason}
+	switch r.Status {
+	case bundler.OpPending, bundler.OpSubmitted:
+		status.Status = OpStatusPending
+	case bundler.OpIncluded:
+		status.Status = OpStatusIncluded
+	case bundler.OpReplaced:
+		status.Status = OpStatusReplaced
+	default:
+		status.Status = OpStatusFailed
+	}
+	return status, nil
+}
+
+// UserOpStatus asks the bundler whether the op has been included, or is still known to it.
+func (hc *HandlerContext) UserOpStatus(ctx context.Context, opHash string) (*OpStatus, error) {
+	if hc.Bundler != nil {
+		return hc.localOpStatus(opHash)
+	}
+	var receipt json.RawMessage
+	if err := hc.bundlerCall(ctx, &receipt, "eth_getUserOperationReceipt", opHash); err != nil {
+		return nil, err
+	}
+	if len(receipt) != 0 && string(receipt) != "null" {
+		var outcome struct {
+			Success bool `json:"success"`
+		}
+		if err := json.Unmarshal(receipt, &outcome); err != nil {
+			return nil, err
+		}
+		return &OpStatus{Status: OpStatusIncluded, Success: &outcome.Success, Receipt: receipt}, nil
+	}
+
+	var op json.RawMessage
+	if err := hc.bundlerCall(ctx, &op, "eth_getUserOperationByHash", opHash); err != nil {
+		return nil, err
+	}
+	if len(op) != 0 && string(op) != "null" {
+		return &OpStatus{Status: OpStatusPending}, nil
+	}
+	return &OpStatus{Status: OpStatusUnknown}, nil
+}
@@ -0,0 +1,101 @@
+package erc4337
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+)
+
+// DecodedCall is one call made by an op; Method and Args are set for the calls the
+// builders make.
+type DecodedCall struct {
+	Target ethgo.Address          `json:"target"`
+	Value  *hexutil.Big           `json:"value"`
+	Method string                 `json:"method,omitempty"`
+	Args   map[string]interface{} `json:"args,omitempty"`
+	Data   hexutil.Bytes          `json:"data"`
+}
+
+var knownMethods = []*abi.Method{transferMethod, approveMethod, withdrawToMethod, mintMethod}
+
+func decodeMethodArgs(m *abi.Method, data []byte) (map[string]interface{}, error) {
+	decoded, err := abi.Decode(m.Inputs, data[4:])
+	if err != nil {
+		return nil, err
+	}
+	args, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected - expected map for decoded '%v' args", m.Name)
+	}
+	return args, nil
+}
+
+func decodeCall(target ethgo.Address, value *big.Int, data []byte) *DecodedCall {
+	call := &DecodedCall{Target: target, Value: (*hexutil.Big)(value), Data: data}
+	if len(data) < 4 {
+		return call
+	}
+	for _, m := range knownMethods {
+		if bytes.Equal(data[:4], m.ID()) {
+			if args, err := decodeMethodArgs(m, data); err == nil {
+				call.Method = m.Sig()
+				call.Args = args
+			}
+			break
+		}
+	}
+	return call
+}
+
+// DecodeCallData decodes an execute or executeBatch call to an account.
+func DecodeCallData(callData []byte) ([]*DecodedCall, error) {
+	if len(callData) < 4 {
+		return nil, fmt.Errorf("call data too short: %v", len(callData))
+	}
+	switch {
+	case bytes.Equal(callData[:4], abiExec.ID()):
+		args, err := decodeMethodArgs(abiExec, callData)
+		if err != nil {
+			return nil, err
+		}
+		to, _ := args["to"].(ethgo.Address)
+		value, _ := args["value"].(*big.Int)
+		data, _ := args["data"].([]byte)
+		return []*DecodedCall{decodeCall(to, value, data)}, nil
+	case bytes.Equal(callData[:4], abiExecBatch.ID()):
+		args, err := decodeMethodArgs(abiExecBatch, callData)
+		if err != nil {
+			return nil, err
+		}
+		dest, _ := args["dest"].([]ethgo.Address)
+		funcs, _ := args["func"].([][]byte)
+		if len(dest) != len(funcs) {
+			return nil, fmt.Errorf("executeBatch length mismatch: %v targets, %v calls", len(dest), len(funcs))
+		}
+		var calls []*DecodedCall
+		for i := range dest {
+			calls = append(calls, decodeCall(dest[i], big.NewInt(0), funcs[i]))
+		}
+		return calls, nil
+	}
+	return nil, fmt.Errorf("unknown account method %v", hexutil.Encode(callData[:4]))
+}
+
+// DecodeInitCode splits initCode into the factory and the createAccount args.
+func DecodeInitCode(initCode []byte) (factory, owner ethgo.Address, salt *big.Int, err error) {
+	if len(initCode) < 24 || !bytes.Equal(initCode[20:24], createAccountMethod.ID()) {
+		err = fmt.Errorf("unknown init code")
+		return
+	}
+	factory = ethgo.BytesToAddress(initCode[:20])
+	args, err := decodeMethodArgs(createAccountMethod, initCode[20:])
+	if err != nil {
+		return
+	}
+	owner, _ = args["owner"].(ethgo.Address)
+	salt, _ = args["salt"].(*big.Int)
+	return
+}
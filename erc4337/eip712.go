@@ -0,0 +1,71 @@
+package erc4337
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/crypto"
+	"io"
+	"net/http"
+)
+
+// typed data is small, bigger bodies are refused before they're read
+const maxTypedDataSize = 64 << 10
+
+type typedDataHashResponse struct {
+	Digest          hexutil.Bytes `json:"digest"`
+	DomainSeparator hexutil.Bytes `json:"domainSeparator"`
+	StructHash      hexutil.Bytes `json:"structHash"`
+	// the address that made the signature query parameter, if given
+	Signer string `json:"signer,omitempty"`
+}
+
+// HandleTypedDataHash returns the EIP-712 digest of the eth_signTypedData_v4 payload
+// in the body, and with ?signature=0x.. the address that signed it.
+func (hc *HandlerContext) HandleTypedDataHash(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxTypedDataSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	td, err := crypto.ParseTypedData(body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	resp := typedDataHashResponse{}
+	if resp.DomainSeparator, err = td.DomainSeparator(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("domain: %v", err.Error()))
+		return
+	}
+	if resp.StructHash, err = td.HashStruct(td.PrimaryType, td.Message); err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("message: %v", err.Error()))
+		return
+	}
+	if resp.Digest, err = td.Hash(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if sigHex := c.Query("signature"); len(sigHex) != 0 {
+		sig, err := hexutil.Decode(sigHex)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid signature"))
+			return
+		}
+		signer, err := crypto.Ecrecover(resp.Digest, sig)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		resp.Signer = signer.String()
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -1,15 +1,26 @@
 package erc4337
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/auth"
+	"github.com/oneness/erc-4337-api/bundler"
 	"github.com/oneness/erc-4337-api/chain"
 	"github.com/oneness/erc-4337-api/config"
-	"github.com/oneness/erc-4337-api/crypto"
-	"github.com/stackup-wallet/stackup-bundler/pkg/entrypoint/execution"
+	"github.com/oneness/erc-4337-api/nonces"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/oneness/erc-4337-api/policy"
+	"github.com/oneness/erc-4337-api/replace"
+	"github.com/oneness/erc-4337-api/session"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/oneness/erc-4337-api/upstream"
 	"github.com/stackup-wallet/stackup-bundler/pkg/entrypoint/reverts"
 	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
 	"github.com/umbracle/ethgo"
@@ -18,6 +29,7 @@ import (
 	"github.com/umbracle/ethgo/jsonrpc/codec"
 	"math/big"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -75,65 +87,137 @@ func handleSimulationError(err error) {
 	}
 }
 
+// how many account addresses are cached, each keyed by its ~90 byte init code
+const senderCacheSize = 10_000
+
 type HandlerContext struct {
 	testContext map[string]string
 	chainRpc    *jsonrpc.Client
+	// batches and aggregates reads on the build path
+	reader *chain.Reader
+	// counterfactual account addresses by init code, which never change; bounded, as
+	// it's filled from unauthenticated requests
+	senders *lru.Cache[string, ethgo.Address]
 
 	suNodeRpc *rpc.Client
 	suPMRpc   *rpc.Client
+	// the endpoint pools behind the clients above, probed by their Run
+	Upstreams []*upstream.Pool
+	timeouts  upstreamTimeouts
 
 	ChainId      *big.Int
 	EntryPoint   *contract.Contract
 	ChainKeyAddr ethgo.Address
-	EcdsaKey     *chain.EcdsaKey
-
-	simulateUserOp   bool
-	sendUserOpDirect bool
+	// the server key when held locally; Signer is set whenever there's a server key,
+	// local or remote
+	EcdsaKey *chain.EcdsaKey
+	Signer   chain.Signer
+	// keys derived to submit handleOps from; the server key submits when empty
+	Submitters *chain.SignerPool
+
+	// checked before any op is sent for sponsorship, if set
+	SponsorPolicy *policy.Engine
+	// session keys, scoped to what they may do from an account; nil when disabled
+	Sessions *session.Manager
+	// pending nonces of ops built and sent through this server; nil in tests
+	Nonces *nonces.Manager
+	// in-process bundler; when nil ops are sent to the bundler service
+	Bundler *bundler.Bundler
+	// in-process paymaster; when nil ops are sponsored by the paymaster service
+	Paymaster *paymaster.VerifyingSigner
+	// ERC-20 gas payment through the in-process paymaster, if exchange rates are configured
+	TokenQuoter     *paymaster.TokenQuoter
+	TokenReconciler *paymaster.Reconciler
+
+	// sent ops are kept here so they can be replaced; nil in tests
+	store *store.Store
+	// how much replacements raise both fees by, in percent
+	feeBumpPercent int64
+
+	// ops are checked with simulateValidation before they're sent, when set
+	validateOps bool
+	validation  ValidationConfig
 }
 
 func makeTestContext(testContext map[string]string) (*HandlerContext, error) {
-	return &HandlerContext{testContext: testContext}, nil
+	return &HandlerContext{testContext: testContext, senders: lru.NewCache[string, ethgo.Address](senderCacheSize)}, nil
 }
 
-func MakeContext(config config.Config) (*HandlerContext, error) {
+func MakeContext(config config.Config, st *store.Store) (*HandlerContext, error) {
 	abiEPBytes, err := abiIEP.ReadFile("abi/IEntryPoint.json")
 	if err != nil {
 		return nil, err
 	}
 
-	chainRpc, err := jsonrpc.NewClient(config.ChainRpcUrl)
+	var pools []*upstream.Pool
+	chainRpc, pool, err := DialChain(config)
 	if err != nil {
 		return nil, err
 	}
-
-	nodeRpc, err := rpc.Dial(config.SUNodeUrl)
+	pools = append(pools, pool)
+	reader, err := dialChainReader(config, pool)
 	if err != nil {
 		return nil, err
 	}
 
-	pmRpc, err := rpc.Dial(config.SUPayMasterUrl)
-	if err != nil {
-		return nil, err
+	// the bundler service is only needed for op receipts when bundling in-process
+	var nodeRpc *rpc.Client
+	if !config.LocalBundler() || len(config.SUNodeUrl) != 0 {
+		if nodeRpc, pool, err = dialRPC("bundler", config.BundlerUrls(), config, config.BundlerTimeout); err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+
+	// the paymaster service isn't needed when sponsoring in-process
+	var pmRpc *rpc.Client
+	if !config.LocalPaymaster() {
+		if pmRpc, pool, err = dialRPC("paymaster", config.PaymasterUrls(), config, config.PaymasterTimeout); err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
 	}
 
 	chainId, err := chainRpc.Eth().ChainID()
 	if err != nil {
-		log.Errorf("failed to connect to blockchain at %v, error %v", config.ChainRpcUrl, err.Error())
+		log.Errorf("failed to connect to blockchain, error %v", err.Error())
 		return nil, err
 	}
-	hc := &HandlerContext{ChainId: chainId, chainRpc: chainRpc, suNodeRpc: nodeRpc, suPMRpc: pmRpc}
-	log.Infof("connected to chain with url %v, got chain id %v", config.ChainRpcUrl, chainId.Int64())
+	hc := &HandlerContext{ChainId: chainId, chainRpc: chainRpc, reader: reader, suNodeRpc: nodeRpc, suPMRpc: pmRpc, timeouts: makeUpstreamTimeouts(config), store: st,
+		senders: lru.NewCache[string, ethgo.Address](senderCacheSize)}
+	for _, p := range pools {
+		// nil for endpoints dialed directly
+		if p != nil {
+			hc.Upstreams = append(hc.Upstreams, p)
+		}
+	}
+	log.Infof("connected to chain with %v endpoint(s), got chain id %v", len(config.ChainRpcUrls()), chainId.Int64())
 
 	var maybeKey *chain.EcdsaKey
-	if len(config.ChainSKHex) != 0 {
-		if sk, err := crypto.SKFromHex(config.ChainSKHex); err != nil {
+	if sk, err := config.ChainKey(); err != nil {
+		return nil, fmt.Errorf("invalid chain key: %v", err.Error())
+	} else if sk != nil {
+		maybeKey = &chain.EcdsaKey{SK: sk}
+		hc.EcdsaKey = maybeKey
+		hc.Signer = maybeKey
+	} else if len(config.RemoteSignerUrl) != 0 {
+		if hc.Signer, err = chain.NewRemoteSigner(config.RemoteSignerUrl, ethgo.HexToAddress(config.ChainSignerAddress), config.ChainTimeout); err != nil {
 			return nil, err
-		} else {
-			maybeKey = &chain.EcdsaKey{SK: sk}
-			hc.EcdsaKey = maybeKey
 		}
-		hc.ChainKeyAddr = maybeKey.Address()
+		log.Infof("signing as %v with the remote signer at %v", hc.Signer.Address().String(), config.RemoteSignerUrl)
+	}
+	if hc.Signer != nil {
+		hc.ChainKeyAddr = hc.Signer.Address()
+	}
+	submitterKeys, err := config.SubmitterKeys()
+	if err != nil {
+		return nil, err
+	}
+	var submitters []chain.Signer
+	for _, sk := range submitterKeys {
+		submitters = append(submitters, &chain.EcdsaKey{SK: sk})
 	}
+	hc.Submitters = chain.NewSignerPool(submitters...)
 
 	hc.EntryPoint, err = chain.LoadReadContractAbi(chainRpc, abiEPBytes, DefaultEntryPoint, maybeKey)
 	//hc.EntryPoint, err = chain.LoadContract(chainRpc, "IEntryPoint.sol/IEntryPoint", maybeKey, DefaultEntryPoint)
@@ -142,25 +226,185 @@ func MakeContext(config config.Config) (*HandlerContext, error) {
 		return nil, err
 	}
 
-	hc.simulateUserOp = false
-	hc.sendUserOpDirect = false
+	if config.LocalPaymaster() {
+		if hc.Paymaster, err = makeLocalPaymaster(config, chainRpc, chainId); err != nil {
+			return nil, err
+		}
+		log.Infof("sponsoring ops in-process for paymaster %v, verifier %v",
+			hc.Paymaster.Paymaster.String(), hc.Paymaster.Verifier.Address().String())
+
+		if len(config.TokenRates) != 0 || len(config.TokenRatesFile) != 0 {
+			if err = hc.makeTokenQuoter(config, st); err != nil {
+				return nil, err
+			}
+		}
+	} else if len(config.TokenRates) != 0 || len(config.TokenRatesFile) != 0 {
+		return nil, fmt.Errorf("token gas payment requires the local paymaster mode")
+	}
+
+	hc.validateOps = config.ValidateOps
+	hc.validation = ValidationConfig{ValidUntilMargin: config.ValidUntilMargin, MinUnstakeDelay: config.MinUnstakeDelay}
+	if len(config.MinPaymasterStake) != 0 {
+		var ok bool
+		if hc.validation.MinPaymasterStake, ok = new(big.Int).SetString(config.MinPaymasterStake, 10); !ok {
+			return nil, fmt.Errorf("invalid minimum paymaster stake '%v'", config.MinPaymasterStake)
+		}
+	}
+	hc.Nonces = nonces.NewManager(st, config.NonceTTL, config.NonceSentTTL)
+	hc.feeBumpPercent = config.FeeBumpPercent
+	if hc.feeBumpPercent <= 0 {
+		hc.feeBumpPercent = replace.MinFeeBumpPercent
+	}
+	if config.LocalBundler() {
+		if err = hc.makeLocalBundler(config, st); err != nil {
+			return nil, err
+		}
+	}
 
 	return hc, nil
 }
 
+func makeLocalPaymaster(config config.Config, chainRpc *jsonrpc.Client, chainId *big.Int) (*paymaster.VerifyingSigner, error) {
+	if handleRequiredAddress(config.PaymasterAddress) == nil {
+		return nil, fmt.Errorf("local paymaster mode requires a paymaster address")
+	}
+	var verifier chain.Signer
+	sk, err := config.VerifierKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid paymaster verifier key: %v", err.Error())
+	}
+	if sk != nil {
+		verifier = &chain.EcdsaKey{SK: sk}
+	} else if len(config.RemoteSignerUrl) != 0 && handleRequiredAddress(config.PaymasterVerifierAddress) != nil {
+		if verifier, err = chain.NewRemoteSigner(config.RemoteSignerUrl, ethgo.HexToAddress(config.PaymasterVerifierAddress), config.ChainTimeout); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("local paymaster mode requires a verifier key or a verifier address on the remote signer")
+	}
+	signer := paymaster.NewVerifyingSigner(ethgo.HexToAddress(config.PaymasterAddress), chainId, verifier, config.PaymasterValidity)
+	if config.PaymasterCrossCheck {
+		if err = signer.WithCrossCheck(chainRpc); err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
+
+func (hc *HandlerContext) makeTokenQuoter(config config.Config, st *store.Store) (err error) {
+	var rates paymaster.RateSource
+	if len(config.TokenRatesFile) != 0 {
+		if rates, err = paymaster.NewFileRates(config.TokenRatesFile); err != nil {
+			return
+		}
+	} else if rates, err = paymaster.ParseStaticRates(config.TokenRates); err != nil {
+		return
+	}
+
+	pm, err := paymaster.LoadContract(hc.chainRpc, hc.Paymaster.Paymaster, nil)
+	if err != nil {
+		return
+	}
+	postOpGas, err := paymaster.ReadPostOpGas(pm)
+	if err != nil {
+		log.Warnf("failed to read paymaster POST_OP_GAS, using %v: %v", paymaster.DefaultPostOpGas.String(), err.Error())
+		postOpGas = nil
+	}
+	vault, err := paymaster.ReadVault(pm)
+	if err != nil {
+		return fmt.Errorf("failed to read paymaster vault: %v", err.Error())
+	}
+
+	hc.TokenQuoter = paymaster.NewTokenQuoter(hc.Paymaster, rates, postOpGas, st)
+	if hc.suNodeRpc != nil {
+		hc.TokenReconciler = paymaster.NewReconciler(hc.TokenQuoter.Settlements(), hc.suNodeRpc, vault, 0)
+	} else {
+		log.Warn("no bundler url to read op receipts from - token settlements won't be reconciled")
+	}
+	log.Infof("accepting gas payment in tokens, paid to vault %v", vault.String())
+	return nil
+}
+
+func (hc *HandlerContext) makeLocalBundler(config config.Config, st *store.Store) (err error) {
+	submitters := hc.Submitters
+	if len(submitters.Signers()) == 0 {
+		if hc.Signer == nil {
+			return fmt.Errorf("the local bundler needs a server key or submitter keys")
+		}
+		submitters = chain.NewSignerPool(hc.Signer)
+	}
+	cfg := bundler.Config{Interval: config.BundleInterval, Beneficiary: hc.ChainKeyAddr, MinFeeBumpPercent: hc.feeBumpPercent}
+	if len(config.BundlerBeneficiary) != 0 {
+		cfg.Beneficiary = ethgo.HexToAddress(config.BundlerBeneficiary)
+	}
+	if config.MaxBatchGasLimit != 0 {
+		cfg.MaxBatchGasLimit = new(big.Int).SetUint64(config.MaxBatchGasLimit)
+	}
+	// dropped ops didn't use their nonce, the next build takes it
+	cfg.OnDrop = func(op *userop.UserOperation, status string) {
+		opsFailed.WithLabelValues(failBundlePrefix + status).Inc()
+		opHash := op.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId).String()
+		if err := hc.Nonces.Dropped(ethgo.Address(op.Sender), op.Nonce, opHash); err != nil {
+			log.Warnf("failed to release nonce of dropped op '%v': %v", opHash, err.Error())
+		}
+	}
+	if hc.Bundler, err = bundler.New(hc.ChainClient(), DefaultEntryPoint, hc.ChainId, submitters, st, cfg); err != nil {
+		return
+	}
+	log.Infof("bundling ops in-process every %v, beneficiary %v", config.BundleInterval.String(), cfg.Beneficiary.String())
+	return
+}
+
 // TODO: this might get kind of expensive. in the future we could have a goproc that updates a cached price
-func (hc *HandlerContext) getGasPrice() (*big.Int, error) {
-	if price, err := hc.chainRpc.Eth().GasPrice(); err != nil {
+func (hc *HandlerContext) getGasPrice(ctx context.Context) (*big.Int, error) {
+	var price uint64
+	if err := hc.chainCall(ctx, func() (err error) {
+		price, err = hc.chainRpc.Eth().GasPrice()
+		return
+	}); err != nil {
 		return nil, err
-	} else {
-		return big.NewInt(int64(price)), nil
 	}
+	observeGasPrice(new(big.Int).SetUint64(price))
+	return new(big.Int).SetUint64(price), nil
+}
+
+// senderAddressRead is the getSenderAddress call for initCode, for a batch; the call
+// always reverts, with the address.
+func (hc *HandlerContext) senderAddressRead(initCode []byte) (rpc.BatchElem, error) {
+	data, err := hc.EntryPoint.GetABI().GetMethod("getSenderAddress").Encode([]any{initCode})
+	return chain.CallElem(DefaultEntryPoint, data, new(hexutil.Bytes)), err
 }
 
-func (hc *HandlerContext) getOwnerInfo(ownerAddr ethgo.Address, salt *big.Int) (nonce *big.Int, senderAddr ethgo.Address, err error) {
+// getSenderAddress returns the address of the account initCode deploys.
+func (hc *HandlerContext) getSenderAddress(ctx context.Context, initCode []byte) (ethgo.Address, error) {
+	if sender, found := hc.senders.Get(string(initCode)); found {
+		return sender, nil
+	}
+	read, err := hc.senderAddressRead(initCode)
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	reqs := []rpc.BatchElem{read}
+	if err = hc.chainBatch(ctx, reqs); err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	sender, err := getSenderAddressFromError(reqs[0].Error)
+	if err == nil {
+		hc.senders.Add(string(initCode), sender)
+	}
+	return sender, err
+}
+
+// readOwnerInfo reads the owner's account address and nonce, and the gas price when
+// withGasPrice is set. The reads are batched: the nonce's needs the address, so when
+// it isn't cached the address is read first, along with the gas price.
+func (hc *HandlerContext) readOwnerInfo(ctx context.Context, ownerAddr ethgo.Address, salt *big.Int, withGasPrice bool) (nonce *big.Int, senderAddr ethgo.Address, gasPrice *big.Int, err error) {
 	if len(hc.testContext) != 0 {
 		nonce, _ = new(big.Int).SetString(hc.testContext["nonce"], 10)
 		senderAddr = ethgo.HexToAddress(hc.testContext["sender"])
+		if withGasPrice {
+			gasPrice, err = hc.getGasPrice(ctx)
+		}
 		return
 	}
 
@@ -169,14 +413,47 @@ func (hc *HandlerContext) getOwnerInfo(ownerAddr ethgo.Address, salt *big.Int) (
 		return
 	}
 
-	_, err = hc.EntryPoint.Call("getSenderAddress", ethgo.Latest, ownerInitCode)
-	// this method is expected to revert
-	if senderAddr, err = getSenderAddressFromError(err); err != nil {
-		return
+	var price hexutil.Big
+	var reqs []rpc.BatchElem
+	if withGasPrice {
+		reqs = append(reqs, rpc.BatchElem{Method: "eth_gasPrice", Result: &price})
+	}
+	if cached, found := hc.senders.Get(string(ownerInitCode)); found {
+		senderAddr = cached
+	} else {
+		var read rpc.BatchElem
+		if read, err = hc.senderAddressRead(ownerInitCode); err != nil {
+			return
+		}
+		reqs = append(reqs, read)
+		if err = hc.chainBatch(ctx, reqs); err != nil {
+			return
+		}
+		if senderAddr, err = getSenderAddressFromError(reqs[len(reqs)-1].Error); err != nil {
+			return
+		}
+		hc.senders.Add(string(ownerInitCode), senderAddr)
+		if err = batchError(reqs[:len(reqs)-1]); err != nil {
+			return
+		}
+		reqs = nil
 	}
 
+	var nonceData []byte
+	var nonceOut hexutil.Bytes
+	getNonce := hc.EntryPoint.GetABI().GetMethod("getNonce")
+	if nonceData, err = getNonce.Encode([]any{senderAddr, big.NewInt(0)}); err != nil {
+		return
+	}
+	reqs = append(reqs, chain.CallElem(DefaultEntryPoint, nonceData, &nonceOut))
+	if err = hc.chainBatch(ctx, reqs); err != nil {
+		return
+	}
+	if err = batchError(reqs); err != nil {
+		return
+	}
 	var res map[string]interface{}
-	if res, err = hc.EntryPoint.Call("getNonce", ethgo.Latest, senderAddr, big.NewInt(0)); err != nil {
+	if res, err = getNonce.Decode(nonceOut); err != nil {
 		return
 	}
 	var ok bool
@@ -184,22 +461,120 @@ func (hc *HandlerContext) getOwnerInfo(ownerAddr ethgo.Address, salt *big.Int) (
 		err = fmt.Errorf("unexpected - expected *big.Int for nonce return value")
 		return
 	}
+	if withGasPrice {
+		gasPrice = price.ToInt()
+		observeGasPrice(gasPrice)
+	}
+	return
+}
 
+func (hc *HandlerContext) getOwnerInfo(ctx context.Context, ownerAddr ethgo.Address, salt *big.Int) (nonce *big.Int, senderAddr ethgo.Address, err error) {
+	nonce, senderAddr, _, err = hc.readOwnerInfo(ctx, ownerAddr, salt, false)
+	return
+}
+
+// getBuildInfo is getOwnerInfo for an op being built, with the gas price, and with the
+// account's next pending nonce instead of the chain's, so ops built before the
+// previous ones are included don't collide. The nonce is held until it's sent or the
+// build is abandoned.
+func (hc *HandlerContext) getBuildInfo(ctx context.Context, ownerAddr ethgo.Address, salt *big.Int) (nonce *big.Int, senderAddr ethgo.Address, gasPrice *big.Int, err error) {
+	if nonce, senderAddr, gasPrice, err = hc.readOwnerInfo(ctx, ownerAddr, salt, true); err != nil || hc.Nonces == nil {
+		return
+	}
+	if hc.Bundler == nil {
+		hc.resyncSentNonces(ctx, senderAddr, nonce)
+	}
+	nonce, err = hc.Nonces.Next(senderAddr, nonce)
 	return
 }
 
-func (hc *HandlerContext) getPaymasterInfo(userOp *userop.UserOperation) (newOp *userop.UserOperation, err error) {
+// resyncSentNonces frees the nonces of sent ops the external bundler no longer knows
+// of: it drops ops without saying so, which would leave a nonce gap until the sent TTL
+// passes. The in-process bundler reports drops through OnDrop instead.
+func (hc *HandlerContext) resyncSentNonces(ctx context.Context, sender ethgo.Address, chainNonce *big.Int) {
+	sent, err := hc.Nonces.SentOps(sender, chainNonce)
+	if err != nil {
+		log.Warnf("failed to list sent nonces of '%v': %v", sender.String(), err.Error())
+		return
+	}
+	for _, op := range sent {
+		status, err := hc.UserOpStatus(ctx, op.OpHash)
+		if err != nil {
+			log.Warnf("failed to check sent op '%v': %v", op.OpHash, err.Error())
+			continue
+		}
+		if status.Status != OpStatusUnknown {
+			continue
+		}
+		log.Infof("sent op '%v' is unknown to the bundler, freeing nonce %v of '%v'", op.OpHash, op.Nonce.String(), sender.String())
+		if err = hc.Nonces.Dropped(sender, op.Nonce, op.OpHash); err != nil {
+			log.Warnf("failed to release nonce of dropped op '%v': %v", op.OpHash, err.Error())
+		}
+	}
+}
+
+// releaseNonce frees a nonce whose op won't be sent.
+func (hc *HandlerContext) releaseNonce(sender ethgo.Address, nonce *big.Int) {
+	if hc.Nonces == nil {
+		return
+	}
+	if err := hc.Nonces.Release(sender, nonce); err != nil {
+		log.Warnf("failed to release nonce %v of '%v': %v", nonce.String(), sender.String(), err.Error())
+	}
+}
+
+// getPaymasterInfo sponsors the op, in gasToken when set; the op is then rewritten to
+// approve the paymaster and the quote is returned alongside.
+func (hc *HandlerContext) getPaymasterInfo(ctx context.Context, userOp *userop.UserOperation, owner ethgo.Address, gasToken *ethgo.Address) (*userop.UserOperation, *paymaster.Quote, error) {
+	return hc.sponsorOp(ctx, userOp, nil, owner, gasToken)
+}
+
+// sponsorOp sponsors userOp, in place of the already sponsored replaced op if set.
+func (hc *HandlerContext) sponsorOp(ctx context.Context, userOp, replaced *userop.UserOperation, owner ethgo.Address, gasToken *ethgo.Address) (newOp *userop.UserOperation, quote *paymaster.Quote, err error) {
 	// paymaster API requires signature - can be fake tho ...
 	//k, _ := crypto.SKFromInt(big.NewInt(0))
+	defer func() {
+		hc.observeSponsor(gasToken != nil, err)
+	}()
+
+	if hc.SponsorPolicy != nil {
+		var reservation *policy.Reservation
+		if replaced != nil {
+			reservation, err = hc.SponsorPolicy.ReserveReplacement(userOp, replaced, owner)
+		} else {
+			reservation, err = hc.SponsorPolicy.Reserve(userOp, owner)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if err != nil {
+				_ = reservation.Release()
+			}
+		}()
+	}
+
+	if gasToken != nil {
+		return hc.sponsorInToken(ctx, userOp, *gasToken)
+	}
+
+	if hc.Paymaster != nil {
+		// with the cross-check on, signing calls the paymaster contract
+		err = hc.chainCall(ctx, func() (err error) {
+			newOp, err = hc.Paymaster.Sponsor(userOp, nil)
+			return
+		})
+		return
+	}
 
 	prevSignature := userOp.Signature
-	if newOp, err = UserOpSeal(userOp, hc.ChainId, hc.EcdsaKey); err != nil {
-		return nil, err
+	if newOp, err = UserOpSeal(userOp, hc.ChainId, hc.Signer); err != nil {
+		return nil, nil, err
 	} else {
 		var pmResp map[string]any
 		opMap, _ := newOp.ToMap()
-		if err = hc.suPMRpc.Call(&pmResp, "pm_sponsorUserOperation", opMap, DefaultEntryPoint.String(), map[string]string{"type": "payg"}); err != nil {
-			return nil, err
+		if err = hc.paymasterCall(ctx, &pmResp, "pm_sponsorUserOperation", opMap, DefaultEntryPoint.String(), map[string]string{"type": "payg"}); err != nil {
+			return nil, nil, err
 		}
 		for k, v := range pmResp {
 			opMap[k] = v
@@ -210,30 +585,117 @@ func (hc *HandlerContext) getPaymasterInfo(userOp *userop.UserOperation) (newOp
 	return
 }
 
-func (hc *HandlerContext) sendUserOp(userOp *userop.UserOperation) (reply string, err error) {
+func (hc *HandlerContext) sponsorInToken(ctx context.Context, userOp *userop.UserOperation, token ethgo.Address) (newOp *userop.UserOperation, quote *paymaster.Quote, err error) {
+	if hc.TokenQuoter == nil {
+		return nil, nil, errTokenGasDisabled
+	}
+	// the approve needs gas as well, so the op is quoted with it in place
+	if newOp, err = UserOpApproveGasToken(userOp, token, hc.Paymaster.Paymaster, big.NewInt(0)); err != nil {
+		return
+	}
+	if quote, err = hc.TokenQuoter.Quote(newOp, token); err != nil {
+		return
+	}
+	if newOp, err = UserOpApproveGasToken(userOp, token, hc.Paymaster.Paymaster, quote.MaxTokenCost.ToInt()); err != nil {
+		return
+	}
+	err = hc.chainCall(ctx, func() (err error) {
+		newOp, err = hc.TokenQuoter.Sponsor(newOp, quote, DefaultEntryPoint)
+		return
+	})
+	return
+}
+
+var errTokenGasDisabled = errors.New("gas payment in tokens is not enabled")
+
+// handleOptionalGasToken parses the gasToken query param; ok is false if it's invalid.
+func handleOptionalGasToken(q url.Values) (token *ethgo.Address, ok bool) {
+	if len(q.Get("gasToken")) == 0 {
+		return nil, true
+	}
+	token = handleRequiredAddress(q.Get("gasToken"))
+	return token, token != nil
+}
+
+// respondOp sends the op, along with its token quote when paying for gas in a token.
+func respondOp(c *gin.Context, op *userop.UserOperation, quote *paymaster.Quote) {
+	opJson, _ := op.ToMap()
+	if quote == nil {
+		c.JSON(http.StatusOK, opJson)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]any{"op": opJson, "quote": quote})
+}
+
+// policy and session key rejections are the caller's problem, anything else is ours
+func abortWithSponsorError(c *gin.Context, err error) {
+	var rejection *policy.Rejection
+	if errors.As(err, &rejection) {
+		_ = c.Error(err)
+		c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{
+			"error":  "sponsorship rejected",
+			"rule":   rejection.Rule,
+			"reason": rejection.Reason,
+		})
+		return
+	}
+	var sessionRejection *session.Rejection
+	if errors.As(err, &sessionRejection) {
+		_ = c.Error(err)
+		c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{
+			"error":  "session key rejected",
+			"reason": sessionRejection.Reason,
+		})
+		return
+	}
+	if errors.Is(err, errTokenGasDisabled) {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+}
+
+func (hc *HandlerContext) sendUserOp(ctx context.Context, userOp *userop.UserOperation) (reply string, err error) {
 	opMap, _ := userOp.ToMap()
-	if hc.simulateUserOp {
-		if sim, err := execution.SimulateHandleOp(hc.suNodeRpc, common.Address(DefaultEntryPoint), userOp, common.BigToAddress(big.NewInt(0)), nil); err != nil {
-			log.Infof("userop failed simulation: %v", err.Error())
-		} else {
-			_ = sim
+	sender := ethgo.Address(userOp.Sender)
+	if hc.validateOps {
+		if err = hc.validateUserOp(ctx, userOp); err != nil {
+			log.Infof("userop failed validation: %v", err.Error())
+			var rejection *ValidationRejection
+			if errors.As(err, &rejection) {
+				opsFailed.WithLabelValues(failValidationFailed).Inc()
+			} else {
+				opsFailed.WithLabelValues(failValidationError).Inc()
+			}
+			hc.releaseNonce(sender, userOp.Nonce)
+			return
 		}
 	}
 
 	reply = userOp.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId).String()
-	if hc.sendUserOpDirect {
-		err = chain.TxnDoWait(hc.EntryPoint.Txn("handleOps", []map[string]any{opMap}, hc.ChainKeyAddr))
+	if hc.Bundler != nil {
+		reply, err = hc.Bundler.Add(userOp)
 	} else {
-		err = hc.suNodeRpc.Call(&reply, "eth_sendUserOperation", opMap, DefaultEntryPoint.String())
+		err = hc.bundlerCall(ctx, &reply, "eth_sendUserOperation", opMap, DefaultEntryPoint.String())
 	}
-	if err == nil {
-		opJson, _ := userOp.MarshalJSON()
-		log.Infof("submitted user op hash '%v', '%v'", reply, string(opJson))
+	if err != nil {
+		opsFailed.WithLabelValues(failSendError).Inc()
+		hc.releaseNonce(sender, userOp.Nonce)
+		return
+	}
+	opsSubmitted.WithLabelValues(hc.bundlerLabel()).Inc()
+	opJson, _ := userOp.MarshalJSON()
+	log.Infof("submitted user op hash '%v', '%v'", reply, string(opJson))
+	if hc.Nonces != nil {
+		if nonceErr := hc.Nonces.Sent(sender, userOp.Nonce, reply); nonceErr != nil {
+			log.Warnf("failed to record nonce %v of '%v' as sent: %v", userOp.Nonce.String(), sender.String(), nonceErr.Error())
+		}
 	}
 	return
 }
 
 func (hc *HandlerContext) HandleGetSenderInfo(c *gin.Context) {
+	ctx := c.Request.Context()
 	q := c.Request.URL.Query()
 	ownerAddr := handleRequiredAddress(q.Get("owner"))
 	if ownerAddr == nil {
@@ -242,7 +704,7 @@ func (hc *HandlerContext) HandleGetSenderInfo(c *gin.Context) {
 	}
 
 	salt := handleRequiredSalt(q.Get("salt"))
-	if nonce, senderAddr, err := hc.getOwnerInfo(*ownerAddr, salt); err != nil {
+	if nonce, senderAddr, err := hc.getOwnerInfo(ctx, *ownerAddr, salt); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 	} else {
 		if false {
@@ -266,9 +728,7 @@ func (hc *HandlerContext) HandleGetSenderAddress(c *gin.Context) {
 	salt := handleRequiredSalt(q.Get("salt"))
 	initCode, err := MakeInitCode(DefaultAccountFactory, *ownerAddr, salt)
 
-	_, err = hc.EntryPoint.Call("getSenderAddress", ethgo.Latest, initCode)
-	// this method is expected to revert
-	senderAddr, err := getSenderAddressFromError(err)
+	senderAddr, err := hc.getSenderAddress(c.Request.Context(), initCode)
 
 	log.Infof("senderAddr:", senderAddr.String())
 	log.Infof("ownerAddr:", hc.ChainKeyAddr.String())
@@ -285,6 +745,8 @@ func (hc *HandlerContext) HandleGetSenderAddress(c *gin.Context) {
 
 func (hc *HandlerContext) HandleUserOpApprove(c *gin.Context) {
 
+	ctx := c.Request.Context()
+
 	q := c.Request.URL.Query()
 
 	targetAddr := handleRequiredAddress(q.Get("target"))
@@ -299,7 +761,7 @@ func (hc *HandlerContext) HandleUserOpApprove(c *gin.Context) {
 		return
 	}
 
-	nonce, senderAddr, err := hc.getOwnerInfo(*ownerAddr, salt)
+	nonce, senderAddr, _, err := hc.getBuildInfo(ctx, *ownerAddr, salt)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -310,12 +772,15 @@ func (hc *HandlerContext) HandleUserOpApprove(c *gin.Context) {
 		return
 	} else {
 		opJson, _ := op.ToMap()
+		opsBuilt.WithLabelValues("approve").Inc()
 		c.JSON(http.StatusOK, opJson)
 	}
 }
 
 func (hc *HandlerContext) HandleUserOpWithdrawTo(c *gin.Context) {
 
+	ctx := c.Request.Context()
+
 	q := c.Request.URL.Query()
 
 	targetAddr := handleRequiredAddress(q.Get("target"))
@@ -323,20 +788,16 @@ func (hc *HandlerContext) HandleUserOpWithdrawTo(c *gin.Context) {
 	ownerAddr := handleRequiredAddress(q.Get("owner"))
 	salt := handleRequiredSalt(q.Get("salt"))
 
+	gasToken, gasTokenOk := handleOptionalGasToken(q)
+
 	amount, ok := new(big.Int).SetString(q.Get("amount"), 10)
 
-	if targetAddr == nil || toAddr == nil || ownerAddr == nil || !ok {
+	if targetAddr == nil || toAddr == nil || ownerAddr == nil || !ok || !gasTokenOk {
 		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
 		return
 	}
 
-	nonce, senderAddr, err := hc.getOwnerInfo(*ownerAddr, salt)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-
-	gasPrice, err := hc.getGasPrice()
+	nonce, senderAddr, gasPrice, err := hc.getBuildInfo(ctx, *ownerAddr, salt)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -346,19 +807,29 @@ func (hc *HandlerContext) HandleUserOpWithdrawTo(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	} else {
-		if op, err = hc.getPaymasterInfo(op); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		var quote *paymaster.Quote
+		if op, quote, err = hc.getPaymasterInfo(ctx, op, *ownerAddr, gasToken); err != nil {
+			hc.releaseNonce(senderAddr, nonce)
+			abortWithSponsorError(c, err)
 			return
 		}
-		opJson, _ := op.ToMap()
-		c.JSON(http.StatusOK, opJson)
+		opsBuilt.WithLabelValues("withdrawto").Inc()
+		respondOp(c, op, quote)
 	}
 }
 
 // TODO: copy pasta from withdraw ...
 
+// HandleUserOpTransfer builds a sponsored token transfer op and responds with it, for
+// the owner to sign and send with userop/send, like the other build routes. It used to
+// also send the op itself after responding; that op carried no owner signature, so the
+// send could never pass validation, and clients that relied on it must now sign and
+// send the op they get back.
+// GET erc4337/userop/transfer?owner=XXXX&salt=N&target=YYYY&to=ZZZZ&amount=N
 func (hc *HandlerContext) HandleUserOpTransfer(c *gin.Context) {
 
+	ctx := c.Request.Context()
+
 	q := c.Request.URL.Query()
 
 	targetAddr := handleRequiredAddress(q.Get("target"))
@@ -367,53 +838,103 @@ func (hc *HandlerContext) HandleUserOpTransfer(c *gin.Context) {
 	salt := handleRequiredSalt(q.Get("salt"))
 	//ownerAddr = &hc.ChainKeyAddr
 
+	gasToken, gasTokenOk := handleOptionalGasToken(q)
+
 	amount, ok := new(big.Int).SetString(q.Get("amount"), 10)
 
-	if targetAddr == nil || toAddr == nil || ownerAddr == nil || !ok {
+	if targetAddr == nil || toAddr == nil || ownerAddr == nil || !ok || !gasTokenOk {
 		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
 		return
 	}
 
-	nonce, senderAddr, err := hc.getOwnerInfo(*ownerAddr, salt)
+	nonce, senderAddr, gasPrice, err := hc.getBuildInfo(ctx, *ownerAddr, salt)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
 	log.Infof("senderAddr:", senderAddr.String())
-	gasPrice, err := hc.getGasPrice()
+
+	if op, err := UserOpTransfer(nonce, *ownerAddr, senderAddr, *targetAddr, *toAddr, salt, amount, gasPrice); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	} else {
+		var quote *paymaster.Quote
+		if op, quote, err = hc.getPaymasterInfo(ctx, op, *ownerAddr, gasToken); err != nil {
+			hc.releaseNonce(senderAddr, nonce)
+			abortWithSponsorError(c, err)
+			return
+		}
+		// the owner signs and sends it with userop/send
+		opsBuilt.WithLabelValues("transfer").Inc()
+		respondOp(c, op, quote)
+	}
+}
+
+var errCallsDisabled = errors.New("arbitrary calls need a sponsorship policy")
+
+// HandleUserOpCall builds an op making an arbitrary call from the owner's account. It
+// needs a sponsorship policy, which limits the targets and spend.
+func (hc *HandlerContext) HandleUserOpCall(c *gin.Context) {
+	ctx := c.Request.Context()
+	if hc.SponsorPolicy == nil {
+		c.AbortWithError(http.StatusNotFound, errCallsDisabled)
+		return
+	}
+	q := c.Request.URL.Query()
+
+	targetAddr := handleRequiredAddress(q.Get("target"))
+	ownerAddr := handleRequiredAddress(q.Get("owner"))
+	salt := handleRequiredSalt(q.Get("salt"))
+	gasToken, gasTokenOk := handleOptionalGasToken(q)
+
+	value, ok := big.NewInt(0), true
+	if len(q.Get("value")) != 0 {
+		value, ok = new(big.Int).SetString(q.Get("value"), 10)
+	}
+	callGasLimit, callGasOk := DefaultCallGasLimit, true
+	if len(q.Get("callGas")) != 0 {
+		callGasLimit, callGasOk = new(big.Int).SetString(q.Get("callGas"), 10)
+		callGasOk = callGasOk && callGasLimit.Sign() > 0 && callGasLimit.Cmp(MaxCallGasLimit) <= 0
+	}
+	data, err := hexutil.Decode(q.Get("data"))
+
+	if targetAddr == nil || ownerAddr == nil || !ok || !callGasOk || !gasTokenOk || err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+
+	nonce, senderAddr, gasPrice, err := hc.getBuildInfo(ctx, *ownerAddr, salt)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	if op, err := UserOpTransfer(nonce, *ownerAddr, senderAddr, *targetAddr, *toAddr, salt, amount, gasPrice); err != nil {
+	if op, err := UserOpCall(nonce, *ownerAddr, senderAddr, *targetAddr, salt, value, data, callGasLimit, gasPrice); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	} else {
-		if op, err = hc.getPaymasterInfo(op); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		var quote *paymaster.Quote
+		if op, quote, err = hc.getPaymasterInfo(ctx, op, *ownerAddr, gasToken); err != nil {
+			hc.releaseNonce(senderAddr, nonce)
+			abortWithSponsorError(c, err)
 			return
 		}
-		opJson, _ := op.ToMap()
-		c.JSON(http.StatusOK, opJson)
-		if reply, err := hc.sendUserOp(op); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		} else {
-			c.JSON(http.StatusOK, fmt.Sprintf(`{"op hash":"%v"}`, reply))
-			return
-		}
-		//c.JSON(http.StatusOK, opJson)
+		opsBuilt.WithLabelValues("call").Inc()
+		respondOp(c, op, quote)
 	}
 }
 
 type userOpSendRequest struct {
 	EntryPointAddr string         `json:"entryPoint"`
 	Op             map[string]any `json:"op"`
+	// needed for contract owners, whose address can't be recovered from the signature
+	Owner string `json:"owner,omitempty"`
+	Salt  string `json:"salt,omitempty"`
 }
 
 func (hc *HandlerContext) HandleUserOpSend(c *gin.Context) {
+	ctx := c.Request.Context()
 	req := userOpSendRequest{}
 	if err := c.BindJSON(&req); err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
@@ -424,13 +945,60 @@ func (hc *HandlerContext) HandleUserOpSend(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	} else {
-		opHash, ownerAddr, err := UserOpEcrecover(userOp, hc.ChainId)
-		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("ecrecover failure: %v", err.Error()))
+		// ops signed by a session key are checked against its scope instead of the owner
+		if s, err := hc.sessionOwner(ctx, userOp); err != nil {
+			abortWithSponsorError(c, err)
 			return
+		} else if s != nil {
+			log.Infof("op '%v' signed by session key '%v' of '%v'", userOp.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId).String(),
+				s.Key.String(), s.Account.String())
+			if reply, err := hc.sendUserOp(ctx, userOp); err != nil {
+				if err := hc.Sessions.Refund(s.Account, s.Key, userOp); err != nil {
+					log.Warnf("failed to refund session key '%v': %v", s.Key.String(), err.Error())
+				}
+				abortWithSendError(c, err)
+			} else {
+				if err = hc.recordSentOp(userOp, s.Owner); err != nil {
+					log.Warnf("failed to record sent op '%v': %v", reply, err.Error())
+				}
+				c.JSON(http.StatusOK, fmt.Sprintf(`{"op hash":"%v"}`, reply))
+			}
+			return
+		}
+
+		var claimedOwner *ethgo.Address
+		if len(req.Owner) != 0 {
+			if claimedOwner = handleRequiredAddress(req.Owner); claimedOwner == nil {
+				c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid owner address"))
+				return
+			}
+		} else if authAddr, ok := auth.AuthenticatedAddress(c); ok {
+			claimedOwner = &authAddr
+		}
+		salt := big.NewInt(0)
+		if len(req.Salt) != 0 {
+			if salt = handleRequiredSalt(req.Salt); salt == nil {
+				c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid salt"))
+				return
+			}
 		}
 
-		_, senderAddr, err := hc.getOwnerInfo(ownerAddr, big.NewInt(0))
+		opHash, ownerAddr, how, err := hc.VerifyOpSignature(ctx, userOp, claimedOwner)
+		if errors.Is(err, errInvalidOpSignature) {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if authAddr, ok := auth.AuthenticatedAddress(c); ok && authAddr != ownerAddr {
+			c.AbortWithError(http.StatusForbidden, fmt.Errorf("op owner '%v' does not match authenticated address '%v'",
+				ownerAddr.String(), authAddr.String()))
+			return
+		}
+		log.Infof("op '%v' signed by owner '%v' (%v)", opHash.String(), ownerAddr.String(), how)
+
+		_, senderAddr, err := hc.getOwnerInfo(ctx, ownerAddr, salt)
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
@@ -440,12 +1008,56 @@ func (hc *HandlerContext) HandleUserOpSend(c *gin.Context) {
 				ownerAddr.String(), senderAddr.String(), userOp.Sender.String(), opHash.String()))
 			return
 		}
-		if reply, err := hc.sendUserOp(userOp); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		if reply, err := hc.sendUserOp(ctx, userOp); err != nil {
+			abortWithSendError(c, err)
 			return
 		} else {
+			if err = hc.recordSentOp(userOp, ownerAddr); err != nil {
+				log.Warnf("failed to record sent op '%v': %v", reply, err.Error())
+			}
 			c.JSON(http.StatusOK, fmt.Sprintf(`{"op hash":"%v"}`, reply))
 			return
 		}
 	}
 }
+
+func (hc *HandlerContext) HandleUserOpStatus(c *gin.Context) {
+	ctx := c.Request.Context()
+	opHash := c.Request.URL.Query().Get("hash")
+	if len(opHash) == 0 {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+	status, err := hc.UserOpStatus(ctx, opHash)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if status.Status == OpStatusUnknown {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("op '%v' not found", opHash))
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (hc *HandlerContext) HandleGetSettlement(c *gin.Context) {
+	if hc.TokenQuoter == nil {
+		c.AbortWithError(http.StatusNotFound, errTokenGasDisabled)
+		return
+	}
+	opHash := c.Request.URL.Query().Get("hash")
+	if len(opHash) == 0 {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+	settlement, found, err := hc.TokenQuoter.Settlements().Get(opHash)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("no token settlement for op '%v'", opHash))
+		return
+	}
+	c.JSON(http.StatusOK, settlement)
+}
@@ -3,6 +3,7 @@ package erc4337
 import (
 	"fmt"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/umbracle/ethgo"
 	"github.com/umbracle/ethgo/abi"
 	"github.com/umbracle/ethgo/jsonrpc/codec"
@@ -33,12 +34,20 @@ func MakeInitCode(factory, owner ethgo.Address, salt *big.Int) (ret []byte, err
 
 var senderAddressErrorPrefix = "0x6ca7b806"
 
+// getSenderAddressFromError takes the address from getSenderAddress's revert, from
+// either ethgo's or go-ethereum's client.
 func getSenderAddressFromError(errIn error) (addr ethgo.Address, err error) {
-	if eo, ok := errIn.(*codec.ErrorObject); !ok {
-		err = fmt.Errorf("unexpected - error is not *codec.ErrorObject")
+	var data interface{}
+	if eo, ok := errIn.(*codec.ErrorObject); ok {
+		data = eo.Data
+	} else if de, ok := errIn.(rpc.DataError); ok {
+		data = de.ErrorData()
 	} else {
-		if eod, ok := eo.Data.(string); !ok {
-			err = fmt.Errorf("unexpected - codec.ErrorObject Data element is not a string")
+		err = fmt.Errorf("unexpected - error is not a JSON-RPC error with data: %v", errIn)
+	}
+	if err == nil {
+		if eod, ok := data.(string); !ok {
+			err = fmt.Errorf("unexpected - error data is not a string")
 		} else {
 			if !strings.HasPrefix(eod, senderAddressErrorPrefix) {
 				err = fmt.Errorf("unexpected - error data format has invalid 4byte prefix")
@@ -46,8 +55,9 @@ func getSenderAddressFromError(errIn error) (addr ethgo.Address, err error) {
 				var eodBytes []byte
 				if eodBytes, err = hexutil.Decode(eod); err != nil || len(eodBytes) != 36 {
 					err = fmt.Errorf("unexpected - bad address data a/o invalid length")
+				} else {
+					addr = ethgo.BytesToAddress(eodBytes[16:])
 				}
-				addr = ethgo.BytesToAddress(eodBytes[16:])
 			}
 		}
 	}
@@ -0,0 +1,78 @@
+package erc4337
+
+import (
+	"errors"
+	"github.com/oneness/erc-4337-api/policy"
+	"github.com/oneness/erc-4337-api/session"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math/big"
+)
+
+// why an op failed, for erc4337_ops_failed_total; the in-process bundler's are
+// "bundle_" and the op's status, dropped or failed
+const (
+	failSponsorRejected  = "sponsor_rejected"
+	failSponsorError     = "sponsor_error"
+	failValidationFailed = "validation_rejected"
+	failValidationError  = "validation_error"
+	failSendError        = "send_error"
+	failBundlePrefix     = "bundle_"
+)
+
+var (
+	opsBuilt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_ops_built_total",
+		Help: "Ops built for owners to sign, by kind.",
+	}, []string{"kind"})
+	opsSponsored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_ops_sponsored_total",
+		Help: "Ops sponsored, by paymaster: local, token or service.",
+	}, []string{"paymaster"})
+	opsSubmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_ops_submitted_total",
+		Help: "Ops sent to the bundler, by bundler: local or service.",
+	}, []string{"bundler"})
+	opsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_ops_failed_total",
+		Help: "Ops that failed to be sponsored or sent, or that the in-process bundler dropped, by reason.",
+	}, []string{"reason"})
+	gasPriceGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "erc4337_gas_price_wei",
+		Help: "The chain's gas price, as last read.",
+	})
+)
+
+func observeGasPrice(price *big.Int) {
+	f, _ := new(big.Float).SetInt(price).Float64()
+	gasPriceGauge.Set(f)
+}
+
+// observeSponsor counts the outcome of sponsoring an op.
+func (hc *HandlerContext) observeSponsor(gasToken bool, err error) {
+	if err != nil {
+		var rejection *policy.Rejection
+		var sessionRejection *session.Rejection
+		if errors.As(err, &rejection) || errors.As(err, &sessionRejection) || errors.Is(err, errTokenGasDisabled) {
+			opsFailed.WithLabelValues(failSponsorRejected).Inc()
+		} else {
+			opsFailed.WithLabelValues(failSponsorError).Inc()
+		}
+		return
+	}
+	switch {
+	case gasToken:
+		opsSponsored.WithLabelValues("token").Inc()
+	case hc.Paymaster != nil:
+		opsSponsored.WithLabelValues("local").Inc()
+	default:
+		opsSponsored.WithLabelValues("service").Inc()
+	}
+}
+
+func (hc *HandlerContext) bundlerLabel() string {
+	if hc.Bundler != nil {
+		return "local"
+	}
+	return "service"
+}
@@ -0,0 +1,128 @@
+package erc4337
+
+import (
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/auth"
+	"github.com/oneness/erc-4337-api/replace"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const sentOpPrefix = "sentop/"
+
+// sent ops are kept long enough to be replaced while they're stuck
+var sentOpTTL = 24 * time.Hour
+
+type sentOp struct {
+	Op     map[string]any `json:"op"`
+	Owner  ethgo.Address  `json:"owner"`
+	SentAt time.Time      `json:"sentAt"`
+}
+
+// recordSentOp keeps the op, so it can be sped up or cancelled later.
+func (hc *HandlerContext) recordSentOp(op *userop.UserOperation, owner ethgo.Address) error {
+	if hc.store == nil {
+		return nil
+	}
+	opMap, err := op.ToMap()
+	if err != nil {
+		return err
+	}
+	opHash := op.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId).String()
+	return hc.store.PutWithTTL(sentOpPrefix+opHash, sentOp{Op: opMap, Owner: owner, SentAt: time.Now().UTC()}, sentOpTTL)
+}
+
+func (hc *HandlerContext) getSentOp(opHash string) (op *userop.UserOperation, owner ethgo.Address, found bool, err error) {
+	if hc.store == nil {
+		return
+	}
+	sent := sentOp{}
+	if found, err = hc.store.Get(sentOpPrefix+opHash, &sent); err != nil || !found {
+		return
+	}
+	op, err = userop.New(sent.Op)
+	return op, sent.Owner, found, err
+}
+
+// HandleUserOpSpeedup rebuilds a stuck op with higher fees and sponsors it again, for
+// the owner to sign and send.
+// POST erc4337/userop/:hash/speedup
+func (hc *HandlerContext) HandleUserOpSpeedup(c *gin.Context) {
+	hc.handleUserOpReplace(c, "speedup", replace.Speedup)
+}
+
+// HandleUserOpCancel builds a sponsored no-op replacing a stuck op, for the owner to
+// sign and send.
+// POST erc4337/userop/:hash/cancel
+func (hc *HandlerContext) HandleUserOpCancel(c *gin.Context) {
+	hc.handleUserOpReplace(c, "cancel", replace.Cancel)
+}
+
+func (hc *HandlerContext) handleUserOpReplace(c *gin.Context, kind string, build func(*userop.UserOperation, *big.Int, int64) (*userop.UserOperation, error)) {
+	ctx := c.Request.Context()
+	opHash := c.Param("hash")
+	op, owner, found, err := hc.getSentOp(opHash)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("op '%v' was not sent through this server, or has expired", opHash))
+		return
+	}
+	if authAddr, ok := auth.AuthenticatedAddress(c); ok && authAddr != owner {
+		c.AbortWithError(http.StatusForbidden, fmt.Errorf("op owner '%v' does not match authenticated address '%v'",
+			owner.String(), authAddr.String()))
+		return
+	}
+
+	status, err := hc.UserOpStatus(ctx, opHash)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if status.Status == OpStatusIncluded {
+		c.AbortWithError(http.StatusConflict, fmt.Errorf("op '%v' is already included", opHash))
+		return
+	}
+	if status.Status == OpStatusReplaced {
+		c.AbortWithError(http.StatusConflict, fmt.Errorf("op '%v' was already replaced, %v", opHash, status.Reason))
+		return
+	}
+	if hc.TokenQuoter != nil {
+		if _, paidInToken, err := hc.TokenQuoter.Settlements().Get(opHash); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		} else if paidInToken {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("op '%v' pays for gas in a token and can't be replaced, build a new op at nonce %v",
+				opHash, op.Nonce.String()))
+			return
+		}
+	}
+
+	gasPrice, err := hc.getGasPrice(ctx)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	newOp, err := build(op, gasPrice, hc.feeBumpPercent)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if len(op.PaymasterAndData) != 0 {
+		// the policy already booked the stuck op's cost
+		if newOp, _, err = hc.sponsorOp(ctx, newOp, op, owner, nil); err != nil {
+			abortWithSponsorError(c, err)
+			return
+		}
+	}
+	opsBuilt.WithLabelValues(kind).Inc()
+	// the owner signs and sends it with userop/send
+	respondOp(c, newOp, nil)
+}
@@ -0,0 +1,236 @@
+package erc4337
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/session"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"net/http"
+)
+
+var errSessionsDisabled = errors.New("session keys are not enabled")
+
+type sessionRegisterRequest struct {
+	Key ethgo.Address `json:"key"`
+	session.Scope
+}
+
+// HandleSessionRegister records a pending session key for the owner's account and
+// builds the sponsored op enabling it on chain, for the owner to sign and send. The key
+// is accepted once that op is included.
+// POST erc4337/session?owner=XXXX&salt=N
+func (hc *HandlerContext) HandleSessionRegister(c *gin.Context) {
+	ctx := c.Request.Context()
+	if hc.Sessions == nil {
+		c.AbortWithError(http.StatusNotFound, errSessionsDisabled)
+		return
+	}
+	q := c.Request.URL.Query()
+	ownerAddr := handleRequiredAddress(q.Get("owner"))
+	salt := handleRequiredSalt(q.Get("salt"))
+	req := sessionRegisterRequest{}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if ownerAddr == nil || salt == nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+
+	nonce, senderAddr, gasPrice, err := hc.getBuildInfo(ctx, *ownerAddr, salt)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	s, prev, err := hc.Sessions.Register(senderAddr, *ownerAddr, req.Key, req.Scope)
+	if err != nil {
+		hc.releaseNonce(senderAddr, nonce)
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	// without an op to enable it, the key goes back to how it was
+	undo := func() {
+		hc.releaseNonce(senderAddr, nonce)
+		if err := hc.Sessions.Restore(s, prev); err != nil {
+			log.Warnf("failed to undo the registration of session key '%v': %v", s.Key.String(), err.Error())
+		}
+	}
+	data, err := hc.Sessions.EnableData(s)
+	if err != nil {
+		undo()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	op, err := UserOpCall(nonce, *ownerAddr, senderAddr, hc.Sessions.Plugin(), salt, big.NewInt(0), data, DefaultCallGasLimit, gasPrice)
+	if err != nil {
+		undo()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if op, _, err = hc.getPaymasterInfo(ctx, op, *ownerAddr, nil); err != nil {
+		undo()
+		abortWithSponsorError(c, err)
+		return
+	}
+	// the hash leaves out the signature, so it's final once the op is sponsored
+	opHash := op.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId).String()
+	if s, err = hc.Sessions.SetEnableOp(senderAddr, req.Key, opHash); err != nil {
+		undo()
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	log.Infof("registered session key '%v' for '%v' until %v", s.Key.String(), s.Account.String(), s.Scope.ValidUntil.String())
+
+	opsBuilt.WithLabelValues("session").Inc()
+	opJson, _ := op.ToMap()
+	c.JSON(http.StatusOK, map[string]any{"session": s, "op": opJson})
+}
+
+// HandleSessionList returns the sessions of the owner's account.
+// GET erc4337/session?owner=XXXX&salt=N
+func (hc *HandlerContext) HandleSessionList(c *gin.Context) {
+	ctx := c.Request.Context()
+	if hc.Sessions == nil {
+		c.AbortWithError(http.StatusNotFound, errSessionsDisabled)
+		return
+	}
+	q := c.Request.URL.Query()
+	ownerAddr := handleRequiredAddress(q.Get("owner"))
+	salt := handleRequiredSalt(q.Get("salt"))
+	if ownerAddr == nil || salt == nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+	_, senderAddr, err := hc.getOwnerInfo(ctx, *ownerAddr, salt)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	sessions, err := hc.Sessions.List(senderAddr)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]any{"account": senderAddr, "sessions": sessions})
+}
+
+// HandleSessionRevoke stops the server sponsoring or sending ops signed by a session
+// key; the owner still has to disable the key on chain.
+// POST erc4337/session/revoke?owner=XXXX&salt=N&key=YYYY
+func (hc *HandlerContext) HandleSessionRevoke(c *gin.Context) {
+	ctx := c.Request.Context()
+	if hc.Sessions == nil {
+		c.AbortWithError(http.StatusNotFound, errSessionsDisabled)
+		return
+	}
+	q := c.Request.URL.Query()
+	ownerAddr := handleRequiredAddress(q.Get("owner"))
+	keyAddr := handleRequiredAddress(q.Get("key"))
+	salt := handleRequiredSalt(q.Get("salt"))
+	if ownerAddr == nil || keyAddr == nil || salt == nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing parameter(s)"))
+		return
+	}
+	_, senderAddr, err := hc.getOwnerInfo(ctx, *ownerAddr, salt)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = hc.Sessions.Revoke(senderAddr, *keyAddr); err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+type sessionSponsorRequest struct {
+	Op  map[string]any `json:"op"`
+	Key ethgo.Address  `json:"key"`
+}
+
+// HandleSessionSponsor sponsors an op for the session key to sign, if it's within the
+// key's scope.
+// POST erc4337/session/sponsor
+func (hc *HandlerContext) HandleSessionSponsor(c *gin.Context) {
+	ctx := c.Request.Context()
+	if hc.Sessions == nil {
+		c.AbortWithError(http.StatusNotFound, errSessionsDisabled)
+		return
+	}
+	req := sessionSponsorRequest{}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	op, err := userop.New(req.Op)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	s, found, err := hc.getSession(ctx, ethgo.Address(op.Sender), req.Key)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("no session key '%v' for '%v'", req.Key.String(), op.Sender.String()))
+		return
+	}
+	if err = hc.Sessions.Check(s, op); err != nil {
+		hc.observeSponsor(false, err)
+		abortWithSponsorError(c, err)
+		return
+	}
+	if op, _, err = hc.getPaymasterInfo(ctx, op, s.Owner, nil); err != nil {
+		abortWithSponsorError(c, err)
+		return
+	}
+	// the session key signs and sends it with userop/send
+	respondOp(c, op, nil)
+}
+
+// getSession returns the session of key on the account, activating it if it's pending
+// and its enabling op has been included.
+func (hc *HandlerContext) getSession(ctx context.Context, account, key ethgo.Address) (*session.Session, bool, error) {
+	s, found, err := hc.Sessions.Get(account, key)
+	if err != nil || !found || s.Status != session.StatusPending || len(s.EnableOpHash) == 0 {
+		return s, found, err
+	}
+	status, err := hc.UserOpStatus(ctx, s.EnableOpHash)
+	if err != nil {
+		return nil, false, err
+	}
+	if status.Status != OpStatusIncluded || status.Success == nil || !*status.Success {
+		return s, true, nil
+	}
+	if s, err = hc.Sessions.Activate(account, key, s.EnableOpHash); err != nil {
+		return nil, false, err
+	}
+	log.Infof("session key '%v' of '%v' enabled on chain", key.String(), account.String())
+	return s, true, nil
+}
+
+// sessionOwner returns the session whose key signed op, nil if the op isn't signed
+// by a registered session key. The op's spend is booked against the session, and
+// has to be refunded if the op isn't sent.
+func (hc *HandlerContext) sessionOwner(ctx context.Context, op *userop.UserOperation) (*session.Session, error) {
+	if hc.Sessions == nil || len(op.Signature) != 65 {
+		return nil, nil
+	}
+	_, key, err := UserOpEcrecover(op, hc.ChainId)
+	if err != nil {
+		return nil, nil
+	}
+	account := ethgo.Address(op.Sender)
+	if _, found, err := hc.getSession(ctx, account, key); err != nil || !found {
+		return nil, err
+	}
+	return hc.Sessions.Spend(account, key, op)
+}
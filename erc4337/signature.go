@@ -0,0 +1,140 @@
+package erc4337
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"github.com/umbracle/ethgo/jsonrpc/codec"
+	"strings"
+)
+
+var abiIsValidSignature, _ = abi.NewMethod("function isValidSignature(bytes32 hash, bytes signature) view returns (bytes4)")
+
+// EIP-1271's magic value, bytes4(keccak256("isValidSignature(bytes32,bytes)"))
+var eip1271MagicValue = [4]byte{0x16, 0x26, 0xba, 0x7e}
+
+var errInvalidOpSignature = errors.New("the op signature is neither the owner's ECDSA signature nor accepted by EIP-1271 isValidSignature")
+
+// how an op's signature was verified
+const (
+	SigECDSA   = "ecdsa"
+	SigEIP1271 = "eip1271"
+)
+
+// isValidSignature asks the contract at addr whether sig is its signature of hash;
+// a revert, or an address without code, counts as no. Other call failures, such as
+// the node being unreachable, are returned.
+func (hc *HandlerContext) isValidSignature(ctx context.Context, addr ethgo.Address, hash []byte, sig []byte) (bool, error) {
+	var hash32 [32]byte
+	copy(hash32[:], hash)
+	data, err := abiIsValidSignature.Encode([]interface{}{hash32, sig})
+	if err != nil {
+		return false, err
+	}
+	var out string
+	if err = hc.chainCall(ctx, func() (err error) {
+		out, err = hc.chainRpc.Eth().Call(&ethgo.CallMsg{To: &addr, Data: data}, ethgo.Latest)
+		return
+	}); err != nil {
+		if isCallFailure(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("isValidSignature on %v: %w", addr.String(), err)
+	}
+	outBytes, err := hexutil.Decode(out)
+	if err != nil || len(outBytes) == 0 {
+		return false, nil
+	}
+	res, err := abiIsValidSignature.Decode(outBytes)
+	if err != nil {
+		return false, nil
+	}
+	magic, ok := res["0"].([4]byte)
+	return ok && magic == eip1271MagicValue, nil
+}
+
+// isCallFailure tells whether the node ran the call and it failed in the EVM, as
+// opposed to the node failing to run it.
+func isCallFailure(err error) bool {
+	var cerr *codec.ErrorObject
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	if cerr.Code == 3 {
+		return true
+	}
+	msg := strings.ToLower(cerr.Message)
+	for _, failure := range []string{"revert", "invalid opcode", "out of gas", "invalid jump"} {
+		if strings.Contains(msg, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+type sigCandidate struct {
+	// the contract to ask, and the owner it stands for
+	contract ethgo.Address
+	owner    ethgo.Address
+	sig      []byte
+}
+
+// VerifyOpSignature returns the owner that signed op and how. An EOA owner's 65
+// byte signature is recovered. Otherwise the signature is checked with EIP-1271
+// isValidSignature, over both the op hash and its eth_sign hash, on
+//   - claimedOwner, a contract owner such as a Safe,
+//   - the contract in the first 20 bytes of the signature, with the rest as its
+//     signature, the encoding used for validator modules like passkeys,
+//   - the account itself, which then stands for claimedOwner.
+//
+// claimedOwner is nil when the caller doesn't know the owner. An error other than
+// errInvalidOpSignature means a check couldn't be made.
+func (hc *HandlerContext) VerifyOpSignature(ctx context.Context, op *userop.UserOperation, claimedOwner *ethgo.Address) (opHash common.Hash, owner ethgo.Address, how string, err error) {
+	opHash = op.GetUserOpHash(common.Address(DefaultEntryPoint), hc.ChainId)
+	sig := op.Signature
+
+	var ecdsaErr error
+	if len(sig) == 65 {
+		var recovered ethgo.Address
+		if _, recovered, ecdsaErr = UserOpEcrecover(op, hc.ChainId); ecdsaErr == nil && (claimedOwner == nil || recovered == *claimedOwner) {
+			return opHash, recovered, SigECDSA, nil
+		}
+	}
+
+	var candidates []sigCandidate
+	if claimedOwner != nil {
+		candidates = append(candidates, sigCandidate{contract: *claimedOwner, owner: *claimedOwner, sig: sig})
+	}
+	if len(sig) > 20 {
+		validator := ethgo.BytesToAddress(sig[:20])
+		if claimedOwner == nil || validator == *claimedOwner {
+			candidates = append(candidates, sigCandidate{contract: validator, owner: validator, sig: sig[20:]})
+		}
+	}
+	if claimedOwner != nil {
+		candidates = append(candidates, sigCandidate{contract: ethgo.Address(op.Sender), owner: *claimedOwner, sig: sig})
+	}
+
+	hashes := [][]byte{opHash.Bytes(), crypto.EthSignedMessageHash(opHash.Bytes())}
+	for _, c := range candidates {
+		for _, hash := range hashes {
+			valid, err := hc.isValidSignature(ctx, c.contract, hash, c.sig)
+			if err != nil {
+				return opHash, ethgo.ZeroAddress, "", err
+			}
+			if valid {
+				return opHash, c.owner, SigEIP1271, nil
+			}
+		}
+	}
+	if ecdsaErr != nil {
+		return opHash, ethgo.ZeroAddress, "", fmt.Errorf("%w: %v", errInvalidOpSignature, ecdsaErr.Error())
+	}
+	return opHash, ethgo.ZeroAddress, "", errInvalidOpSignature
+}
@@ -0,0 +1,156 @@
+package erc4337
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/upstream"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/jsonrpc"
+	"net/http"
+	"time"
+)
+
+func upstreamConfig(config config.Config, timeout time.Duration) upstream.Config {
+	return upstream.Config{
+		ProbeInterval: config.UpstreamProbeInterval,
+		Retries:       config.UpstreamRetries,
+		Backoff:       config.UpstreamBackoff,
+		Timeout:       timeout,
+	}
+}
+
+// how long a call to each upstream may take with its retries, no limit when 0
+type upstreamTimeouts struct {
+	chain     time.Duration
+	bundler   time.Duration
+	paymaster time.Duration
+}
+
+func makeUpstreamTimeouts(config config.Config) upstreamTimeouts {
+	return upstreamTimeouts{
+		chain:     upstreamConfig(config, config.ChainTimeout).CallTimeout(),
+		bundler:   upstreamConfig(config, config.BundlerTimeout).CallTimeout(),
+		paymaster: upstreamConfig(config, config.PaymasterTimeout).CallTimeout(),
+	}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// chainCall runs ethgo calls to the chain until ctx is done or the chain timeout passes.
+func (hc *HandlerContext) chainCall(ctx context.Context, call func() error) error {
+	ctx, cancel := withTimeout(ctx, hc.timeouts.chain)
+	defer cancel()
+	return chain.Await(ctx, call)
+}
+
+// chainBatch sends the chain reads in one JSON-RPC batch.
+func (hc *HandlerContext) chainBatch(ctx context.Context, reqs []rpc.BatchElem) error {
+	ctx, cancel := withTimeout(ctx, hc.timeouts.chain)
+	defer cancel()
+	return hc.reader.Batch(ctx, reqs)
+}
+
+// batchError returns the first error of the batched requests.
+func batchError(reqs []rpc.BatchElem) error {
+	for _, req := range reqs {
+		if req.Error != nil {
+			return req.Error
+		}
+	}
+	return nil
+}
+
+// chainAggregate makes the contract reads through Multicall3, when it's deployed.
+func (hc *HandlerContext) chainAggregate(ctx context.Context, calls []chain.Call) ([]chain.CallResult, error) {
+	ctx, cancel := withTimeout(ctx, hc.timeouts.chain)
+	defer cancel()
+	return hc.reader.Aggregate(ctx, calls)
+}
+
+func (hc *HandlerContext) bundlerCall(ctx context.Context, result any, method string, args ...any) error {
+	ctx, cancel := withTimeout(ctx, hc.timeouts.bundler)
+	defer cancel()
+	return hc.suNodeRpc.CallContext(ctx, result, method, args...)
+}
+
+func (hc *HandlerContext) paymasterCall(ctx context.Context, result any, method string, args ...any) error {
+	ctx, cancel := withTimeout(ctx, hc.timeouts.paymaster)
+	defer cancel()
+	return hc.suPMRpc.CallContext(ctx, result, method, args...)
+}
+
+// DialChain returns a client for the chain endpoints that fails over between them. A
+// single websocket or IPC endpoint is dialed directly, without a pool.
+func DialChain(config config.Config) (*jsonrpc.Client, *upstream.Pool, error) {
+	urls := config.ChainRpcUrls()
+	if len(urls) == 1 && !upstream.IsHTTP(urls[0]) {
+		ec, err := jsonrpc.NewClient(urls[0])
+		return ec, nil, err
+	}
+	pool, err := upstream.NewPool("chain", urls, upstreamConfig(config, config.ChainTimeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	// ethgo's client can't be given a transport, so it goes through a local relay
+	relayUrl, err := pool.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	ec, err := jsonrpc.NewClient(relayUrl)
+	return ec, pool, err
+}
+
+func dialRPC(name string, urls []string, config config.Config, timeout time.Duration) (*rpc.Client, *upstream.Pool, error) {
+	if len(urls) == 1 && !upstream.IsHTTP(urls[0]) {
+		client, err := rpc.Dial(urls[0])
+		return client, nil, err
+	}
+	pool, err := upstream.NewPool(name, urls, upstreamConfig(config, timeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := dialPool(pool)
+	return client, pool, err
+}
+
+func dialPool(pool *upstream.Pool) (*rpc.Client, error) {
+	return rpc.DialOptions(context.Background(), pool.URL(), rpc.WithHTTPClient(&http.Client{Transport: pool}))
+}
+
+// dialChainReader returns a reader of the chain through the pool DialChain returned,
+// which is nil when the chain endpoint is dialed directly.
+func dialChainReader(config config.Config, pool *upstream.Pool) (*chain.Reader, error) {
+	var client *rpc.Client
+	var err error
+	if pool != nil {
+		client, err = dialPool(pool)
+	} else {
+		client, err = rpc.Dial(config.ChainRpcUrls()[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	var multicall ethgo.Address
+	if len(config.MulticallAddress) != 0 {
+		addr := handleRequiredAddress(config.MulticallAddress)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid multicall address '%v'", config.MulticallAddress)
+		}
+		multicall = *addr
+	}
+	return chain.NewReader(client, multicall), nil
+}
+
+// ChainClient returns the client for the chain endpoints, whose calls stop with their
+// context.
+func (hc *HandlerContext) ChainClient() *rpc.Client {
+	return hc.reader.Client()
+}
@@ -1,6 +1,7 @@
 package erc4337
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -9,7 +10,6 @@ import (
 	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
 	"github.com/umbracle/ethgo"
 	"github.com/umbracle/ethgo/abi"
-	"github.com/umbracle/ethgo/wallet"
 	"math/big"
 )
 
@@ -18,6 +18,7 @@ var DefaultEntryPoint = ethgo.HexToAddress("0x5ff137d4b0fdcd49dca30c7cf57e578a02
 var DefaultChainId = big.NewInt(137) // Polygon mainnet for now...
 
 var abiExec, _ = abi.NewMethod("function execute(address to, uint256 value, bytes data)")
+var abiExecBatch, _ = abi.NewMethod("function executeBatch(address[] dest, bytes[] func)")
 
 func makeExecute(toAddr ethgo.Address, value *big.Int, m *abi.Method, args ...interface{}) (enc []byte, err error) {
 	if enc, err = m.Encode(args); err == nil {
@@ -36,6 +37,10 @@ var DefaultMintGasLimit = big.NewInt(200_000)
 var DefaultTransferGasLimit = big.NewInt(200_000) // TODO: too high?
 var DefaultApproveGasLimit = big.NewInt(200_000)
 var DefaultWithdrawToGasLimit = big.NewInt(200_000)
+var DefaultCallGasLimit = big.NewInt(200_000)
+
+// MaxCallGasLimit is the most call gas an op built for a caller may ask for
+var MaxCallGasLimit = big.NewInt(5_000_000)
 
 func makeBaseOp(nonce *big.Int, owner, sender ethgo.Address, salt, callGasLimit, maxFeePerGas *big.Int, callData []byte) (op *userop.UserOperation, err error) {
 	var initCode []byte
@@ -96,13 +101,57 @@ func UserOpWithdrawTo(nonce *big.Int, owner, sender, targetAddr, toAddr ethgo.Ad
 	}
 }
 
-func UserOpSeal(op *userop.UserOperation, chainId *big.Int, k *chain.EcdsaKey) (*userop.UserOperation, error) {
+// UserOpCall makes an op calling target with arbitrary data from the sender.
+func UserOpCall(nonce *big.Int, owner, sender, target ethgo.Address, salt, value *big.Int, data []byte, callGasLimit, gas *big.Int) (*userop.UserOperation, error) {
+	if callData, err := abiExec.Encode([]interface{}{target, value, data}); err != nil {
+		return nil, err
+	} else {
+		return makeBaseOp(nonce, owner, sender, salt, callGasLimit, gas, callData)
+	}
+}
+
+// DefaultTokenApproveGasLimit covers the approve batched into ops that pay for gas in a token
+var DefaultTokenApproveGasLimit = big.NewInt(60_000)
+
+// UserOpApproveGasToken returns a copy of an execute op rewritten as executeBatch, first
+// approving the paymaster to take amount of token for gas, then making the original call.
+func UserOpApproveGasToken(op *userop.UserOperation, token, paymaster ethgo.Address, amount *big.Int) (*userop.UserOperation, error) {
+	if len(op.CallData) < 4 || !bytes.Equal(op.CallData[:4], abiExec.ID()) {
+		return nil, fmt.Errorf("token gas payment requires an execute op")
+	}
+	decoded, err := abi.Decode(abiExec.Inputs, op.CallData[4:])
+	if err != nil {
+		return nil, err
+	}
+	args, _ := decoded.(map[string]interface{})
+	to, _ := args["to"].(ethgo.Address)
+	value, _ := args["value"].(*big.Int)
+	data, _ := args["data"].([]byte)
+	if value != nil && value.Sign() != 0 {
+		// executeBatch has no value
+		return nil, fmt.Errorf("token gas payment isn't supported for calls with value")
+	}
+
+	approve, err := approveMethod.Encode([]interface{}{paymaster, amount})
+	if err != nil {
+		return nil, err
+	}
+	callData, err := abiExecBatch.Encode([]interface{}{[]ethgo.Address{token, to}, [][]byte{approve, data}})
+	if err != nil {
+		return nil, err
+	}
+
+	newOp := *op
+	newOp.CallData = callData
+	newOp.CallGasLimit = new(big.Int).Add(op.CallGasLimit, DefaultTokenApproveGasLimit)
+	return &newOp, nil
+}
+
+func UserOpSeal(op *userop.UserOperation, chainId *big.Int, s chain.Signer) (*userop.UserOperation, error) {
 	opHash := op.GetUserOpHash(common.Address(DefaultEntryPoint), chainId)
-	opEthHash := crypto.EthSignedMessageHash(opHash.Bytes())
-	if sig, err := crypto.Sign(k.SK, opEthHash); err != nil {
+	if sig, err := s.SignHash(opHash.Bytes()); err != nil {
 		return nil, err
 	} else {
-		sig[64] += 27
 		op.Signature = sig
 	}
 	return op, nil
@@ -111,15 +160,6 @@ func UserOpSeal(op *userop.UserOperation, chainId *big.Int, k *chain.EcdsaKey) (
 func UserOpEcrecover(op *userop.UserOperation, chainId *big.Int) (opHash common.Hash, addr ethgo.Address, err error) {
 	opHash = op.GetUserOpHash(common.Address(DefaultEntryPoint), chainId)
 	opEthHash := crypto.EthSignedMessageHash(opHash.Bytes())
-	if len(op.Signature) != 65 {
-		err = fmt.Errorf("should not happen - invalid signature size in user op: %v", len(op.Signature))
-	} else {
-		var sig [65]byte
-		copy(sig[:], op.Signature)
-		if sig[64] >= 27 {
-			sig[64] -= 27
-		}
-		addr, err = wallet.Ecrecover(opEthHash, sig[:])
-	}
+	addr, err = crypto.Ecrecover(opEthHash, op.Signature)
 	return
 }
@@ -0,0 +1,175 @@
+package erc4337
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stackup-wallet/stackup-bundler/pkg/entrypoint/reverts"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/jsonrpc/codec"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// the checks an op can fail before it's sent
+const (
+	RuleSigFailed        = "sigFailed"
+	RuleValidAfter       = "validAfter"
+	RuleValidUntil       = "validUntil"
+	RulePrefund          = "prefund"
+	RulePaymasterDeposit = "paymasterDeposit"
+	RulePaymasterStake   = "paymasterStake"
+	// the entry point reverted validation with FailedOp, e.g. "AA23 reverted"
+	RuleEntryPoint = "entryPoint"
+)
+
+// ValidationRejection is an op that would fail validation on chain.
+type ValidationRejection struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (r *ValidationRejection) Error() string {
+	return fmt.Sprintf("op failed validation (%v): %v", r.Rule, r.Reason)
+}
+
+// ValidationConfig sets the checks on simulateValidation's result.
+type ValidationConfig struct {
+	// ops must stay valid at least this long, so they can still be included
+	ValidUntilMargin time.Duration
+	// required of paymasters, when set
+	MinPaymasterStake *big.Int
+	MinUnstakeDelay   time.Duration
+}
+
+// simulateValidation runs the entry point's simulateValidation, which always reverts,
+// with either ValidationResult or FailedOp.
+func (hc *HandlerContext) simulateValidation(ctx context.Context, op *userop.UserOperation) (*reverts.ValidationResultRevert, error) {
+	opMap, _ := op.ToMap()
+	data, err := hc.EntryPoint.GetABI().GetMethod("simulateValidation").Encode([]any{opMap})
+	if err != nil {
+		return nil, err
+	}
+	err = hc.chainCall(ctx, func() (err error) {
+		_, err = hc.chainRpc.Eth().Call(&ethgo.CallMsg{To: &DefaultEntryPoint, Data: data}, ethgo.Latest)
+		return
+	})
+	if err == nil {
+		return nil, fmt.Errorf("unexpected - simulateValidation did not revert")
+	}
+	cerr, ok := err.(*codec.ErrorObject)
+	if !ok {
+		return nil, err
+	}
+	et := errThunk{cerr: cerr}
+	res, resErr := reverts.NewValidationResult(et)
+	if resErr == nil {
+		return res, nil
+	}
+	if failed, failedErr := reverts.NewFailedOp(et); failedErr == nil {
+		return nil, &ValidationRejection{Rule: RuleEntryPoint, Reason: failed.Reason}
+	}
+	return nil, fmt.Errorf("simulateValidation: %v", resErr.Error())
+}
+
+func (hc *HandlerContext) depositOf(ctx context.Context, addr ethgo.Address) (*big.Int, error) {
+	var res map[string]interface{}
+	if err := hc.chainCall(ctx, func() (err error) {
+		res, err = hc.EntryPoint.Call("balanceOf", ethgo.Latest, addr)
+		return
+	}); err != nil {
+		return nil, err
+	}
+	deposit, ok := res["0"].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("unexpected - expected *big.Int for balanceOf return value")
+	}
+	return deposit, nil
+}
+
+// validateUserOp simulates the op's validation and returns a *ValidationRejection if
+// the op would fail it once sent.
+func (hc *HandlerContext) validateUserOp(ctx context.Context, op *userop.UserOperation) error {
+	res, err := hc.simulateValidation(ctx, op)
+	if err != nil {
+		return err
+	}
+	ret := res.ReturnInfo
+	if ret.SigFailed {
+		return &ValidationRejection{Rule: RuleSigFailed, Reason: "the account or paymaster rejected the op's signature"}
+	}
+
+	now := time.Now()
+	if ret.ValidAfter != nil && ret.ValidAfter.Int64() > now.Unix() {
+		return &ValidationRejection{Rule: RuleValidAfter, Reason: fmt.Sprintf("the op is not valid until %v",
+			time.Unix(ret.ValidAfter.Int64(), 0).UTC().Format(time.RFC3339))}
+	}
+	// zero is valid indefinitely
+	if ret.ValidUntil != nil && ret.ValidUntil.Sign() != 0 && ret.ValidUntil.Int64() < now.Add(hc.validation.ValidUntilMargin).Unix() {
+		return &ValidationRejection{Rule: RuleValidUntil, Reason: fmt.Sprintf("the op expires at %v",
+			time.Unix(ret.ValidUntil.Int64(), 0).UTC().Format(time.RFC3339))}
+	}
+
+	paymasterAddr := ethgo.Address(op.GetPaymaster())
+	if paymasterAddr == ethgo.ZeroAddress {
+		// the account pays the prefund from its deposit, topping it up from its balance
+		deposit, err := hc.depositOf(ctx, ethgo.Address(op.Sender))
+		if err != nil {
+			return err
+		}
+		var balance *big.Int
+		if err = hc.chainCall(ctx, func() (err error) {
+			balance, err = hc.chainRpc.Eth().GetBalance(ethgo.Address(op.Sender), ethgo.Latest)
+			return
+		}); err != nil {
+			return err
+		}
+		if funds := new(big.Int).Add(deposit, balance); funds.Cmp(ret.Prefund) < 0 {
+			return &ValidationRejection{Rule: RulePrefund, Reason: fmt.Sprintf("the account has %v wei to cover a prefund of %v",
+				funds.String(), ret.Prefund.String())}
+		}
+		return nil
+	}
+
+	deposit, err := hc.depositOf(ctx, paymasterAddr)
+	if err != nil {
+		return err
+	}
+	if deposit.Cmp(ret.Prefund) < 0 {
+		return &ValidationRejection{Rule: RulePaymasterDeposit, Reason: fmt.Sprintf("paymaster %v has a deposit of %v wei, the prefund is %v",
+			paymasterAddr.String(), deposit.String(), ret.Prefund.String())}
+	}
+	stake := res.PaymasterInfo
+	// paymasters returning a context must be staked, as bundlers require
+	if len(ret.PaymasterContext) != 0 && stake.Stake.Sign() == 0 {
+		return &ValidationRejection{Rule: RulePaymasterStake, Reason: fmt.Sprintf("paymaster %v returns a context but isn't staked", paymasterAddr.String())}
+	}
+	if min := hc.validation.MinPaymasterStake; min != nil && stake.Stake.Cmp(min) < 0 {
+		return &ValidationRejection{Rule: RulePaymasterStake, Reason: fmt.Sprintf("paymaster %v has a stake of %v wei, at least %v is required",
+			paymasterAddr.String(), stake.Stake.String(), min.String())}
+	}
+	if min := hc.validation.MinUnstakeDelay; min != 0 && stake.UnstakeDelaySec.Int64() < int64(min.Seconds()) {
+		return &ValidationRejection{Rule: RulePaymasterStake, Reason: fmt.Sprintf("paymaster %v has an unstake delay of %vs, at least %v is required",
+			paymasterAddr.String(), stake.UnstakeDelaySec.String(), min.String())}
+	}
+	return nil
+}
+
+// abortWithSendError responds to ops that failed validation with why; anything else
+// is ours.
+func abortWithSendError(c *gin.Context, err error) {
+	var rejection *ValidationRejection
+	if errors.As(err, &rejection) {
+		_ = c.Error(err)
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, map[string]string{
+			"error":  "op failed validation",
+			"rule":   rejection.Rule,
+			"reason": rejection.Reason,
+		})
+		return
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+}
@@ -0,0 +1,275 @@
+package faucet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	// KindRequest mints with the test token's requestTokens(), then transfers
+	KindRequest Kind = "request"
+	KindERC20   Kind = "erc20"
+	KindNative  Kind = "native"
+)
+
+const (
+	cooldownPrefix = "faucet-cooldown/"
+	budgetPrefix   = "faucet-budget/"
+	grantPrefix    = "faucet-grant/"
+)
+
+var grantTTL = 90 * 24 * time.Hour
+
+// fixed width so grant keys sort by time
+const grantKeyTime = "2006-01-02T15:04:05.000000000Z"
+
+var faucetAbi, _ = abi.NewABIFromList([]string{
+	"function requestTokens()",
+	"function transfer(address to, uint256 amount) returns (bool)",
+})
+
+type Config struct {
+	Kind   Kind
+	Token  ethgo.Address
+	Amount *big.Int
+
+	AddressCooldown time.Duration
+	IPCooldown      time.Duration
+	// in the same units as Amount; unlimited when nil
+	DailyBudget *big.Int
+}
+
+// Rejection is a grant refused by a cooldown or the budget.
+type Rejection struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+type Grant struct {
+	To        ethgo.Address  `json:"to"`
+	User      *ethgo.Address `json:"user,omitempty"`
+	IP        string         `json:"ip"`
+	Kind      Kind           `json:"kind"`
+	Token     *ethgo.Address `json:"token,omitempty"`
+	Amount    *hexutil.Big   `json:"amount"`
+	TxHash    ethgo.Hash     `json:"txHash"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+type Faucet struct {
+	cfg   Config
+	store *store.Store
+	now   func() time.Time
+
+	// sends cfg.Amount to the address; the hash is set once the transfer is sent, even
+	// if the wait for it fails
+	dispense func(ctx context.Context, to ethgo.Address) (ethgo.Hash, error)
+
+	// one send at a time, they all take their nonce from the same key
+	mu sync.Mutex
+}
+
+func ParseKind(s string) (Kind, error) {
+	switch k := Kind(strings.ToLower(s)); k {
+	case KindRequest, KindERC20, KindNative:
+		return k, nil
+	}
+	return "", fmt.Errorf("invalid faucet kind '%v', expected request, erc20 or native", s)
+}
+
+func New(cfg Config, client *rpc.Client, signer chain.Signer, st *store.Store) (*Faucet, error) {
+	if cfg.Amount == nil || cfg.Amount.Sign() <= 0 {
+		return nil, fmt.Errorf("faucet amount must be positive")
+	}
+	f := &Faucet{cfg: cfg, store: st, now: time.Now}
+
+	if cfg.Kind == KindNative {
+		f.dispense = func(ctx context.Context, to ethgo.Address) (ethgo.Hash, error) {
+			txn := chain.ValueTxn(client, signer, to, cfg.Amount)
+			err := f.sendWait(ctx, txn, nil)
+			return txn.Hash(), err
+		}
+		return f, nil
+	}
+
+	if cfg.Token == ethgo.ZeroAddress {
+		return nil, fmt.Errorf("faucet kind '%v' requires a token", cfg.Kind)
+	}
+	tokenTxn := func(method string, args ...interface{}) (contract.Txn, error) {
+		data, err := faucetAbi.GetMethod(method).Encode(args)
+		return chain.SignerTxn(client, signer, cfg.Token, nil, data), err
+	}
+	f.dispense = func(ctx context.Context, to ethgo.Address) (hash ethgo.Hash, err error) {
+		if cfg.Kind == KindRequest {
+			txn, err := tokenTxn("requestTokens")
+			if err = f.sendWait(ctx, txn, err); err != nil {
+				return hash, err
+			}
+		}
+		txn, err := tokenTxn("transfer", to, cfg.Amount)
+		err = f.sendWait(ctx, txn, err)
+		return txn.Hash(), err
+	}
+	return f, nil
+}
+
+// sendWait sends the transaction and waits for it until ctx is done, or for
+// chain.DefaultTxnTimeout when ctx has no deadline. Only the send holds the lock, so
+// a grant waiting on its receipt doesn't hold up the others.
+func (f *Faucet) sendWait(ctx context.Context, txn contract.Txn, errIn error) error {
+	if errIn != nil {
+		return errIn
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, chain.DefaultTxnTimeout)
+		defer cancel()
+	}
+	f.mu.Lock()
+	err := chain.DoContext(ctx, txn)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = chain.WaitContext(ctx, txn)
+	return err
+}
+
+func dayKey(day time.Time) string {
+	return budgetPrefix + day.UTC().Format("2006-01-02")
+}
+
+type claim struct {
+	key string
+	ttl time.Duration
+}
+
+// claimCooldown starts the cooldown for key, failing if it's already running.
+func (f *Faucet) claimCooldown(key string, ttl time.Duration, what string) (*claim, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	n, err := f.store.Incr(cooldownPrefix+key, 1, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1 {
+		return nil, &Rejection{Reason: fmt.Sprintf("%v is in its %v cooldown", what, ttl), RetryAfter: ttl}
+	}
+	return &claim{key: cooldownPrefix + key, ttl: ttl}, nil
+}
+
+func (f *Faucet) claimBudget() (*claim, error) {
+	if f.cfg.DailyBudget == nil {
+		return nil, nil
+	}
+	c := &claim{key: dayKey(f.now()), ttl: 48 * time.Hour}
+	n, err := f.store.Incr(c.key, 1, c.ttl)
+	if err != nil {
+		return nil, err
+	}
+	maxGrants := new(big.Int).Div(f.cfg.DailyBudget, f.cfg.Amount).Int64()
+	if n > maxGrants {
+		_, _ = f.store.Incr(c.key, -1, c.ttl)
+		tomorrow := f.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return nil, &Rejection{Reason: "the faucet's daily budget is used up", RetryAfter: tomorrow.Sub(f.now())}
+	}
+	return c, nil
+}
+
+// Grant sends the configured amount to the address, subject to cooldowns on the
+// address, the authenticated user, if any, and the client's IP. The wait for the
+// transaction is abandoned when ctx is done.
+func (f *Faucet) Grant(ctx context.Context, to ethgo.Address, user *ethgo.Address, ip string) (grant *Grant, err error) {
+	var claims []*claim
+	var txHash ethgo.Hash
+	defer func() {
+		// a sent transfer keeps its claims, or a client could hang up mid wait and claim again
+		if err == nil || txHash != (ethgo.Hash{}) {
+			return
+		}
+		for _, c := range claims {
+			if strings.HasPrefix(c.key, budgetPrefix) {
+				_, _ = f.store.Incr(c.key, -1, c.ttl)
+			} else {
+				_ = f.store.Delete(c.key)
+			}
+		}
+	}()
+
+	take := func(c *claim, err error) error {
+		if c != nil {
+			claims = append(claims, c)
+		}
+		return err
+	}
+	if err = take(f.claimCooldown("ip/"+ip, f.cfg.IPCooldown, "this IP")); err != nil {
+		return
+	}
+	if err = take(f.claimCooldown("address/"+to.String(), f.cfg.AddressCooldown, "this address")); err != nil {
+		return
+	}
+	if user != nil && *user != to {
+		if err = take(f.claimCooldown("address/"+user.String(), f.cfg.AddressCooldown, "this user")); err != nil {
+			return
+		}
+	}
+	if err = take(f.claimBudget()); err != nil {
+		return
+	}
+
+	if txHash, err = f.dispense(ctx, to); err != nil {
+		return
+	}
+
+	grant = &Grant{
+		To:        to,
+		User:      user,
+		IP:        ip,
+		Kind:      f.cfg.Kind,
+		Amount:    (*hexutil.Big)(f.cfg.Amount),
+		TxHash:    txHash,
+		CreatedAt: f.now().UTC(),
+	}
+	if f.cfg.Kind != KindNative {
+		grant.Token = &f.cfg.Token
+	}
+	key := grantPrefix + grant.CreatedAt.Format(grantKeyTime) + "/" + to.String()
+	if logErr := f.store.PutWithTTL(key, grant, grantTTL); logErr != nil {
+		log.Errorf("failed to log faucet grant to %v, tx %v: %v", to.String(), txHash.String(), logErr.Error())
+	}
+	log.Infof("faucet granted %v to %v, tx %v", f.cfg.Amount.String(), to.String(), txHash.String())
+	return grant, nil
+}
+
+// Grants returns the logged grants, oldest first.
+func (f *Faucet) Grants() (grants []*Grant, err error) {
+	err = f.store.List(grantPrefix, func(_ string, val []byte) error {
+		grant := &Grant{}
+		if err := json.Unmarshal(val, grant); err != nil {
+			return err
+		}
+		grants = append(grants, grant)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,129 @@
+package faucet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testAccount = ethgo.HexToAddress("0xfD6DD93dCc566f6E8C0A5FFb7322B1302c1d2CC0")
+var testOwner = ethgo.HexToAddress("0x3bF27b2B37345D08a980E273564473bC3744bB1e")
+var testOther = ethgo.HexToAddress("0x58a2993A618Afee681DE23dECBCF535A58A080BA")
+
+func makeTestFaucet(t *testing.T) (*Faucet, *[]ethgo.Address) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	var sent []ethgo.Address
+	f := &Faucet{
+		cfg: Config{
+			Kind:            KindNative,
+			Amount:          big.NewInt(100),
+			AddressCooldown: 24 * time.Hour,
+			IPCooldown:      time.Hour,
+			DailyBudget:     big.NewInt(250),
+		},
+		store: st,
+		now:   time.Now,
+		dispense: func(_ context.Context, to ethgo.Address) (ethgo.Hash, error) {
+			if to == testOther {
+				return ethgo.Hash{}, errors.New("out of funds")
+			}
+			sent = append(sent, to)
+			return ethgo.Hash{1}, nil
+		},
+	}
+	return f, &sent
+}
+
+func requireRejection(t *testing.T, err error) {
+	var rejection *Rejection
+	require.True(t, errors.As(err, &rejection), "expected a rejection, got %v", err)
+}
+
+func TestFaucetGrant(t *testing.T) {
+	f, sent := makeTestFaucet(t)
+
+	grant, err := f.Grant(context.Background(), testAccount, &testOwner, "1.1.1.1")
+	require.NoError(t, err)
+	require.Equal(t, ethgo.Hash{1}, grant.TxHash)
+
+	// the address, the user behind it and the ip are all cooling down
+	_, err = f.Grant(context.Background(), testAccount, nil, "2.2.2.2")
+	requireRejection(t, err)
+	_, err = f.Grant(context.Background(), testOwner, nil, "3.3.3.3")
+	requireRejection(t, err)
+	_, err = f.Grant(context.Background(), testOther, nil, "1.1.1.1")
+	requireRejection(t, err)
+
+	// a failed grant doesn't count against anything
+	_, err = f.Grant(context.Background(), testOther, nil, "4.4.4.4")
+	require.EqualError(t, err, "out of funds")
+	f.dispense = func(_ context.Context, to ethgo.Address) (ethgo.Hash, error) {
+		*sent = append(*sent, to)
+		return ethgo.Hash{2}, nil
+	}
+	_, err = f.Grant(context.Background(), testOther, nil, "4.4.4.4")
+	require.NoError(t, err)
+
+	// 250 a day is two grants of 100
+	_, err = f.Grant(context.Background(), ethgo.HexToAddress("0x0000000000000000000000000000000000000001"), nil, "5.5.5.5")
+	requireRejection(t, err)
+	require.Len(t, *sent, 2)
+
+	f.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	_, err = f.Grant(context.Background(), ethgo.HexToAddress("0x0000000000000000000000000000000000000001"), nil, "5.5.5.5")
+	require.NoError(t, err)
+
+	grants, err := f.Grants()
+	require.NoError(t, err)
+	require.Len(t, grants, 3)
+	require.Equal(t, testAccount, grants[0].To)
+	require.Equal(t, testOwner, *grants[0].User)
+}
+
+func TestFaucetGrantSentKeepsCooldown(t *testing.T) {
+	f, _ := makeTestFaucet(t)
+	f.dispense = func(ctx context.Context, to ethgo.Address) (ethgo.Hash, error) {
+		return ethgo.Hash{1}, ctx.Err()
+	}
+
+	// the client hung up while the sent transfer was waited for
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := f.Grant(ctx, testAccount, nil, "1.1.1.1")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = f.Grant(context.Background(), testAccount, nil, "2.2.2.2")
+	requireRejection(t, err)
+}
+
+func TestHandleFaucet(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	f, _ := makeTestFaucet(t)
+	r := gin.New()
+	r.POST("/faucet", f.HandleFaucet)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/faucet", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusBadRequest, post(`{"address": "0x1234"}`).Code)
+	require.Equal(t, http.StatusOK, post(`{"address": "`+testAccount.String()+`"}`).Code)
+	w := post(`{"address": "` + testAccount.String() + `"}`)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+}
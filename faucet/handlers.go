@@ -0,0 +1,59 @@
+package faucet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/auth"
+	"github.com/umbracle/ethgo"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type faucetRequest struct {
+	// a smart account or owner address
+	Address string `json:"address"`
+}
+
+// HandleFaucet grants funds to the address in the body, POST /faucet.
+func (f *Faucet) HandleFaucet(c *gin.Context) {
+	req := faucetRequest{}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if len(req.Address) != len(ethgo.ZeroAddress.String()) {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid or missing address"))
+		return
+	}
+
+	var user *ethgo.Address
+	if addr, ok := auth.AuthenticatedAddress(c); ok {
+		user = &addr
+	}
+
+	grant, err := f.Grant(c.Request.Context(), ethgo.HexToAddress(req.Address), user, c.ClientIP())
+	if err != nil {
+		var rejection *Rejection
+		if errors.As(err, &rejection) {
+			secs := int(math.Ceil(rejection.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(secs))
+			_ = c.Error(err)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, map[string]any{"error": rejection.Reason, "retryAfter": secs})
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, grant)
+}
+
+// HandleGrants lists the grant log.
+func (f *Faucet) HandleGrants(c *gin.Context) {
+	grants, err := f.Grants()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, grants)
+}
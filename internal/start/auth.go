@@ -0,0 +1,130 @@
+package start
+
+import (
+	"fmt"
+	"github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/auth"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/store"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type serverAuth struct {
+	// accepted bearer tokens - Stytch JWTs a/o SIWE session tokens
+	verifiers []auth.TokenVerifier
+	siwe      *auth.SIWEHandler
+
+	// set when api keys are required
+	apiKeys *auth.APIKeys
+	// scrapes /metrics, when set
+	metricsToken string
+}
+
+func makeServerAuth(cfg config.Config, chainId *big.Int, st *store.Store) (sa *serverAuth, err error) {
+	sa = &serverAuth{metricsToken: cfg.MetricsToken}
+
+	if cfg.RequireAPIKey {
+		sa.apiKeys = auth.NewAPIKeys(st)
+	} else {
+		log.Warn("api keys are not required - the api is open to anyone who can reach it")
+	}
+	if sa.apiKeys == nil && len(sa.metricsToken) == 0 {
+		log.Warn("no metrics token or api keys configured - /metrics can't be scraped")
+	}
+
+	if len(cfg.JWKSUrl) != 0 || len(cfg.JWKSFile) != 0 {
+		// without both, a token the JWKS issuer made for any other app or tenant is accepted
+		if len(cfg.JWTIssuer) == 0 || len(cfg.JWTAudience) == 0 {
+			return nil, fmt.Errorf("JWKS auth requires ERC4337_API_JWT_ISSUER and ERC4337_API_JWT_AUDIENCE")
+		}
+		var keys *auth.JWKS
+		if keys, err = auth.NewJWKS(cfg.JWKSUrl, cfg.JWKSFile, auth.DefaultJWKSRefreshInterval); err != nil {
+			return
+		}
+		sa.verifiers = append(sa.verifiers, auth.NewJWTVerifier(keys, cfg.JWTIssuer, cfg.JWTAudience))
+	}
+
+	if len(cfg.SIWEDomain) != 0 {
+		var sessions *auth.SessionIssuer
+		if sessions, err = auth.NewSessionIssuer([]byte(cfg.SessionSecret), cfg.SessionTTL); err != nil {
+			return
+		}
+		if len(cfg.SessionSecret) == 0 {
+			log.Warn("no session secret configured - SIWE sessions will not survive a restart")
+		}
+		sa.siwe = &auth.SIWEHandler{
+			Verifier: &auth.SIWEVerifier{
+				Domain:    cfg.SIWEDomain,
+				ChainId:   chainId,
+				Nonces:    auth.NewNonceStore(10*time.Minute, auth.DefaultMaxNonces),
+				ClockSkew: time.Minute,
+			},
+			Sessions: sessions,
+		}
+		sa.verifiers = append(sa.verifiers, sessions)
+	}
+
+	if len(sa.verifiers) == 0 {
+		log.Warn("no JWKS or SIWE domain configured - userop routes are unauthenticated")
+	}
+	return
+}
+
+func skipAuth(c *gin.Context) {
+	c.Next()
+}
+
+func (sa *serverAuth) requireKey(scope auth.Scope, countsOp bool) gin.HandlerFunc {
+	if sa.apiKeys == nil {
+		return skipAuth
+	}
+	return auth.RequireAPIKey(sa.apiKeys, scope, countsOp)
+}
+
+// requireAdmin fails closed: without api keys there's no telling an admin apart, so
+// admin routes are refused rather than left open.
+func (sa *serverAuth) requireAdmin() gin.HandlerFunc {
+	if sa.apiKeys == nil {
+		return func(c *gin.Context) {
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "admin routes require api keys"})
+		}
+	}
+	return auth.RequireAPIKey(sa.apiKeys, auth.ScopeAdmin, false)
+}
+
+// requireMetrics takes the metrics token, so metrics can be scraped without api keys,
+// or else an admin key.
+func (sa *serverAuth) requireMetrics() gin.HandlerFunc {
+	if len(sa.metricsToken) == 0 {
+		return sa.requireAdmin()
+	}
+	return auth.RequireStaticToken(sa.metricsToken)
+}
+
+// requireVerifiers fails closed for routes that act for an owner and so can't be left
+// open when there's no JWKS or SIWE to authenticate users.
+func (sa *serverAuth) requireVerifiers() gin.HandlerFunc {
+	if len(sa.verifiers) == 0 {
+		return func(c *gin.Context) {
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "this route requires JWKS or SIWE authentication"})
+		}
+	}
+	return skipAuth
+}
+
+func (sa *serverAuth) requireUser() gin.HandlerFunc {
+	if len(sa.verifiers) == 0 {
+		return skipAuth
+	}
+	return auth.RequireToken(sa.verifiers...)
+}
+
+func (sa *serverAuth) requireOwner() gin.HandlerFunc {
+	if len(sa.verifiers) == 0 {
+		return skipAuth
+	}
+	return auth.RequireOwner()
+}
@@ -0,0 +1,70 @@
+package start
+
+import (
+	"fmt"
+	"github.com/apex/log"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/faucet"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/umbracle/ethgo"
+)
+
+// makeFaucet returns nil unless the chain is one of the faucet's testnets.
+func makeFaucet(cfg config.Config, hc *erc4337.HandlerContext, sa *serverAuth, st *store.Store) (*faucet.Faucet, error) {
+	if len(cfg.FaucetChainIds) == 0 {
+		return nil, nil
+	}
+	enabled := false
+	for _, id := range cfg.FaucetChainIds {
+		enabled = enabled || id == hc.ChainId.String()
+	}
+	if !enabled {
+		log.Infof("faucet disabled - chain id %v is not one of %v", hc.ChainId.String(), cfg.FaucetChainIds)
+		return nil, nil
+	}
+	if len(sa.verifiers) == 0 {
+		return nil, fmt.Errorf("the faucet requires JWT or SIWE auth to be configured")
+	}
+	if hc.Signer == nil {
+		return nil, fmt.Errorf("the faucet requires the server key")
+	}
+
+	kind, err := faucet.ParseKind(cfg.FaucetKind)
+	if err != nil {
+		return nil, err
+	}
+	fCfg := faucet.Config{Kind: kind, AddressCooldown: cfg.FaucetAddressCooldown, IPCooldown: cfg.FaucetIPCooldown}
+	if len(cfg.FaucetToken) != 0 {
+		if fCfg.Token, err = parseAddress("faucet token", cfg.FaucetToken); err != nil {
+			return nil, err
+		}
+	}
+	if fCfg.Amount, err = parseWei("faucet amount", cfg.FaucetAmount); err != nil {
+		return nil, err
+	}
+	if fCfg.DailyBudget, err = parseWei("faucet daily budget", cfg.FaucetDailyBudget); err != nil {
+		return nil, err
+	}
+
+	signer := hc.Signer
+	if sk, err := cfg.FaucetKey(); err != nil {
+		return nil, err
+	} else if sk != nil {
+		signer = &chain.EcdsaKey{SK: sk}
+	}
+	f, err := faucet.New(fCfg, hc.ChainClient(), signer, st)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("faucet enabled on chain id %v from %v", hc.ChainId.String(), signer.Address().String())
+	return f, nil
+}
+
+func parseAddress(name, s string) (ethgo.Address, error) {
+	if len(s) != len(ethgo.ZeroAddress.String()) {
+		return ethgo.ZeroAddress, fmt.Errorf("invalid %v '%v'", name, s)
+	}
+	return ethgo.HexToAddress(s), nil
+}
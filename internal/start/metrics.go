@@ -0,0 +1,46 @@
+package start
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/bundler"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+var (
+	requestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_http_requests_total",
+		Help: "HTTP requests, by method, route and status.",
+	}, []string{"method", "route", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "erc4337_http_request_duration_seconds",
+		Help: "How long HTTP requests took, by method and route.",
+	}, []string{"method", "route"})
+)
+
+// metricsMiddleware counts requests by their route pattern, so path params like op
+// hashes don't make a series each.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		requestCounter.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		requestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// registerBundlerMetrics reports the size of the in-process bundler's mempool.
+func registerBundlerMetrics(b *bundler.Bundler) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "erc4337_bundler_mempool_ops",
+		Help: "Ops waiting in the in-process bundler's mempool.",
+	}, func() float64 {
+		return float64(b.Size())
+	})
+}
@@ -0,0 +1,66 @@
+package start
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/config"
+	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"net/http"
+)
+
+// parseWei parses an optional wei amount from config, nil when unset.
+func parseWei(name, s string) (*big.Int, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	if wei, ok := new(big.Int).SetString(s, 10); !ok || wei.Sign() < 0 {
+		return nil, fmt.Errorf("invalid %v '%v', expected an amount in wei", name, s)
+	} else {
+		return wei, nil
+	}
+}
+
+// makeDepositMonitor returns nil when no paymaster address is configured.
+func makeDepositMonitor(cfg config.Config, hc *erc4337.HandlerContext, st *store.Store) (mon *paymaster.Monitor, err error) {
+	if len(cfg.PaymasterAddress) != len(ethgo.ZeroAddress.String()) {
+		return nil, nil
+	}
+	monCfg := paymaster.MonitorConfig{
+		Interval:     cfg.DepositMonitorInterval,
+		AlertWebhook: cfg.DepositAlertWebhook,
+		AlertLevel:   cfg.DepositAlertLevel,
+	}
+	if monCfg.Threshold, err = parseWei("deposit alert threshold", cfg.DepositAlertThreshold); err != nil {
+		return
+	}
+	if monCfg.TopUpAmount, err = parseWei("deposit top-up amount", cfg.DepositTopUpAmount); err != nil {
+		return
+	}
+	if monCfg.TopUpDailyCap, err = parseWei("deposit top-up daily cap", cfg.DepositTopUpDailyCap); err != nil {
+		return
+	}
+	if monCfg.TopUpAmount != nil {
+		if monCfg.Threshold == nil || monCfg.TopUpDailyCap == nil {
+			return nil, fmt.Errorf("deposit top-ups require an alert threshold and a daily cap")
+		}
+		if hc.EcdsaKey == nil {
+			return nil, fmt.Errorf("deposit top-ups require the server key")
+		}
+	}
+	return paymaster.NewMonitor(hc.EntryPoint, ethgo.HexToAddress(cfg.PaymasterAddress), monCfg, st), nil
+}
+
+func handleDepositStatus(mon *paymaster.Monitor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := mon.Status()
+		if status == nil {
+			c.AbortWithError(http.StatusServiceUnavailable, fmt.Errorf("paymaster deposit not read yet"))
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
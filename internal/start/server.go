@@ -1,23 +1,48 @@
 package start
 
 import (
+	"context"
 	"fmt"
+	"github.com/apex/log"
 	"github.com/gin-gonic/gin"
+	"github.com/oneness/erc-4337-api/auth"
 	"github.com/oneness/erc-4337-api/config"
 	"github.com/oneness/erc-4337-api/erc4337"
+	"github.com/oneness/erc-4337-api/faucet"
+	"github.com/oneness/erc-4337-api/paymaster"
+	"github.com/oneness/erc-4337-api/policy"
+	"github.com/oneness/erc-4337-api/session"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/oneness/erc-4337-api/upstream"
 	"github.com/oneness/erc-4337-api/util"
-	"github.com/spf13/viper"
-	"log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/umbracle/ethgo"
 	"net/http"
 )
 
 var db = make(map[string]string)
 
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware allows the configured origins. With no origins (or '*') any origin is
+// allowed, but then without credentials.
+func CORSMiddleware(origins []string) gin.HandlerFunc {
+	allowAny := len(origins) == 0
+	allowed := make(map[string]bool)
+	for _, o := range origins {
+		if o == "*" {
+			allowAny = true
+		}
+		allowed[o] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
+		if allowAny {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := c.GetHeader("Origin"); allowed[origin] {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key, accept, origin, Cache-Control, X-Requested-With")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
 
 		if c.Request.Method == "OPTIONS" {
@@ -29,65 +54,165 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-func setupRouter(hc *erc4337.HandlerContext) *gin.Engine {
+func setupRouter(hc *erc4337.HandlerContext, sa *serverAuth, mon *paymaster.Monitor, f *faucet.Faucet, corsOrigins []string) *gin.Engine {
 	r := gin.Default()
-	r.Use(CORSMiddleware())
+	r.Use(metricsMiddleware())
+	r.Use(CORSMiddleware(corsOrigins))
+
+	// health test, with the upstreams' state
+	r.GET("/health", handleHealth(hc.Upstreams))
+	// metrics carry balances and traffic, so they're scraped with the metrics token or
+	// an admin key
+	r.GET("/metrics", sa.requireMetrics(), gin.WrapH(promhttp.Handler()))
+
+	if sa.siwe != nil {
+		authGroup := r.Group("auth")
+		authGroup.GET("siwe/nonce", sa.siwe.HandleNonce)
+		authGroup.POST("siwe/verify", sa.siwe.HandleVerify)
+	}
 
-	// health test
-	r.GET("/health", func(c *gin.Context) {
-		c.String(http.StatusOK, "ok")
-	})
+	adminGroup := r.Group("admin")
+	if sa.apiKeys != nil {
+		// leaked keys are revoked here, the keys command needs the server down for the store
+		adminGroup.POST("apikeys/:id/revoke", sa.requireAdmin(), sa.apiKeys.HandleRevoke)
+	}
+	if mon != nil {
+		adminGroup.GET("paymaster/deposit", sa.requireAdmin(), handleDepositStatus(mon))
+	}
+
+	if f != nil {
+		r.POST("/faucet", sa.requireKey(auth.ScopeBuild, false), sa.requireUser(), f.HandleFaucet)
+		adminGroup.GET("faucet/grants", sa.requireAdmin(), f.HandleGrants)
+	}
 
 	erc4337Group := r.Group("erc4337")
-	erc4337Group.GET("sender-info", hc.HandleGetSenderInfo)
-	erc4337Group.GET("sender-address", hc.HandleGetSenderAddress)
+	erc4337Group.GET("sender-info", sa.requireKey(auth.ScopeInfo, false), hc.HandleGetSenderInfo)
+	erc4337Group.GET("sender-address", sa.requireKey(auth.ScopeInfo, false), hc.HandleGetSenderAddress)
+	erc4337Group.GET("account", sa.requireKey(auth.ScopeInfo, false), hc.HandleAccount)
+
+	erc4337Group.GET("paymaster/settlement", sa.requireKey(auth.ScopeInfo, false), hc.HandleGetSettlement)
+	erc4337Group.POST("eip712/hash", sa.requireKey(auth.ScopeInfo, false), hc.HandleTypedDataHash)
+
+	if hc.Sessions != nil {
+		sessionGroup := erc4337Group.Group("session")
+		sessionGroup.GET("", sa.requireKey(auth.ScopeInfo, false), hc.HandleSessionList)
+		// anyone could hand out or revoke keys on an owner's account without user auth
+		sessionGroup.POST("", sa.requireVerifiers(), sa.requireKey(auth.ScopeBuild, true), sa.requireUser(), sa.requireOwner(), hc.HandleSessionRegister)
+		sessionGroup.POST("revoke", sa.requireVerifiers(), sa.requireKey(auth.ScopeBuild, false), sa.requireUser(), sa.requireOwner(), hc.HandleSessionRevoke)
+		// the session key holder isn't the owner, so only the key's scope is checked
+		sessionGroup.POST("sponsor", sa.requireKey(auth.ScopeBuild, true), hc.HandleSessionSponsor)
+	}
 
-	erc4337Group.GET("userop/approve", hc.HandleUserOpApprove)
-	erc4337Group.GET("userop/withdrawto", hc.HandleUserOpWithdrawTo)
-	erc4337Group.GET("userop/transfer", hc.HandleUserOpTransfer)
+	userOpGroup := erc4337Group.Group("userop")
+	userOpGroup.GET("approve", sa.requireKey(auth.ScopeBuild, true), sa.requireUser(), sa.requireOwner(), hc.HandleUserOpApprove)
+	userOpGroup.GET("withdrawto", sa.requireKey(auth.ScopeBuild, true), sa.requireUser(), sa.requireOwner(), hc.HandleUserOpWithdrawTo)
+	userOpGroup.GET("transfer", sa.requireKey(auth.ScopeBuild, true), sa.requireUser(), sa.requireOwner(), hc.HandleUserOpTransfer)
+	// arbitrary calls are only sponsored within a policy's targets and caps
+	if hc.SponsorPolicy != nil {
+		userOpGroup.GET("call", sa.requireKey(auth.ScopeBuild, true), sa.requireUser(), sa.requireOwner(), hc.HandleUserOpCall)
+	} else {
+		log.Warn("no sponsorship policy configured - userop/call is disabled")
+	}
+	userOpGroup.GET("status", sa.requireKey(auth.ScopeInfo, false), hc.HandleUserOpStatus)
 
-	erc4337Group.POST("userop/send", hc.HandleUserOpSend)
+	// the op owner is recovered from the signature and checked against the token in the handler;
+	// ops count against the key's quota when they're built, so sending them doesn't again
+	userOpGroup.POST("send", sa.requireKey(auth.ScopeSend, false), sa.requireUser(), hc.HandleUserOpSend)
+	// replacements for stuck ops, checked against the owner the op was sent for; they stand
+	// in for an op already counted
+	userOpGroup.POST(":hash/speedup", sa.requireKey(auth.ScopeBuild, false), sa.requireUser(), hc.HandleUserOpSpeedup)
+	userOpGroup.POST(":hash/cancel", sa.requireKey(auth.ScopeBuild, false), sa.requireUser(), hc.HandleUserOpCancel)
 
 	return r
 }
 
+// handleHealth is ok while every upstream has a healthy endpoint, degraded when some
+// endpoints are down, and unavailable when an upstream has none left.
+func handleHealth(pools []*upstream.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code, status := http.StatusOK, "ok"
+		var upstreams []upstream.Status
+		for _, p := range pools {
+			s := p.Status()
+			upstreams = append(upstreams, s)
+			if !s.Healthy {
+				code, status = http.StatusServiceUnavailable, "down"
+				continue
+			}
+			for _, e := range s.Endpoints {
+				if !e.Healthy && code == http.StatusOK {
+					status = "degraded"
+				}
+			}
+		}
+		c.JSON(code, map[string]any{"status": status, "upstreams": upstreams})
+	}
+}
+
 func Server() {
-	// Read in from .env file if available
-	viper.SetConfigName(".env")
-	viper.SetConfigType("env")
-	viper.AddConfigPath(".")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			// Config file not found
-			// Can ignore
-		} else {
-			panic(fmt.Errorf("fatal error config file: %w", err))
+	cfg, err := config.Load()
+	if err != nil {
+		panic(err)
+	}
+
+	st, err := store.Open(cfg.StoreDir)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer st.Close()
+
+	hc, err := erc4337.MakeContext(cfg, st)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	for _, p := range hc.Upstreams {
+		go p.Run(context.Background())
+	}
+	if hc.TokenReconciler != nil {
+		go hc.TokenReconciler.Run(context.Background())
+	}
+	if hc.Bundler != nil {
+		registerBundlerMetrics(hc.Bundler)
+		go hc.Bundler.Run(context.Background())
+	}
+
+	if len(cfg.PolicyFile) != 0 {
+		p, err := policy.LoadPolicy(cfg.PolicyFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if hc.SponsorPolicy, err = policy.NewEngine(p, st); err != nil {
+			log.Fatal(err.Error())
 		}
+	} else {
+		log.Warn("no sponsorship policy configured - every op built is sponsored")
 	}
 
-	// Read in from environment variables
-	_ = viper.BindEnv("ERC4337_API_BUNDLER_URL")
-	_ = viper.BindEnv("ERC4337_API_PAYMASTER_URL")
-	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_SK")
-	_ = viper.BindEnv("ERC4337_API_ETH_CLIENT_URL")
+	if len(cfg.SessionKeyPlugin) != 0 {
+		if hc.Sessions, err = session.NewManager(ethgo.HexToAddress(cfg.SessionKeyPlugin), st); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
 
-	maybeEnvUrl := viper.GetString("ERC4337_API_ETH_CLIENT_URL")
+	sa, err := makeServerAuth(cfg, hc.ChainId, st)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-	// TODO: some API's will fail without these url's - should we just fail here...?
-	maybeSUNodeUrl := viper.GetString("ERC4337_API_BUNDLER_URL")
-	maybeSUPaymasterUrl := viper.GetString("ERC4337_API_PAYMASTER_URL")
-	cfg := config.Config{
-		ChainSKHex:     viper.GetString("ERC4337_API_ETH_CLIENT_SK"),
-		ChainRpcUrl:    maybeEnvUrl,
-		SUNodeUrl:      maybeSUNodeUrl,
-		SUPayMasterUrl: maybeSUPaymasterUrl,
+	mon, err := makeDepositMonitor(cfg, hc, st)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-	hc, err := erc4337.MakeContext(cfg)
+	if mon != nil {
+		go mon.Run(context.Background())
+	}
+
+	f, err := makeFaucet(cfg, hc, sa, st)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(err.Error())
 	}
 
-	r := setupRouter(hc)
+	r := setupRouter(hc, sa, mon, f, cfg.CORSOrigins)
 	localIp := util.GetOutboundIP()
 	println(fmt.Sprintf("server starting at local IP %v", localIp.String())) // TODO: logging...
 	// Listen and Server in 0.0.0.0:8080
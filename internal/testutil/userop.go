@@ -0,0 +1,46 @@
+// Package testutil holds the fixtures the packages' tests share.
+package testutil
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"testing"
+)
+
+var executeMethod, _ = abi.NewMethod("function execute(address to, uint256 value, bytes data)")
+
+// ExecuteCallData is the account's execute call to target, sending value and calling
+// method with args.
+func ExecuteCallData(t testing.TB, target ethgo.Address, value int64, method string, args ...any) []byte {
+	m, err := abi.NewMethod(method)
+	require.NoError(t, err)
+	inner, err := m.Encode(args)
+	require.NoError(t, err)
+	callData, err := executeMethod.Encode([]interface{}{target, big.NewInt(value), inner})
+	require.NoError(t, err)
+	return callData
+}
+
+// MakeOp is an unsigned op from sender running callData, with fixed gas limits and a
+// 1 gwei fee.
+func MakeOp(t testing.TB, sender ethgo.Address, callData []byte) *userop.UserOperation {
+	op, err := userop.New(map[string]any{
+		"sender":               sender.String(),
+		"nonce":                big.NewInt(0),
+		"initCode":             "0x",
+		"callData":             hexutil.Encode(callData),
+		"callGasLimit":         big.NewInt(200_000),
+		"verificationGasLimit": big.NewInt(100_000),
+		"maxFeePerGas":         big.NewInt(1_000_000_000),
+		"maxPriorityFeePerGas": big.NewInt(1_000_000_000),
+		"paymasterAndData":     "0x",
+		"preVerificationGas":   big.NewInt(100_000),
+		"signature":            "0x00",
+	})
+	require.NoError(t, err)
+	return op
+}
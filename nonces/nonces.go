@@ -0,0 +1,185 @@
+package nonces
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const noncePrefix = "nonce/"
+
+// nonce states
+const (
+	// handed out to a build, free again after the issue TTL unless it's sent
+	Issued = "issued"
+	// sent with an op, free again if the op is dropped or after the sent TTL
+	Sent = "sent"
+)
+
+var (
+	DefaultIssuedTTL = 5 * time.Minute
+	DefaultSentTTL   = 30 * time.Minute
+)
+
+// an entry point nonce is a 192 bit key and a 64 bit sequence number
+var seqMask = new(big.Int).SetUint64(^uint64(0))
+
+func split(nonce *big.Int) (key *big.Int, seq uint64) {
+	return new(big.Int).Rsh(nonce, 64), new(big.Int).And(nonce, seqMask).Uint64()
+}
+
+func join(key *big.Int, seq uint64) *big.Int {
+	nonce := new(big.Int).Lsh(key, 64)
+	return nonce.Or(nonce, new(big.Int).SetUint64(seq))
+}
+
+type entry struct {
+	Seq       uint64    `json:"seq"`
+	Status    string    `json:"status"`
+	OpHash    string    `json:"opHash,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Manager hands out pending nonces per sender and nonce key, so builds for the same
+// account made before the first op is included don't collide.
+type Manager struct {
+	store     *store.Store
+	issuedTTL time.Duration
+	sentTTL   time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+}
+
+func NewManager(st *store.Store, issuedTTL, sentTTL time.Duration) *Manager {
+	if issuedTTL <= 0 {
+		issuedTTL = DefaultIssuedTTL
+	}
+	if sentTTL <= 0 {
+		sentTTL = DefaultSentTTL
+	}
+	return &Manager{store: st, issuedTTL: issuedTTL, sentTTL: sentTTL, now: time.Now}
+}
+
+func keyPrefix(sender ethgo.Address, key *big.Int) string {
+	return noncePrefix + sender.String() + "/" + key.Text(16) + "/"
+}
+
+func entryKey(sender ethgo.Address, key *big.Int, seq uint64) string {
+	// zero padded so entries list in order
+	return fmt.Sprintf("%v%020d", keyPrefix(sender, key), seq)
+}
+
+func (m *Manager) put(sender ethgo.Address, key *big.Int, e *entry, ttl time.Duration) error {
+	e.ExpiresAt = m.now().Add(ttl).UTC()
+	return m.store.PutWithTTL(entryKey(sender, key, e.Seq), e, ttl)
+}
+
+// Next issues the sender's next free nonce, at or after chainNonce, the entry point's
+// nonce for the key. Nonces below chainNonce have been used and are forgotten.
+func (m *Manager) Next(sender ethgo.Address, chainNonce *big.Int) (*big.Int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, chainSeq := split(chainNonce)
+	taken := map[uint64]bool{}
+	var used []uint64
+	now := m.now()
+	err := m.store.List(keyPrefix(sender, key), func(_ string, val []byte) error {
+		e := entry{}
+		if err := json.Unmarshal(val, &e); err != nil {
+			return err
+		}
+		if e.Seq < chainSeq {
+			used = append(used, e.Seq)
+		} else if now.Before(e.ExpiresAt) {
+			taken[e.Seq] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range used {
+		if err = m.store.Delete(entryKey(sender, key, seq)); err != nil {
+			return nil, err
+		}
+	}
+
+	seq := chainSeq
+	for taken[seq] {
+		seq++
+	}
+	if err = m.put(sender, key, &entry{Seq: seq, Status: Issued}, m.issuedTTL); err != nil {
+		return nil, err
+	}
+	return join(key, seq), nil
+}
+
+// Sent records that an op using the nonce was sent; it stays taken until the op is
+// included, dropped, or the sent TTL passes.
+func (m *Manager) Sent(sender ethgo.Address, nonce *big.Int, opHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, seq := split(nonce)
+	return m.put(sender, key, &entry{Seq: seq, Status: Sent, OpHash: opHash}, m.sentTTL)
+}
+
+// SentOp is a nonce held by an op that was sent but isn't included yet.
+type SentOp struct {
+	Nonce  *big.Int
+	OpHash string
+}
+
+// SentOps returns the sender's nonces held by sent ops, at or after chainNonce. With an
+// external bundler, which doesn't say when it drops an op, they're checked with it
+// before a build, so a dropped op doesn't leave a gap until the sent TTL passes.
+func (m *Manager) SentOps(sender ethgo.Address, chainNonce *big.Int) (ops []SentOp, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, chainSeq := split(chainNonce)
+	now := m.now()
+	err = m.store.List(keyPrefix(sender, key), func(_ string, val []byte) error {
+		e := entry{}
+		if err := json.Unmarshal(val, &e); err != nil {
+			return err
+		}
+		if e.Status == Sent && e.Seq >= chainSeq && now.Before(e.ExpiresAt) {
+			ops = append(ops, SentOp{Nonce: join(key, e.Seq), OpHash: e.OpHash})
+		}
+		return nil
+	})
+	return
+}
+
+// Release frees an issued nonce whose op won't be sent, so the next build reuses it
+// rather than leaving a gap. A nonce held by a sent op stays taken, e.g. when its
+// replacement fails.
+func (m *Manager) Release(sender ethgo.Address, nonce *big.Int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.free(sender, nonce, func(e *entry) bool { return e.Status == Issued })
+}
+
+// Dropped frees the nonce of a sent op that was dropped without being included, unless
+// another op was sent with it since.
+func (m *Manager) Dropped(sender ethgo.Address, nonce *big.Int, opHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.free(sender, nonce, func(e *entry) bool { return e.Status == Issued || e.OpHash == opHash })
+}
+
+func (m *Manager) free(sender ethgo.Address, nonce *big.Int, ok func(e *entry) bool) error {
+	key, seq := split(nonce)
+	e := entry{}
+	found, err := m.store.Get(entryKey(sender, key, seq), &e)
+	if err != nil || !found || !ok(&e) {
+		return err
+	}
+	return m.store.Delete(entryKey(sender, key, seq))
+}
@@ -0,0 +1,63 @@
+package nonces
+
+import (
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPendingNonces(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	now := time.Now()
+	m := NewManager(st, time.Minute, time.Hour)
+	m.now = func() time.Time { return now }
+	sender := ethgo.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	next := func(chainNonce *big.Int) *big.Int {
+		nonce, err := m.Next(sender, chainNonce)
+		require.NoError(t, err)
+		return nonce
+	}
+
+	// builds before the first op is included get consecutive nonces
+	require.Equal(t, int64(0), next(big.NewInt(0)).Int64())
+	require.Equal(t, int64(1), next(big.NewInt(0)).Int64())
+	require.NoError(t, m.Sent(sender, big.NewInt(1), "0x01"))
+
+	// an abandoned build's nonce is reused, a sent one's isn't
+	require.NoError(t, m.Release(sender, big.NewInt(0)))
+	require.NoError(t, m.Release(sender, big.NewInt(1)))
+	require.Equal(t, int64(0), next(big.NewInt(0)).Int64())
+	require.Equal(t, int64(2), next(big.NewInt(0)).Int64())
+
+	// and so is a build's that isn't sent within the TTL
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, int64(0), next(big.NewInt(0)).Int64())
+
+	sent, err := m.SentOps(sender, big.NewInt(0))
+	require.NoError(t, err)
+	require.Equal(t, []SentOp{{Nonce: big.NewInt(1), OpHash: "0x01"}}, sent)
+	sent, err = m.SentOps(sender, big.NewInt(2))
+	require.NoError(t, err)
+	require.Empty(t, sent)
+
+	// a dropped op frees its nonce, unless it was replaced
+	require.NoError(t, m.Dropped(sender, big.NewInt(1), "0x02"))
+	require.Equal(t, int64(2), next(big.NewInt(0)).Int64())
+	require.NoError(t, m.Dropped(sender, big.NewInt(1), "0x01"))
+	require.Equal(t, int64(1), next(big.NewInt(0)).Int64())
+
+	// resyncs with the chain
+	require.Equal(t, int64(5), next(big.NewInt(5)).Int64())
+
+	// nonce keys are tracked apart
+	keyed := new(big.Int).Lsh(big.NewInt(7), 64)
+	require.Equal(t, keyed, next(keyed))
+	require.Equal(t, new(big.Int).Add(keyed, big.NewInt(1)), next(keyed))
+}
@@ -0,0 +1,8 @@
+package paymaster
+
+import (
+	"embed"
+)
+
+//go:embed abi/VerifyingPaymaster.json
+var abiVerifyingPaymaster embed.FS
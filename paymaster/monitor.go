@@ -0,0 +1,292 @@
+package paymaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const topUpPrefix = "paymaster-topup/"
+
+// low deposit alerts are repeated this often while the deposit stays low
+var alertRepeat = time.Hour
+
+// top-up counters are kept in gwei so they fit an int64
+var gwei = big.NewInt(1_000_000_000)
+
+var (
+	depositGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "erc4337_paymaster_deposit_wei",
+		Help: "The paymaster's EntryPoint deposit.",
+	}, []string{"paymaster"})
+	stakeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "erc4337_paymaster_stake_wei",
+		Help: "The paymaster's EntryPoint stake.",
+	}, []string{"paymaster"})
+	stakedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "erc4337_paymaster_staked",
+		Help: "1 if the paymaster's stake is locked.",
+	}, []string{"paymaster"})
+	depositLowGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "erc4337_paymaster_deposit_low",
+		Help: "1 if the paymaster's deposit is below the alert threshold.",
+	}, []string{"paymaster"})
+	topUpCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_paymaster_topup_wei_total",
+		Help: "Wei deposited for the paymaster by automatic top-ups.",
+	}, []string{"paymaster"})
+)
+
+func weiFloat(wei *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(wei).Float64()
+	return f
+}
+
+type MonitorConfig struct {
+	Interval time.Duration
+	// alerts fire below Threshold; no alerts when nil
+	Threshold    *big.Int
+	AlertWebhook string
+	// "warn" or "error", for alerts that are only logged
+	AlertLevel string
+	// deposited from the server key when below Threshold, up to TopUpDailyCap a day
+	TopUpAmount   *big.Int
+	TopUpDailyCap *big.Int
+}
+
+type DepositStatus struct {
+	Paymaster       ethgo.Address `json:"paymaster"`
+	Deposit         *hexutil.Big  `json:"deposit"`
+	Staked          bool          `json:"staked"`
+	Stake           *hexutil.Big  `json:"stake"`
+	UnstakeDelaySec uint64        `json:"unstakeDelaySec"`
+	WithdrawTime    uint64        `json:"withdrawTime"`
+	Threshold       *hexutil.Big  `json:"threshold,omitempty"`
+	Low             bool          `json:"low"`
+	ToppedUpToday   *hexutil.Big  `json:"toppedUpToday"`
+	CheckedAt       time.Time     `json:"checkedAt"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// Monitor watches the paymaster's EntryPoint deposit and stake.
+type Monitor struct {
+	Paymaster ethgo.Address
+	Config    MonitorConfig
+
+	entryPoint *contract.Contract
+	store      *store.Store
+	client     *http.Client
+	now        func() time.Time
+
+	mu        sync.Mutex
+	status    *DepositStatus
+	lastAlert time.Time
+}
+
+// NewMonitor reads the deposit through entryPoint, which must have the server key as
+// sender for top-ups.
+func NewMonitor(entryPoint *contract.Contract, paymaster ethgo.Address, cfg MonitorConfig, st *store.Store) *Monitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	return &Monitor{
+		Paymaster:  paymaster,
+		Config:     cfg,
+		entryPoint: entryPoint,
+		store:      st,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case *big.Int:
+		return n.Uint64()
+	case uint64:
+		return n
+	case uint32:
+		return uint64(n)
+	}
+	return 0
+}
+
+func (m *Monitor) readDeposit() (*DepositStatus, error) {
+	res, err := m.entryPoint.Call("getDepositInfo", ethgo.Latest, m.Paymaster)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := res["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected - expected tuple for getDepositInfo return value")
+	}
+	deposit, _ := info["deposit"].(*big.Int)
+	stake, _ := info["stake"].(*big.Int)
+	if deposit == nil || stake == nil {
+		return nil, fmt.Errorf("unexpected - invalid getDepositInfo return value")
+	}
+	staked, _ := info["staked"].(bool)
+	return &DepositStatus{
+		Paymaster:       m.Paymaster,
+		Deposit:         (*hexutil.Big)(deposit),
+		Staked:          staked,
+		Stake:           (*hexutil.Big)(stake),
+		UnstakeDelaySec: toUint64(info["unstakeDelaySec"]),
+		WithdrawTime:    toUint64(info["withdrawTime"]),
+	}, nil
+}
+
+func (m *Monitor) topUpKey(day time.Time) string {
+	return topUpPrefix + m.Paymaster.String() + "/" + day.UTC().Format("2006-01-02")
+}
+
+func (m *Monitor) toppedUpToday() (*big.Int, error) {
+	n, err := m.store.Counter(m.topUpKey(m.now()))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Mul(big.NewInt(n), gwei), nil
+}
+
+// topUp deposits TopUpAmount unless that would go over today's cap.
+func (m *Monitor) topUp() error {
+	amountGwei := new(big.Int).Div(m.Config.TopUpAmount, gwei).Int64()
+	key := m.topUpKey(m.now())
+	n, err := m.store.Incr(key, amountGwei, 48*time.Hour)
+	if err != nil {
+		return err
+	}
+	if m.Config.TopUpDailyCap != nil && new(big.Int).Mul(big.NewInt(n), gwei).Cmp(m.Config.TopUpDailyCap) > 0 {
+		_, _ = m.store.Incr(key, -amountGwei, 48*time.Hour)
+		return fmt.Errorf("daily top-up cap of %v wei reached", m.Config.TopUpDailyCap.String())
+	}
+
+	txn, err := m.entryPoint.Txn("depositTo", m.Paymaster)
+	if err == nil {
+		txn.WithOpts(&contract.TxnOpts{Value: m.Config.TopUpAmount})
+	}
+	if err = chain.TxnDoWait(txn, err); err != nil {
+		_, _ = m.store.Incr(key, -amountGwei, 48*time.Hour)
+		return err
+	}
+	topUpCounter.WithLabelValues(m.Paymaster.String()).Add(weiFloat(m.Config.TopUpAmount))
+	log.Infof("topped up paymaster %v deposit by %v wei", m.Paymaster.String(), m.Config.TopUpAmount.String())
+	return nil
+}
+
+func (m *Monitor) alert(status *DepositStatus) {
+	msg := fmt.Sprintf("paymaster %v deposit of %v wei is below %v wei", m.Paymaster.String(),
+		status.Deposit.ToInt().String(), m.Config.Threshold.String())
+	if m.Config.AlertLevel == "error" {
+		log.Error(msg)
+	} else {
+		log.Warn(msg)
+	}
+	if len(m.Config.AlertWebhook) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]any{"text": msg, "status": status})
+	resp, err := m.client.Post(m.Config.AlertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("failed to send low deposit alert: %v", err.Error())
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Errorf("failed to send low deposit alert: webhook returned %v", resp.Status)
+	}
+}
+
+// Check reads the deposit and stake, then alerts and tops up as configured.
+func (m *Monitor) Check() error {
+	status, err := m.readDeposit()
+	if err != nil {
+		m.mu.Lock()
+		if m.status != nil {
+			// statuses handed out are never modified
+			last := *m.status
+			last.Error = err.Error()
+			m.status = &last
+		}
+		m.mu.Unlock()
+		return err
+	}
+	status.CheckedAt = m.now().UTC()
+
+	label := m.Paymaster.String()
+	depositGauge.WithLabelValues(label).Set(weiFloat(status.Deposit.ToInt()))
+	stakeGauge.WithLabelValues(label).Set(weiFloat(status.Stake.ToInt()))
+	stakedGauge.WithLabelValues(label).Set(0)
+	if status.Staked {
+		stakedGauge.WithLabelValues(label).Set(1)
+	}
+
+	if m.Config.Threshold != nil {
+		status.Threshold = (*hexutil.Big)(m.Config.Threshold)
+		status.Low = status.Deposit.ToInt().Cmp(m.Config.Threshold) < 0
+	}
+	depositLowGauge.WithLabelValues(label).Set(0)
+	if status.Low {
+		depositLowGauge.WithLabelValues(label).Set(1)
+		if m.now().Sub(m.lastAlert) >= alertRepeat {
+			m.alert(status)
+			m.lastAlert = m.now()
+		}
+		if m.Config.TopUpAmount != nil && m.Config.TopUpAmount.Sign() > 0 {
+			if err = m.topUp(); err != nil {
+				status.Error = fmt.Sprintf("top-up failed: %v", err.Error())
+				log.Errorf("failed to top up paymaster %v deposit: %v", label, err.Error())
+			}
+		}
+	} else {
+		m.lastAlert = time.Time{}
+	}
+
+	if toppedUp, err := m.toppedUpToday(); err == nil {
+		status.ToppedUpToday = (*hexutil.Big)(toppedUp)
+	}
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+	return nil
+}
+
+// Status returns the last deposit read, nil before the first.
+func (m *Monitor) Status() *DepositStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *Monitor) Run(ctx context.Context) {
+	if err := m.Check(); err != nil {
+		log.Errorf("failed to check paymaster deposit: %v", err.Error())
+	}
+	ticker := time.NewTicker(m.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Check(); err != nil {
+				log.Errorf("failed to check paymaster deposit: %v", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package paymaster
+
+import (
+	"encoding/json"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testEntryPointAbi, _ = abi.NewABIFromList([]string{
+	"function getDepositInfo(address account) view returns (tuple(uint112 deposit, bool staked, uint112 stake, uint32 unstakeDelaySec, uint48 withdrawTime) info)",
+	"function depositTo(address account) payable",
+})
+
+// fakeEntryPoint holds one deposit, which depositTo adds to once mined
+type fakeEntryPoint struct {
+	deposit *big.Int
+}
+
+type fakeTxn struct {
+	ep    *fakeEntryPoint
+	value *big.Int
+}
+
+func (t *fakeTxn) Hash() ethgo.Hash                { return ethgo.Hash{} }
+func (t *fakeTxn) WithOpts(opts *contract.TxnOpts) { t.value = opts.Value }
+func (t *fakeTxn) Wait() (*ethgo.Receipt, error)   { return &ethgo.Receipt{}, nil }
+func (t *fakeTxn) Do() error                       { t.ep.deposit.Add(t.ep.deposit, t.value); return nil }
+
+func (ep *fakeEntryPoint) Txn(ethgo.Address, ethgo.Key, []byte) (contract.Txn, error) {
+	return &fakeTxn{ep: ep}, nil
+}
+
+func (ep *fakeEntryPoint) Call(_ ethgo.Address, _ []byte, _ *contract.CallOpts) ([]byte, error) {
+	info := map[string]interface{}{
+		"deposit": ep.deposit, "staked": true, "stake": big.NewInt(1e18), "unstakeDelaySec": uint32(86400), "withdrawTime": big.NewInt(0),
+	}
+	return abi.Encode(map[string]interface{}{"info": info}, testEntryPointAbi.GetMethod("getDepositInfo").Outputs)
+}
+
+func TestMonitor(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	var alerts []map[string]any
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := map[string]any{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts = append(alerts, alert)
+	}))
+	defer hook.Close()
+
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	ep := &fakeEntryPoint{deposit: big.NewInt(4e17)}
+	c := contract.NewContract(testEntryPoint, testEntryPointAbi, contract.WithProvider(ep), contract.WithSender(&chain.EcdsaKey{SK: sk}))
+	m := NewMonitor(c, testPaymaster, MonitorConfig{
+		Threshold:     big.NewInt(5e17),
+		AlertWebhook:  hook.URL,
+		TopUpAmount:   big.NewInt(2e17),
+		TopUpDailyCap: big.NewInt(3e17),
+	}, st)
+
+	// low, so it alerts and tops up
+	require.NoError(t, m.Check())
+	status := m.Status()
+	require.True(t, status.Low)
+	require.True(t, status.Staked)
+	require.Equal(t, uint64(86400), status.UnstakeDelaySec)
+	require.Equal(t, int64(2e17), status.ToppedUpToday.ToInt().Int64())
+	require.Len(t, alerts, 1)
+	require.Equal(t, int64(6e17), ep.deposit.Int64())
+
+	// drained again, a second top-up would go over the daily cap, and it's too soon
+	// to repeat the alert
+	ep.deposit = big.NewInt(1e17)
+	require.NoError(t, m.Check())
+	status = m.Status()
+	require.True(t, status.Low)
+	require.Contains(t, status.Error, "daily top-up cap")
+	require.Equal(t, int64(1e17), ep.deposit.Int64())
+	require.Len(t, alerts, 1)
+
+	// the next day it may top up again
+	m.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	require.NoError(t, m.Check())
+	require.Equal(t, int64(3e17), ep.deposit.Int64())
+	require.Len(t, alerts, 2)
+}
@@ -0,0 +1,123 @@
+package paymaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateSource supplies exchange rates for gas tokens, in the paymaster's convention:
+// token base units per 1e18 wei.
+type RateSource interface {
+	Rate(token ethgo.Address) (*big.Int, error)
+}
+
+// StaticRates are fixed rates from config.
+type StaticRates map[ethgo.Address]*big.Int
+
+func (s StaticRates) Rate(token ethgo.Address) (*big.Int, error) {
+	if rate, ok := s[token]; ok {
+		return rate, nil
+	}
+	return nil, fmt.Errorf("no exchange rate for token %v", token.String())
+}
+
+func parseRate(token, rate string) (addr ethgo.Address, r *big.Int, err error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, "0x") || len(token) != len(ethgo.ZeroAddress.String()) {
+		err = fmt.Errorf("invalid token address '%v'", token)
+		return
+	}
+	var ok bool
+	if r, ok = new(big.Int).SetString(strings.TrimSpace(rate), 10); !ok || r.Sign() <= 0 {
+		err = fmt.Errorf("invalid exchange rate '%v' for token %v", rate, token)
+		return
+	}
+	addr = ethgo.HexToAddress(token)
+	return
+}
+
+// ParseStaticRates parses 'token=rate' pairs separated by commas.
+func ParseStaticRates(s string) (StaticRates, error) {
+	rates := make(StaticRates)
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		token, rate, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid token rate '%v', expected token=rate", pair)
+		}
+		addr, r, err := parseRate(token, rate)
+		if err != nil {
+			return nil, err
+		}
+		rates[addr] = r
+	}
+	return rates, nil
+}
+
+// FileRates reads rates from a JSON price file of {"<token>": "<rate>"}, reloading it
+// when it changes, so an external job can keep prices current.
+type FileRates struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	rates   StaticRates
+}
+
+func NewFileRates(path string) (*FileRates, error) {
+	f := &FileRates{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// must hold mu, except during construction
+func (f *FileRates) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(f.modTime) {
+		return nil
+	}
+
+	fileBytes, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]string
+	if err = json.Unmarshal(fileBytes, &raw); err != nil {
+		return fmt.Errorf("invalid price file %v: %v", f.path, err.Error())
+	}
+	rates := make(StaticRates)
+	for token, rate := range raw {
+		addr, r, err := parseRate(token, rate)
+		if err != nil {
+			return err
+		}
+		rates[addr] = r
+	}
+	f.rates = rates
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func (f *FileRates) Rate(token ethgo.Address) (*big.Int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// a file caught mid-write keeps the last good prices
+	if err := f.reload(); err != nil {
+		log.Warnf("failed to reload price file: %v", err.Error())
+	}
+	return f.rates.Rate(token)
+}
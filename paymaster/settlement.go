@@ -0,0 +1,193 @@
+package paymaster
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"time"
+)
+
+const settlementPrefix = "paymaster-settlement/"
+
+// settlements are kept around for a month after the op is sponsored
+const settlementTTL = 30 * 24 * time.Hour
+
+// an op may still land shortly after its paymaster signature runs out, the bundler
+// having picked it up in time
+const settlementGrace = 10 * time.Minute
+
+const (
+	SettlementPending = "pending"
+	SettlementSettled = "settled"
+	SettlementExpired = "expired"
+)
+
+var transferTopic = ethgo.Keccak256([]byte("Transfer(address,address,uint256)"))
+
+// Settlement tracks what a token sponsored op was quoted against what postOp actually
+// charged.
+type Settlement struct {
+	OpHash        string        `json:"opHash"`
+	Sender        ethgo.Address `json:"sender"`
+	Token         ethgo.Address `json:"token"`
+	ExchangeRate  *hexutil.Big  `json:"exchangeRate"`
+	MaxTokenCost  *hexutil.Big  `json:"maxTokenCost"`
+	Status        string        `json:"status"`
+	Success       bool          `json:"success,omitempty"`
+	ActualGasCost *hexutil.Big  `json:"actualGasCost,omitempty"`
+	SettledAmount *hexutil.Big  `json:"settledAmount,omitempty"`
+	TxHash        string        `json:"txHash,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	ExpiresAt     time.Time     `json:"expiresAt"`
+	SettledAt     *time.Time    `json:"settledAt,omitempty"`
+}
+
+type Settlements struct {
+	store *store.Store
+}
+
+func NewSettlements(s *store.Store) *Settlements {
+	return &Settlements{store: s}
+}
+
+func (s *Settlements) record(settlement *Settlement) error {
+	return s.store.PutWithTTL(settlementPrefix+settlement.OpHash, settlement, settlementTTL)
+}
+
+func (s *Settlements) Get(opHash string) (settlement *Settlement, found bool, err error) {
+	settlement = &Settlement{}
+	found, err = s.store.Get(settlementPrefix+opHash, settlement)
+	return
+}
+
+func (s *Settlements) Pending() (pending []*Settlement, err error) {
+	err = s.store.List(settlementPrefix, func(_ string, val []byte) error {
+		settlement := &Settlement{}
+		if err := json.Unmarshal(val, settlement); err != nil {
+			return err
+		}
+		if settlement.Status == SettlementPending {
+			pending = append(pending, settlement)
+		}
+		return nil
+	})
+	return
+}
+
+// RPCCaller is the part of the bundler client the reconciler needs.
+type RPCCaller interface {
+	CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error
+}
+
+type receiptLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+}
+
+// the fields of eth_getUserOperationReceipt we use
+type opReceipt struct {
+	Success       bool         `json:"success"`
+	ActualGasCost *hexutil.Big `json:"actualGasCost"`
+	Logs          []receiptLog `json:"logs"`
+	Receipt       struct {
+		TransactionHash common.Hash `json:"transactionHash"`
+	} `json:"receipt"`
+}
+
+// paidAmount sums the token transfers from sender to vault in the op's logs, which is
+// what postOp charged.
+func paidAmount(logs []receiptLog, token, sender, vault ethgo.Address) *big.Int {
+	amount := new(big.Int)
+	for _, l := range logs {
+		if ethgo.Address(l.Address) != token || len(l.Topics) != 3 || l.Topics[0] != common.BytesToHash(transferTopic) {
+			continue
+		}
+		if ethgo.BytesToAddress(l.Topics[1].Bytes()) != sender || ethgo.BytesToAddress(l.Topics[2].Bytes()) != vault {
+			continue
+		}
+		amount.Add(amount, new(big.Int).SetBytes(l.Data))
+	}
+	return amount
+}
+
+// Reconciler settles pending token sponsorships from their op receipts.
+type Reconciler struct {
+	Settlements *Settlements
+	Bundler     RPCCaller
+	Vault       ethgo.Address
+	Interval    time.Duration
+
+	now func() time.Time
+}
+
+func NewReconciler(settlements *Settlements, bundler RPCCaller, vault ethgo.Address, interval time.Duration) *Reconciler {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Reconciler{Settlements: settlements, Bundler: bundler, Vault: vault, Interval: interval, now: time.Now}
+}
+
+func (r *Reconciler) settle(ctx context.Context, settlement *Settlement) error {
+	var receipt *opReceipt
+	if err := r.Bundler.CallContext(ctx, &receipt, "eth_getUserOperationReceipt", settlement.OpHash); err != nil {
+		return err
+	}
+	now := r.now().UTC()
+	if receipt == nil {
+		if now.After(settlement.ExpiresAt.Add(settlementGrace)) {
+			settlement.Status = SettlementExpired
+			return r.Settlements.record(settlement)
+		}
+		return nil
+	}
+
+	amount := paidAmount(receipt.Logs, settlement.Token, settlement.Sender, r.Vault)
+	if amount.Cmp(settlement.MaxTokenCost.ToInt()) > 0 {
+		log.Warnf("op %v paid %v for gas, more than its quote of %v", settlement.OpHash, amount.String(), settlement.MaxTokenCost.ToInt().String())
+	}
+	settlement.Status = SettlementSettled
+	settlement.Success = receipt.Success
+	settlement.ActualGasCost = receipt.ActualGasCost
+	settlement.SettledAmount = (*hexutil.Big)(amount)
+	settlement.TxHash = receipt.Receipt.TransactionHash.String()
+	settlement.SettledAt = &now
+	return r.Settlements.record(settlement)
+}
+
+// Reconcile makes one pass over the pending settlements.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	pending, err := r.Settlements.Pending()
+	if err != nil {
+		return err
+	}
+	for _, settlement := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = r.settle(ctx, settlement); err != nil {
+			log.Warnf("failed to reconcile settlement for op %v: %v", settlement.OpHash, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("failed to reconcile token settlements: %v", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package paymaster
+
+import (
+	"fmt"
+	"github.com/apex/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/contract"
+	"math/big"
+	"time"
+)
+
+// DefaultPostOpGas is used when POST_OP_GAS can't be read from the paymaster.
+var DefaultPostOpGas = big.NewInt(35_000)
+
+var ether = big.NewInt(1_000_000_000_000_000_000)
+
+// with a paymaster the EntryPoint reserves the verification gas three times
+var verificationGasMul = big.NewInt(3)
+
+// Quote is the most a sender can be charged in a token for an op. The paymaster charges
+// (actualGasCost + POST_OP_GAS * gasPrice) * exchangeRate / 1e18 in postOp.
+type Quote struct {
+	Token        ethgo.Address `json:"token"`
+	ExchangeRate *hexutil.Big  `json:"exchangeRate"`
+	MaxGasCost   *hexutil.Big  `json:"maxGasCost"`
+	MaxTokenCost *hexutil.Big  `json:"maxTokenCost"`
+	ValidUntil   uint64        `json:"validUntil"`
+}
+
+// TokenQuoter sponsors ops that pay for gas in an ERC-20 token through the local
+// VerifyingPaymaster.
+type TokenQuoter struct {
+	Signer    *VerifyingSigner
+	Rates     RateSource
+	PostOpGas *big.Int
+
+	settlements *Settlements
+}
+
+func NewTokenQuoter(signer *VerifyingSigner, rates RateSource, postOpGas *big.Int, st *store.Store) *TokenQuoter {
+	if postOpGas == nil {
+		postOpGas = DefaultPostOpGas
+	}
+	return &TokenQuoter{Signer: signer, Rates: rates, PostOpGas: postOpGas, settlements: NewSettlements(st)}
+}
+
+func readUint(c *contract.Contract, method string) (*big.Int, error) {
+	res, err := c.Call(method, ethgo.Latest)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := res["0"].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("unexpected - expected *big.Int for %v return value", method)
+	}
+	return v, nil
+}
+
+// ReadPostOpGas reads POST_OP_GAS from the paymaster contract.
+func ReadPostOpGas(c *contract.Contract) (*big.Int, error) {
+	return readUint(c, "POST_OP_GAS")
+}
+
+// ReadVault reads the address token payments are sent to.
+func ReadVault(c *contract.Contract) (ethgo.Address, error) {
+	res, err := c.Call("vault", ethgo.Latest)
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	vault, ok := res["0"].(ethgo.Address)
+	if !ok {
+		return ethgo.ZeroAddress, fmt.Errorf("unexpected - expected address for vault return value")
+	}
+	return vault, nil
+}
+
+// Quote prices the op's max gas cost in token. The op's gas fields must be final.
+func (q *TokenQuoter) Quote(op *userop.UserOperation, token ethgo.Address) (*Quote, error) {
+	rate, err := q.Rates.Rate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	gas := new(big.Int).Mul(op.VerificationGasLimit, verificationGasMul)
+	gas.Add(gas, op.CallGasLimit)
+	gas.Add(gas, op.PreVerificationGas)
+	gas.Add(gas, q.PostOpGas)
+	maxGasCost := new(big.Int).Mul(gas, op.MaxFeePerGas)
+
+	// round up, the contract rounds down
+	maxTokenCost := new(big.Int).Mul(maxGasCost, rate)
+	maxTokenCost.Add(maxTokenCost, new(big.Int).Sub(ether, big.NewInt(1)))
+	maxTokenCost.Div(maxTokenCost, ether)
+
+	return &Quote{
+		Token:        token,
+		ExchangeRate: (*hexutil.Big)(rate),
+		MaxGasCost:   (*hexutil.Big)(maxGasCost),
+		MaxTokenCost: (*hexutil.Big)(maxTokenCost),
+	}, nil
+}
+
+// Sponsor signs the op for payment in the quoted token and records it for settlement
+// reconciliation.
+func (q *TokenQuoter) Sponsor(op *userop.UserOperation, quote *Quote, entryPoint ethgo.Address) (*userop.UserOperation, error) {
+	d := &SponsorData{ERC20Token: quote.Token, ExchangeRate: quote.ExchangeRate.ToInt()}
+	newOp, err := q.Signer.Sponsor(op, d)
+	if err != nil {
+		return nil, err
+	}
+	quote.ValidUntil = d.ValidUntil
+
+	opHash := newOp.GetUserOpHash(common.Address(entryPoint), q.Signer.ChainId)
+	if err = q.settlements.record(&Settlement{
+		OpHash:       opHash.String(),
+		Sender:       ethgo.Address(newOp.Sender),
+		Token:        quote.Token,
+		ExchangeRate: quote.ExchangeRate,
+		MaxTokenCost: quote.MaxTokenCost,
+		Status:       SettlementPending,
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    time.Unix(int64(d.ValidUntil), 0).UTC(),
+	}); err != nil {
+		// not worth failing the build over
+		log.Warnf("failed to record token settlement for op %v: %v", opHash.String(), err.Error())
+	}
+	return newOp, nil
+}
+
+func (q *TokenQuoter) Settlements() *Settlements {
+	return q.settlements
+}
@@ -0,0 +1,123 @@
+package paymaster
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testToken = ethgo.HexToAddress("0x58a2993A618Afee681DE23dECBCF535A58A080BA")
+var testVault = ethgo.HexToAddress("0x3bF27b2B37345D08a980E273564473bC3744bB1e")
+var testEntryPoint = ethgo.HexToAddress("0x5ff137d4b0fdcd49dca30c7cf57e578a026d2789")
+
+func TestRates(t *testing.T) {
+	rates, err := ParseStaticRates(testToken.String() + "=2000000, ")
+	require.NoError(t, err)
+	rate, err := rates.Rate(testToken)
+	require.NoError(t, err)
+	require.Equal(t, int64(2_000_000), rate.Int64())
+	_, err = rates.Rate(testVault)
+	require.Error(t, err)
+
+	_, err = ParseStaticRates(testToken.String() + "=-1")
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "prices.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"`+testToken.String()+`": "1000"}`), 0600))
+	fileRates, err := NewFileRates(path)
+	require.NoError(t, err)
+	rate, err = fileRates.Rate(testToken)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), rate.Int64())
+
+	// a broken update keeps the last good rate
+	require.NoError(t, os.WriteFile(path, []byte(`{"`), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	rate, err = fileRates.Rate(testToken)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), rate.Int64())
+}
+
+type fakeBundler struct {
+	receipts map[string]string
+}
+
+func (b *fakeBundler) CallContext(_ context.Context, result interface{}, method string, args ...interface{}) error {
+	receipt, ok := b.receipts[args[0].(string)]
+	if !ok {
+		receipt = "null"
+	}
+	return json.Unmarshal([]byte(receipt), result)
+}
+
+func TestTokenQuoteAndSettle(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	// 1 token unit per wei
+	rates := StaticRates{testToken: new(big.Int).Set(ether)}
+	q := NewTokenQuoter(makeTestSigner(t), rates, nil, st)
+
+	op, err := userop.New(testOpData)
+	require.NoError(t, err)
+	quote, err := q.Quote(op, testToken)
+	require.NoError(t, err)
+	gas := 3*0x6ddd0 + 0x11f80 + 0xd496 + DefaultPostOpGas.Int64()
+	require.Equal(t, new(big.Int).Mul(big.NewInt(gas), op.MaxFeePerGas), quote.MaxTokenCost.ToInt())
+
+	sponsored, err := q.Sponsor(op, quote, testEntryPoint)
+	require.NoError(t, err)
+	require.NotZero(t, quote.ValidUntil)
+	_, d, _, err := ParsePaymasterAndData(sponsored.PaymasterAndData)
+	require.NoError(t, err)
+	require.Equal(t, testToken, d.ERC20Token)
+
+	opHash := sponsored.GetUserOpHash(common.Address(testEntryPoint), q.Signer.ChainId).String()
+	pending, err := q.Settlements().Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, opHash, pending[0].OpHash)
+
+	sender := common.BytesToHash(sponsored.Sender.Bytes())
+	topic := common.BytesToHash(transferTopic)
+	receipt := map[string]any{
+		"success":       true,
+		"actualGasCost": "0x64",
+		"logs": []map[string]any{
+			// the op's own transfer of the token doesn't count
+			{"address": testToken.String(), "topics": []common.Hash{topic, sender, common.BytesToHash(testToken.Bytes())}, "data": "0x01"},
+			{"address": testToken.String(), "topics": []common.Hash{topic, sender, common.BytesToHash(testVault.Bytes())}, "data": "0x7b"},
+		},
+		"receipt": map[string]any{"transactionHash": common.Hash{1}.String()},
+	}
+	receiptJson, err := json.Marshal(receipt)
+	require.NoError(t, err)
+
+	bundler := &fakeBundler{receipts: map[string]string{}}
+	r := NewReconciler(q.Settlements(), bundler, testVault, 0)
+
+	// not landed yet
+	require.NoError(t, r.Reconcile(context.Background()))
+	settlement, found, err := q.Settlements().Get(opHash)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, SettlementPending, settlement.Status)
+
+	bundler.receipts[opHash] = string(receiptJson)
+	require.NoError(t, r.Reconcile(context.Background()))
+	settlement, _, err = q.Settlements().Get(opHash)
+	require.NoError(t, err)
+	require.Equal(t, SettlementSettled, settlement.Status)
+	require.Equal(t, int64(123), settlement.SettledAmount.ToInt().Int64())
+	require.Equal(t, int64(100), settlement.ActualGasCost.ToInt().Int64())
+}
@@ -0,0 +1,250 @@
+package paymaster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"github.com/umbracle/ethgo/contract"
+	"github.com/umbracle/ethgo/jsonrpc"
+	"math/big"
+	"time"
+)
+
+// paymasterAndData is paymaster(20) | abi.encode(validUntil, validAfter, erc20Token, exchangeRate)(128) | signature(65)
+const (
+	validTimestampOffset = 20
+	signatureOffset      = 148
+	signatureLength      = 65
+	PaymasterAndDataLen  = signatureOffset + signatureLength
+)
+
+var DefaultValidity = 10 * time.Minute
+
+var paymasterDataType = abi.MustNewType("tuple(uint48 validUntil, uint48 validAfter, address erc20Token, uint256 exchangeRate)")
+var hashDataType = abi.MustNewType("tuple(bytes pack, uint256 chainId, address paymaster, uint48 validUntil, uint48 validAfter, address erc20Token, uint256 exchangeRate)")
+
+// SponsorData is what the paymaster signs in addition to the op. A zero token means the
+// paymaster pays for gas itself, otherwise the sender pays in that token at
+// exchangeRate (token units per 1e18 wei).
+type SponsorData struct {
+	ValidUntil   uint64
+	ValidAfter   uint64
+	ERC20Token   ethgo.Address
+	ExchangeRate *big.Int
+}
+
+func (d *SponsorData) rate() *big.Int {
+	if d.ExchangeRate == nil {
+		return big.NewInt(0)
+	}
+	return d.ExchangeRate
+}
+
+func EncodePaymasterAndData(paymaster ethgo.Address, d *SponsorData, signature []byte) ([]byte, error) {
+	enc, err := abi.Encode(map[string]interface{}{
+		"validUntil":   d.ValidUntil,
+		"validAfter":   d.ValidAfter,
+		"erc20Token":   d.ERC20Token,
+		"exchangeRate": d.rate(),
+	}, paymasterDataType)
+	if err != nil {
+		return nil, err
+	}
+	ret := append(paymaster.Bytes(), enc...)
+	return append(ret, signature...), nil
+}
+
+func ParsePaymasterAndData(pnd []byte) (paymaster ethgo.Address, d *SponsorData, signature []byte, err error) {
+	if len(pnd) < signatureOffset {
+		err = fmt.Errorf("paymasterAndData too short: %v", len(pnd))
+		return
+	}
+	var decoded interface{}
+	if decoded, err = abi.Decode(paymasterDataType, pnd[validTimestampOffset:signatureOffset]); err != nil {
+		return
+	}
+	m, _ := decoded.(map[string]interface{})
+	validUntil, _ := m["validUntil"].(*big.Int)
+	validAfter, _ := m["validAfter"].(*big.Int)
+	if validUntil == nil || validAfter == nil {
+		err = fmt.Errorf("unexpected - invalid paymasterAndData timestamps")
+		return
+	}
+	d = &SponsorData{ValidUntil: validUntil.Uint64(), ValidAfter: validAfter.Uint64()}
+	d.ERC20Token, _ = m["erc20Token"].(ethgo.Address)
+	d.ExchangeRate, _ = m["exchangeRate"].(*big.Int)
+	paymaster = ethgo.BytesToAddress(pnd[:validTimestampOffset])
+	signature = pnd[signatureOffset:]
+	return
+}
+
+// pack mirrors the contract's assembly pack(): the calldata ABI encoding of the op up to,
+// but not including, paymasterAndData. The head still carries the offset of the
+// signature, so paymasterAndData must already have its final length.
+func pack(op *userop.UserOperation) ([]byte, error) {
+	packed := op.Pack()
+	// head word 9 is the offset of paymasterAndData
+	if len(packed) < 11*32 {
+		return nil, fmt.Errorf("unexpected - packed op too short")
+	}
+	pndOffset := binary.BigEndian.Uint64(packed[9*32+24 : 10*32])
+	if pndOffset > uint64(len(packed)) {
+		return nil, fmt.Errorf("unexpected - invalid paymasterAndData offset")
+	}
+	return packed[:pndOffset], nil
+}
+
+// GetHash computes VerifyingPaymaster.getHash locally.
+func GetHash(op *userop.UserOperation, chainId *big.Int, paymaster ethgo.Address, d *SponsorData) ([]byte, error) {
+	p, err := pack(op)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := abi.Encode(map[string]interface{}{
+		"pack":         p,
+		"chainId":      chainId,
+		"paymaster":    paymaster,
+		"validUntil":   d.ValidUntil,
+		"validAfter":   d.ValidAfter,
+		"erc20Token":   d.ERC20Token,
+		"exchangeRate": d.rate(),
+	}, hashDataType)
+	if err != nil {
+		return nil, err
+	}
+	return ethgo.Keccak256(enc), nil
+}
+
+// VerifyingSigner sponsors ops in-process by signing paymasterAndData with the
+// paymaster's verifier key, instead of asking an external paymaster service.
+type VerifyingSigner struct {
+	Paymaster ethgo.Address
+	ChainId   *big.Int
+	Verifier  chain.Signer
+	Validity  time.Duration
+
+	// when set, getHash is also called on chain, and a different result fails the sponsorship
+	contract *contract.Contract
+}
+
+func LoadPaymasterABI() (*abi.ABI, error) {
+	abiBytes, err := abiVerifyingPaymaster.ReadFile("abi/VerifyingPaymaster.json")
+	if err != nil {
+		return nil, err
+	}
+	return abi.NewABI(string(abiBytes))
+}
+
+// LoadContract binds the embedded VerifyingPaymaster ABI, with withKey as sender if set.
+func LoadContract(ec *jsonrpc.Client, addr ethgo.Address, withKey ethgo.Key) (*contract.Contract, error) {
+	theAbi, err := LoadPaymasterABI()
+	if err != nil {
+		return nil, err
+	}
+	opts := []contract.ContractOption{contract.WithJsonRPC(ec.Eth())}
+	if withKey != nil {
+		opts = append(opts, contract.WithSender(withKey))
+	}
+	return contract.NewContract(addr, theAbi, opts...), nil
+}
+
+func NewVerifyingSigner(paymaster ethgo.Address, chainId *big.Int, verifier chain.Signer, validity time.Duration) *VerifyingSigner {
+	if validity <= 0 {
+		validity = DefaultValidity
+	}
+	return &VerifyingSigner{Paymaster: paymaster, ChainId: chainId, Verifier: verifier, Validity: validity}
+}
+
+// WithCrossCheck makes the signer compare its local hash with getHash on chain, and
+// refuse to sign when they differ.
+func (s *VerifyingSigner) WithCrossCheck(ec *jsonrpc.Client) (err error) {
+	s.contract, err = LoadContract(ec, s.Paymaster, nil)
+	return
+}
+
+func (s *VerifyingSigner) onChainHash(op *userop.UserOperation, d *SponsorData) ([]byte, error) {
+	opMap, err := op.ToMap()
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.contract.Call("getHash", ethgo.Latest, opMap, d.ValidUntil, d.ValidAfter, d.ERC20Token, d.rate())
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := res["0"].([32]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected - expected bytes32 for getHash return value")
+	}
+	return hash[:], nil
+}
+
+// Hash returns the digest the verifier signs for op; the op must already carry a
+// paymasterAndData of the final length.
+func (s *VerifyingSigner) Hash(op *userop.UserOperation, d *SponsorData) (hash []byte, err error) {
+	if hash, err = GetHash(op, s.ChainId, s.Paymaster, d); err != nil {
+		return
+	}
+	if s.contract != nil {
+		var onChain []byte
+		if onChain, err = s.onChainHash(op, d); err != nil {
+			return
+		}
+		if !bytes.Equal(hash, onChain) {
+			return nil, fmt.Errorf("paymaster getHash mismatch: local %v, on chain %v", hexutil.Encode(hash), hexutil.Encode(onChain))
+		}
+	}
+	return
+}
+
+// Sponsor returns a copy of op with a signed paymasterAndData valid from now for the
+// signer's validity window.
+func (s *VerifyingSigner) Sponsor(op *userop.UserOperation, d *SponsorData) (*userop.UserOperation, error) {
+	if d == nil {
+		d = &SponsorData{}
+	}
+	if d.ValidUntil == 0 {
+		now := time.Now()
+		d.ValidAfter = uint64(now.Add(-time.Minute).Unix())
+		d.ValidUntil = uint64(now.Add(s.Validity).Unix())
+	}
+
+	newOp := *op
+	pnd, err := EncodePaymasterAndData(s.Paymaster, d, make([]byte, signatureLength))
+	if err != nil {
+		return nil, err
+	}
+	newOp.PaymasterAndData = pnd
+
+	hash, err := s.Hash(&newOp, d)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.Verifier.SignHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	copy(newOp.PaymasterAndData[signatureOffset:], sig)
+	return &newOp, nil
+}
+
+// RecoverVerifier returns the address that signed the op's paymasterAndData.
+func RecoverVerifier(op *userop.UserOperation, chainId *big.Int) (ethgo.Address, error) {
+	paymaster, d, signature, err := ParsePaymasterAndData(op.PaymasterAndData)
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	if len(signature) != signatureLength {
+		return ethgo.ZeroAddress, fmt.Errorf("invalid paymaster signature length: %v", len(signature))
+	}
+	hash, err := GetHash(op, chainId, paymaster, d)
+	if err != nil {
+		return ethgo.ZeroAddress, err
+	}
+	return crypto.Ecrecover(crypto.EthSignedMessageHash(hash), signature)
+}
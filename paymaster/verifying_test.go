@@ -0,0 +1,130 @@
+package paymaster
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/chain"
+	"github.com/oneness/erc-4337-api/crypto"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"github.com/umbracle/ethgo/jsonrpc"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testPaymaster = ethgo.HexToAddress("0xe93ECa6595fe94091DC1af46aac2A8b5D7990770")
+
+var testOpData = map[string]any{
+	"sender":               "0xfD6DD93dCc566f6E8C0A5FFb7322B1302c1d2CC0",
+	"nonce":                "0x0",
+	"initCode":             "0x9406cc6185a346906296840746125a0e449764545fbfb9cf0000000000000000000000003bf27b2b37345d08a980e273564473bc3744bb1e0000000000000000000000000000000000000000000000000000000000000001",
+	"callData":             "0xb61d27f600000000000000000000000058a2993a618afee681de23decbcf535a58a080ba000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000600000000000000000000000000000000000000000000000000000000000000044205c28780000000000000000000000003bf27b2b37345d08a980e273564473bc3744bb1e00000000000000000000000000000000000000000000000000000000000f424000000000000000000000000000000000000000000000000000000000",
+	"callGasLimit":         "0x11f80",
+	"verificationGasLimit": "0x6ddd0",
+	"preVerificationGas":   "0xd496",
+	"maxFeePerGas":         "0x1cd5348a15",
+	"maxPriorityFeePerGas": "0x0",
+	"paymasterAndData":     "0x",
+	"signature":            "0x00",
+}
+
+func makeTestSigner(t *testing.T) *VerifyingSigner {
+	sk, err := crypto.RandSK()
+	require.NoError(t, err)
+	return NewVerifyingSigner(testPaymaster, big.NewInt(80001), &chain.EcdsaKey{SK: sk}, 0)
+}
+
+func TestPaymasterAndDataEncoding(t *testing.T) {
+	d := &SponsorData{ValidUntil: 1697080306, ValidAfter: 0, ERC20Token: testPaymaster, ExchangeRate: big.NewInt(12345)}
+	pnd, err := EncodePaymasterAndData(testPaymaster, d, make([]byte, 65))
+	require.NoError(t, err)
+	require.Len(t, pnd, PaymasterAndDataLen)
+
+	paymaster, checkD, sig, err := ParsePaymasterAndData(pnd)
+	require.NoError(t, err)
+	require.Equal(t, testPaymaster, paymaster)
+	require.Equal(t, d.ValidUntil, checkD.ValidUntil)
+	require.Equal(t, d.ERC20Token, checkD.ERC20Token)
+	require.Equal(t, 0, d.ExchangeRate.Cmp(checkD.ExchangeRate))
+	require.Len(t, sig, 65)
+}
+
+func TestVerifyingSignerSponsor(t *testing.T) {
+	s := makeTestSigner(t)
+	op, err := userop.New(testOpData)
+	require.NoError(t, err)
+
+	sponsored, err := s.Sponsor(op, nil)
+	require.NoError(t, err)
+	require.Len(t, sponsored.PaymasterAndData, PaymasterAndDataLen)
+	require.Empty(t, op.PaymasterAndData, "the input op is left alone")
+
+	verifier, err := RecoverVerifier(sponsored, s.ChainId)
+	require.NoError(t, err)
+	require.Equal(t, s.Verifier.Address(), verifier)
+
+	// the owner signs after sponsorship - the account signature isn't covered
+	sponsored.Signature = make([]byte, 65)
+	verifier, err = RecoverVerifier(sponsored, s.ChainId)
+	require.NoError(t, err)
+	require.Equal(t, s.Verifier.Address(), verifier)
+
+	// but every gas field is
+	sponsored.CallGasLimit = new(big.Int).Add(sponsored.CallGasLimit, big.NewInt(1))
+	verifier, err = RecoverVerifier(sponsored, s.ChainId)
+	require.NoError(t, err)
+	require.NotEqual(t, s.Verifier.Address(), verifier)
+}
+
+var testOpType = abi.MustNewType("tuple(address sender, uint256 nonce, bytes initCode, bytes callData, uint256 callGasLimit, uint256 verificationGasLimit, uint256 preVerificationGas, uint256 maxFeePerGas, uint256 maxPriorityFeePerGas, bytes paymasterAndData, bytes signature)")
+
+// the digest of testOpData sponsored with the data in TestGetHashVector, on chain 80001;
+// pinned so a change to the packing shows up as a changed digest
+const testOpHash = "0xcc1a0149ba583d9647b8cc79a8ca688f621b4334fef07f5d943a5afda6b57abe"
+
+func TestGetHashVector(t *testing.T) {
+	op, err := userop.New(testOpData)
+	require.NoError(t, err)
+	d := &SponsorData{ValidUntil: 1697080306, ValidAfter: 1697079706, ERC20Token: testPaymaster, ExchangeRate: big.NewInt(12345)}
+	op.PaymasterAndData, err = EncodePaymasterAndData(testPaymaster, d, make([]byte, 65))
+	require.NoError(t, err)
+
+	// the contract's pack() is the op's calldata encoding up to paymasterAndData's length word
+	opMap, err := op.ToMap()
+	require.NoError(t, err)
+	encoded, err := testOpType.Encode(opMap)
+	require.NoError(t, err)
+	pndOffset := new(big.Int).SetBytes(encoded[9*32 : 10*32]).Int64()
+	p, err := pack(op)
+	require.NoError(t, err)
+	require.Equal(t, encoded[:pndOffset], p)
+
+	hash, err := GetHash(op, big.NewInt(80001), testPaymaster, d)
+	require.NoError(t, err)
+	require.Equal(t, testOpHash, hexutil.Encode(hash))
+}
+
+func TestVerifyingSignerCrossCheck(t *testing.T) {
+	// a node whose paymaster disagrees with the local hash
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id json.RawMessage `json:"id"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		_ = json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.Id, "result": hexutil.Encode(make([]byte, 32))})
+	}))
+	t.Cleanup(srv.Close)
+	ec, err := jsonrpc.NewClient(srv.URL)
+	require.NoError(t, err)
+
+	s := makeTestSigner(t)
+	require.NoError(t, s.WithCrossCheck(ec))
+	op, err := userop.New(testOpData)
+	require.NoError(t, err)
+	_, err = s.Sponsor(op, nil)
+	require.ErrorContains(t, err, "getHash mismatch")
+}
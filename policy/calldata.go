@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+)
+
+var executeMethod, _ = abi.NewMethod("function execute(address to, uint256 value, bytes data)")
+var executeBatchMethod, _ = abi.NewMethod("function executeBatch(address[] dest, bytes[] func)")
+
+// Call is one contract call made by a smart account on behalf of an op.
+type Call struct {
+	Target   ethgo.Address
+	Value    *big.Int
+	Selector []byte // empty for plain value transfers
+}
+
+func callSelector(data []byte) []byte {
+	if len(data) < 4 {
+		return nil
+	}
+	return data[:4]
+}
+
+func decodeArgs(m *abi.Method, callData []byte) (args map[string]interface{}, err error) {
+	var decoded interface{}
+	if decoded, err = abi.Decode(m.Inputs, callData[4:]); err != nil {
+		return
+	}
+	var ok bool
+	if args, ok = decoded.(map[string]interface{}); !ok {
+		err = fmt.Errorf("unexpected - decoded %v arguments are not a map", m.Name)
+	}
+	return
+}
+
+// DecodeCalls decodes the calls of SimpleAccount style 'execute' and 'executeBatch'
+// calldata. Empty calldata, as in cancelling ops, makes no calls.
+func DecodeCalls(callData []byte) (calls []Call, err error) {
+	if len(callData) == 0 {
+		return nil, nil
+	}
+	if len(callData) < 4 {
+		return nil, fmt.Errorf("calldata too short")
+	}
+
+	switch {
+	case bytes.Equal(callData[:4], executeMethod.ID()):
+		var args map[string]interface{}
+		if args, err = decodeArgs(executeMethod, callData); err != nil {
+			return
+		}
+		to, _ := args["to"].(ethgo.Address)
+		value, _ := args["value"].(*big.Int)
+		data, _ := args["data"].([]byte)
+		calls = append(calls, Call{Target: to, Value: value, Selector: callSelector(data)})
+
+	case bytes.Equal(callData[:4], executeBatchMethod.ID()):
+		var args map[string]interface{}
+		if args, err = decodeArgs(executeBatchMethod, callData); err != nil {
+			return
+		}
+		dests, _ := args["dest"].([]ethgo.Address)
+		funcs, _ := args["func"].([][]byte)
+		if len(dests) != len(funcs) {
+			return nil, fmt.Errorf("executeBatch length mismatch")
+		}
+		for i := range dests {
+			calls = append(calls, Call{Target: dests[i], Value: big.NewInt(0), Selector: callSelector(funcs[i])})
+		}
+
+	default:
+		err = fmt.Errorf("unsupported account call 0x%x", callData[:4])
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package policy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"time"
+)
+
+// Rejection is returned when an op is not eligible for sponsorship.
+type Rejection struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("sponsorship rejected by policy rule '%v': %v", r.Rule, r.Reason)
+}
+
+func reject(rule, format string, args ...any) *Rejection {
+	return &Rejection{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+var spendPrefix = "policy-spend/"
+
+// spend counters are kept in gwei so they fit an int64
+var gwei = big.NewInt(1_000_000_000)
+
+// with a paymaster the EntryPoint reserves the verification gas three times, for
+// validateUserOp, validatePaymasterUserOp and postOp
+var paymasterVerificationGasMul = big.NewInt(3)
+
+// MaxCost is the most wei an op can cost its paymaster.
+func MaxCost(op *userop.UserOperation) (gas, cost *big.Int) {
+	gas = new(big.Int).Mul(op.VerificationGasLimit, paymasterVerificationGasMul)
+	gas.Add(gas, op.CallGasLimit)
+	gas.Add(gas, op.PreVerificationGas)
+	cost = new(big.Int).Mul(gas, op.MaxFeePerGas)
+	return
+}
+
+// Engine decides whether ops may be sponsored, and tracks sponsored spend in the
+// local store.
+type Engine struct {
+	rules *rules
+	store *store.Store
+	now   func() time.Time
+}
+
+func NewEngine(p Policy, s *store.Store) (*Engine, error) {
+	r, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{rules: r, store: s, now: time.Now}, nil
+}
+
+func (e *Engine) checkCalls(op *userop.UserOperation) error {
+	if len(e.rules.targets) == 0 {
+		return nil
+	}
+	calls, err := DecodeCalls(op.CallData)
+	if err != nil {
+		return reject("allowedTargets", "can't decode calldata: %v", err.Error())
+	}
+	for _, call := range calls {
+		selectors, ok := e.rules.targets[call.Target]
+		if !ok {
+			return reject("allowedTargets", "target %v is not allowed", call.Target.String())
+		}
+		if selectors != nil && !selectors[hex.EncodeToString(call.Selector)] {
+			return reject("allowedTargets", "function 0x%x is not allowed on %v", call.Selector, call.Target.String())
+		}
+	}
+	return nil
+}
+
+type counter struct {
+	key   string
+	rule  string
+	limit *big.Int
+	ttl   time.Duration
+}
+
+func (e *Engine) counters(op *userop.UserOperation, owner ethgo.Address) (ret []counter) {
+	now := e.now()
+	add := func(rule, scope string, caps []spendCap) {
+		for _, c := range caps {
+			bucket := now.Unix() / int64(c.window.Seconds())
+			ret = append(ret, counter{
+				key:   fmt.Sprintf("%v%v/%v/%d/%d", spendPrefix, rule, scope, int64(c.window.Seconds()), bucket),
+				rule:  fmt.Sprintf("%v(%v)", rule, c.window),
+				limit: c.maxWei,
+				ttl:   2 * c.window,
+			})
+		}
+	}
+	add("senderCaps", op.Sender.String(), e.rules.senderCaps)
+	add("ownerCaps", owner.String(), e.rules.ownerCaps)
+	add("globalBudgets", "all", e.rules.globalBudgets)
+	return
+}
+
+// Reservation holds the spend booked for an op until it is known whether sponsorship
+// went through.
+type Reservation struct {
+	engine   *Engine
+	counters []counter
+	gwei     int64
+}
+
+// Release gives the reserved spend back, for ops that ended up not being sponsored.
+func (r *Reservation) Release() error {
+	if r == nil {
+		return nil
+	}
+	for _, c := range r.counters {
+		if _, err := r.engine.store.Incr(c.key, -r.gwei, c.ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reserve checks the op against the policy and books its max cost against every spend
+// cap. Returns a *Rejection if the op isn't eligible.
+func (e *Engine) Reserve(op *userop.UserOperation, owner ethgo.Address) (*Reservation, error) {
+	return e.reserve(op, owner, nil)
+}
+
+// ReserveReplacement is Reserve for an op replacing one at the same nonce, whose max
+// cost was booked when it was sponsored. Only what op may cost on top of that is booked.
+func (e *Engine) ReserveReplacement(op, replaced *userop.UserOperation, owner ethgo.Address) (*Reservation, error) {
+	return e.reserve(op, owner, replaced)
+}
+
+// costGwei is the op's max cost in gwei, rounded up.
+func costGwei(op *userop.UserOperation) *big.Int {
+	_, cost := MaxCost(op)
+	g := new(big.Int).Add(cost, new(big.Int).Sub(gwei, big.NewInt(1)))
+	return g.Div(g, gwei)
+}
+
+func (e *Engine) reserve(op *userop.UserOperation, owner ethgo.Address, replaced *userop.UserOperation) (res *Reservation, err error) {
+	gas, cost := MaxCost(op)
+	if e.rules.maxGasPerOp != nil && gas.Cmp(e.rules.maxGasPerOp) > 0 {
+		return nil, reject("maxGasPerOp", "op may use %v gas, limit is %v", gas.String(), e.rules.maxGasPerOp.String())
+	}
+	if err = e.checkCalls(op); err != nil {
+		return
+	}
+
+	delta := costGwei(op)
+	if replaced != nil {
+		delta.Sub(delta, costGwei(replaced))
+	}
+	if delta.Sign() <= 0 {
+		// nothing more than what's already booked
+		return &Reservation{engine: e}, nil
+	}
+	// the counters are int64, a cost that doesn't fit can't be booked
+	if !delta.IsInt64() {
+		return nil, reject("maxCost", "op may cost %v wei, more than any cap", cost.String())
+	}
+	res = &Reservation{engine: e, gwei: delta.Int64()}
+	deltaWei := new(big.Int).Mul(delta, gwei)
+
+	for _, c := range e.counters(op, owner) {
+		if deltaWei.Cmp(c.limit) > 0 {
+			_ = res.Release()
+			return nil, reject(c.rule, "op may cost %v wei, over the spend cap of %v wei", deltaWei.String(), c.limit.String())
+		}
+		var n int64
+		if n, err = e.store.Incr(c.key, res.gwei, c.ttl); err != nil {
+			_ = res.Release()
+			return nil, err
+		}
+		res.counters = append(res.counters, c)
+
+		spent := new(big.Int).Mul(big.NewInt(n), gwei)
+		if spent.Cmp(c.limit) > 0 {
+			_ = res.Release()
+			return nil, reject(c.rule, "spend cap of %v wei reached", c.limit.String())
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"errors"
+	"github.com/oneness/erc-4337-api/internal/testutil"
+	"github.com/oneness/erc-4337-api/replace"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testToken = ethgo.HexToAddress("0x58a2993A618Afee681DE23dECBCF535A58A080BA")
+var testSender = ethgo.HexToAddress("0xfD6DD93dCc566f6E8C0A5FFb7322B1302c1d2CC0")
+var testOwner = ethgo.HexToAddress("0x3bF27b2B37345D08a980E273564473bC3744bB1e")
+
+var testPolicyYaml = `
+maxGasPerOp: 1000000
+allowedTargets:
+  - address: "0x58a2993A618Afee681DE23dECBCF535A58A080BA"
+    selectors: ["transfer(address,uint256)", "0x095ea7b3"]
+senderCaps:
+  - window: 24h
+    maxWei: "2500000000000000"
+`
+
+func makeTestOp(t *testing.T, target ethgo.Address, method string, callGas int64) *userop.UserOperation {
+	op := testutil.MakeOp(t, testSender, testutil.ExecuteCallData(t, target, 0, method, testOwner, big.NewInt(1)))
+	op.CallGasLimit = big.NewInt(callGas)
+	return op
+}
+
+func makeTestEngine(t *testing.T) *Engine {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicyYaml), 0600))
+	p, err := LoadPolicy(path)
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, p.SenderCaps[0].Window)
+
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	e, err := NewEngine(p, st)
+	require.NoError(t, err)
+	return e
+}
+
+func requireRejection(t *testing.T, err error, rule string) {
+	var rejection *Rejection
+	require.True(t, errors.As(err, &rejection), "expected a rejection, got %v", err)
+	require.Equal(t, rule, rejection.Rule)
+}
+
+func TestPolicyTargets(t *testing.T) {
+	e := makeTestEngine(t)
+
+	_, err := e.Reserve(makeTestOp(t, testToken, "function transfer(address,uint256)", 200_000), testOwner)
+	require.NoError(t, err)
+
+	_, err = e.Reserve(makeTestOp(t, testToken, "function mint(address,uint256)", 200_000), testOwner)
+	requireRejection(t, err, "allowedTargets")
+
+	_, err = e.Reserve(makeTestOp(t, testOwner, "function transfer(address,uint256)", 200_000), testOwner)
+	requireRejection(t, err, "allowedTargets")
+
+	_, err = e.Reserve(makeTestOp(t, testToken, "function transfer(address,uint256)", 900_000), testOwner)
+	requireRejection(t, err, "maxGasPerOp")
+
+	// cancelling ops make no calls
+	cancel, err := replace.Cancel(makeTestOp(t, testToken, "function transfer(address,uint256)", 200_000), nil, replace.MinFeeBumpPercent)
+	require.NoError(t, err)
+	_, err = e.Reserve(cancel, testOwner)
+	require.NoError(t, err)
+}
+
+func TestPolicySpendCaps(t *testing.T) {
+	e := makeTestEngine(t)
+
+	// each op may cost (3*100k + 200k + 100k) gas * 1 gwei = 0.0006 eth, the cap is 0.0025
+	op := makeTestOp(t, testToken, "function transfer(address,uint256)", 200_000)
+	var reservations []*Reservation
+	for i := 0; i < 4; i++ {
+		res, err := e.Reserve(op, testOwner)
+		require.NoError(t, err)
+		reservations = append(reservations, res)
+	}
+	_, err := e.Reserve(op, testOwner)
+	requireRejection(t, err, "senderCaps(24h0m0s)")
+
+	// a replacement only books what its fee bump adds to the op it replaces
+	speedup, err := replace.Speedup(op, nil, replace.MinFeeBumpPercent)
+	require.NoError(t, err)
+	_, err = e.Reserve(speedup, testOwner)
+	requireRejection(t, err, "senderCaps(24h0m0s)")
+	_, err = e.ReserveReplacement(speedup, op, testOwner)
+	require.NoError(t, err)
+
+	// a released reservation frees up its spend
+	require.NoError(t, reservations[0].Release())
+	_, err = e.Reserve(op, testOwner)
+	require.NoError(t, err)
+
+	// caps are per window
+	e.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	_, err = e.Reserve(op, testOwner)
+	require.NoError(t, err)
+
+	// costs too big to count don't slip past the caps
+	huge := makeTestOp(t, testToken, "function transfer(address,uint256)", 200_000)
+	huge.MaxFeePerGas = new(big.Int).Lsh(big.NewInt(1), 200)
+	_, err = e.Reserve(huge, testOwner)
+	requireRejection(t, err, "maxCost")
+	huge.MaxFeePerGas = new(big.Int).Lsh(big.NewInt(1), 50)
+	_, err = e.Reserve(huge, testOwner)
+	requireRejection(t, err, "senderCaps(24h0m0s)")
+}
+
+func TestPolicyCapWindow(t *testing.T) {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	for window, ok := range map[time.Duration]bool{0: false, 500 * time.Millisecond: false, time.Second: true} {
+		_, err = NewEngine(Policy{SenderCaps: []SpendCap{{Window: window, MaxWei: "1"}}}, st)
+		if ok {
+			require.NoError(t, err, window)
+		} else {
+			require.Error(t, err, window)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// TargetRule allows calls to one contract, optionally limited to some functions. A
+// selector is either 4 bytes of hex or a function signature, e.g.
+// 'transfer(address,uint256)'.
+type TargetRule struct {
+	Address   string   `mapstructure:"address"`
+	Selectors []string `mapstructure:"selectors"`
+}
+
+// SpendCap limits sponsored gas (max cost, in wei) per fixed time window.
+type SpendCap struct {
+	Window time.Duration `mapstructure:"window"`
+	MaxWei string        `mapstructure:"maxWei"`
+}
+
+// Policy is the sponsorship policy as written in the policy file. Empty sections
+// don't restrict anything.
+type Policy struct {
+	MaxGasPerOp    uint64       `mapstructure:"maxGasPerOp"`
+	AllowedTargets []TargetRule `mapstructure:"allowedTargets"`
+	SenderCaps     []SpendCap   `mapstructure:"senderCaps"`
+	OwnerCaps      []SpendCap   `mapstructure:"ownerCaps"`
+	GlobalBudgets  []SpendCap   `mapstructure:"globalBudgets"`
+}
+
+// LoadPolicy reads a policy file in any format viper understands (yaml, json, toml).
+func LoadPolicy(path string) (p Policy, err error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err = v.ReadInConfig(); err != nil {
+		return
+	}
+	err = v.Unmarshal(&p)
+	return
+}
+
+type spendCap struct {
+	window time.Duration
+	maxWei *big.Int
+}
+
+// compiled policy with parsed addresses, selectors and amounts
+type rules struct {
+	maxGasPerOp *big.Int
+	// target -> allowed selectors, nil for any; empty map when any target is allowed
+	targets       map[ethgo.Address]map[string]bool
+	senderCaps    []spendCap
+	ownerCaps     []spendCap
+	globalBudgets []spendCap
+}
+
+// ParseSelector returns a function selector, given as 4 byte hex or as a signature
+// such as "transfer(address,uint256)", as unprefixed hex.
+func ParseSelector(s string) (string, error) {
+	if strings.Contains(s, "(") {
+		return hex.EncodeToString(ethgo.Keccak256([]byte(s))[:4]), nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(b) != 4 {
+		return "", fmt.Errorf("invalid selector '%v'", s)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// compileCaps parses the caps. Spend is bucketed by whole seconds of the window, so
+// windows under a second are refused.
+func compileCaps(name string, caps []SpendCap) (ret []spendCap, err error) {
+	for _, c := range caps {
+		maxWei, ok := new(big.Int).SetString(c.MaxWei, 10)
+		if !ok || c.Window < time.Second {
+			return nil, fmt.Errorf("invalid %v entry: window '%v', maxWei '%v'", name, c.Window, c.MaxWei)
+		}
+		ret = append(ret, spendCap{window: c.Window, maxWei: maxWei})
+	}
+	return
+}
+
+func (p Policy) compile() (r *rules, err error) {
+	r = &rules{targets: make(map[ethgo.Address]map[string]bool)}
+	if p.MaxGasPerOp != 0 {
+		r.maxGasPerOp = new(big.Int).SetUint64(p.MaxGasPerOp)
+	}
+
+	for _, t := range p.AllowedTargets {
+		if !strings.HasPrefix(t.Address, "0x") || len(t.Address) != len(ethgo.ZeroAddress.String()) {
+			return nil, fmt.Errorf("invalid target address '%v'", t.Address)
+		}
+		var selectors map[string]bool
+		if len(t.Selectors) != 0 {
+			selectors = make(map[string]bool)
+			for _, s := range t.Selectors {
+				var sel string
+				if sel, err = ParseSelector(s); err != nil {
+					return nil, err
+				}
+				selectors[sel] = true
+			}
+		}
+		r.targets[ethgo.HexToAddress(t.Address)] = selectors
+	}
+
+	if r.senderCaps, err = compileCaps("senderCaps", p.SenderCaps); err != nil {
+		return
+	}
+	if r.ownerCaps, err = compileCaps("ownerCaps", p.OwnerCaps); err != nil {
+		return
+	}
+	r.globalBudgets, err = compileCaps("globalBudgets", p.GlobalBudgets)
+	return
+}
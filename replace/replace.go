@@ -0,0 +1,68 @@
+// Package replace builds replacements for ops stuck in the mempool, at the same sender
+// and nonce with the fees raised enough for a bundler to accept them.
+package replace
+
+import (
+	"fmt"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"math/big"
+)
+
+// MinFeeBumpPercent is how much bundlers require a replacement op to raise both
+// maxFeePerGas and maxPriorityFeePerGas by, unless they're configured otherwise.
+const MinFeeBumpPercent = 10
+
+// BumpFee returns fee raised by percent, rounded up so small fees still go up.
+func BumpFee(fee *big.Int, percent int64) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+percent))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+// Replaces returns an error unless op raises both fees of prev by at least percent.
+func Replaces(prev, op *userop.UserOperation, percent int64) error {
+	if op.MaxFeePerGas.Cmp(BumpFee(prev.MaxFeePerGas, percent)) < 0 ||
+		op.MaxPriorityFeePerGas.Cmp(BumpFee(prev.MaxPriorityFeePerGas, percent)) < 0 {
+		return fmt.Errorf("a replacement op must raise maxFeePerGas and maxPriorityFeePerGas by at least %v%%", percent)
+	}
+	return nil
+}
+
+// Speedup returns a copy of op at the same sender and nonce with both its fees raised
+// by bumpPercent, the minimum the bundler accepts for a replacement, and maxFeePerGas
+// raised to gasPrice if that's higher. The copy is unsigned and unsponsored.
+func Speedup(op *userop.UserOperation, gasPrice *big.Int, bumpPercent int64) (*userop.UserOperation, error) {
+	opMap, err := op.ToMap()
+	if err != nil {
+		return nil, err
+	}
+	newOp, err := userop.New(opMap)
+	if err != nil {
+		return nil, err
+	}
+	newOp.MaxFeePerGas = BumpFee(op.MaxFeePerGas, bumpPercent)
+	if gasPrice != nil && gasPrice.Cmp(newOp.MaxFeePerGas) > 0 {
+		newOp.MaxFeePerGas = new(big.Int).Set(gasPrice)
+	}
+	// the max fee is raised to the priority fee rather than capping it, which would
+	// leave the priority fee short of its bump
+	newOp.MaxPriorityFeePerGas = BumpFee(op.MaxPriorityFeePerGas, bumpPercent)
+	if newOp.MaxPriorityFeePerGas.Cmp(newOp.MaxFeePerGas) > 0 {
+		newOp.MaxFeePerGas = new(big.Int).Set(newOp.MaxPriorityFeePerGas)
+	}
+	newOp.PaymasterAndData = []byte{}
+	newOp.Signature = []byte{0}
+	return newOp, nil
+}
+
+// Cancel returns a replacement for op that does nothing: the entry point skips the
+// call of an op without call data. The account is still deployed if op would have
+// deployed it.
+func Cancel(op *userop.UserOperation, gasPrice *big.Int, bumpPercent int64) (*userop.UserOperation, error) {
+	newOp, err := Speedup(op, gasPrice, bumpPercent)
+	if err != nil {
+		return nil, err
+	}
+	newOp.CallData = []byte{}
+	return newOp, nil
+}
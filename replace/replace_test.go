@@ -0,0 +1,68 @@
+package replace
+
+import (
+	"github.com/oneness/erc-4337-api/internal/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"testing"
+)
+
+var testSender = ethgo.HexToAddress("0xfD6DD93dCc566f6E8C0A5FFb7322B1302c1d2CC0")
+var testToken = ethgo.HexToAddress("0x58a2993A618Afee681DE23dECBCF535A58A080BA")
+
+func TestBumpFee(t *testing.T) {
+	require.Equal(t, int64(110), BumpFee(big.NewInt(100), MinFeeBumpPercent).Int64())
+	require.Equal(t, int64(125), BumpFee(big.NewInt(100), 25).Int64())
+	// rounded up, so tiny fees still rise
+	require.Equal(t, int64(2), BumpFee(big.NewInt(1), MinFeeBumpPercent).Int64())
+	require.Equal(t, int64(0), BumpFee(big.NewInt(0), MinFeeBumpPercent).Int64())
+}
+
+func TestSpeedup(t *testing.T) {
+	op := testutil.MakeOp(t, testSender, testutil.ExecuteCallData(t, testToken, 0, "function transfer(address,uint256)", testSender, big.NewInt(1)))
+	op.PaymasterAndData = testToken.Bytes()
+
+	newOp, err := Speedup(op, nil, MinFeeBumpPercent)
+	require.NoError(t, err)
+	require.NoError(t, Replaces(op, newOp, MinFeeBumpPercent))
+	require.Equal(t, int64(1_100_000_000), newOp.MaxFeePerGas.Int64())
+	require.Equal(t, int64(1_100_000_000), newOp.MaxPriorityFeePerGas.Int64())
+	require.Zero(t, op.Nonce.Cmp(newOp.Nonce))
+	require.Equal(t, op.CallData, newOp.CallData)
+	require.Empty(t, newOp.PaymasterAndData)
+	// the original is left alone
+	require.Equal(t, int64(1_000_000_000), op.MaxFeePerGas.Int64())
+
+	// a higher gas price wins
+	newOp, err = Speedup(op, big.NewInt(3_000_000_000), MinFeeBumpPercent)
+	require.NoError(t, err)
+	require.Equal(t, int64(3_000_000_000), newOp.MaxFeePerGas.Int64())
+	require.Equal(t, int64(1_100_000_000), newOp.MaxPriorityFeePerGas.Int64())
+
+	// the bundler's bump is used, and the max fee is raised so the priority fee
+	// keeps all of it
+	op.MaxFeePerGas = big.NewInt(1_000_000_000)
+	op.MaxPriorityFeePerGas = big.NewInt(1_000_000_000)
+	newOp, err = Speedup(op, big.NewInt(900_000_000), 25)
+	require.NoError(t, err)
+	require.NoError(t, Replaces(op, newOp, 25))
+	require.Equal(t, int64(1_250_000_000), newOp.MaxFeePerGas.Int64())
+	require.Equal(t, int64(1_250_000_000), newOp.MaxPriorityFeePerGas.Int64())
+	op.MaxPriorityFeePerGas = big.NewInt(2_000_000_000)
+	newOp, err = Speedup(op, nil, MinFeeBumpPercent)
+	require.NoError(t, err)
+	require.NoError(t, Replaces(op, newOp, MinFeeBumpPercent))
+	require.Equal(t, int64(2_200_000_000), newOp.MaxFeePerGas.Int64())
+	require.Equal(t, newOp.MaxFeePerGas, newOp.MaxPriorityFeePerGas)
+	require.Error(t, Replaces(op, op, MinFeeBumpPercent))
+}
+
+func TestCancel(t *testing.T) {
+	op := testutil.MakeOp(t, testSender, testutil.ExecuteCallData(t, testToken, 0, "function transfer(address,uint256)", testSender, big.NewInt(1)))
+	newOp, err := Cancel(op, nil, MinFeeBumpPercent)
+	require.NoError(t, err)
+	require.Empty(t, newOp.CallData)
+	require.Zero(t, op.Nonce.Cmp(newOp.Nonce))
+	require.Equal(t, int64(1_100_000_000), newOp.MaxFeePerGas.Int64())
+}
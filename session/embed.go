@@ -0,0 +1,8 @@
+package session
+
+import (
+	"embed"
+)
+
+//go:embed abi/ISessionKeyPlugin.json
+var abiSessionKeyPlugin embed.FS
@@ -0,0 +1,370 @@
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/policy"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/umbracle/ethgo"
+	"github.com/umbracle/ethgo/abi"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const sessionPrefix = "session/"
+
+// sessions are kept a while after they expire, so lookups can say why they failed
+var expiredTTL = 7 * 24 * time.Hour
+
+var maxUint256 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Scope is what a session key may do: call the targets, with one of the selectors
+// if any are set, between ValidAfter and ValidUntil, sending at most SpendCap wei
+// of native value in total.
+type Scope struct {
+	ValidAfter time.Time       `json:"validAfter"`
+	ValidUntil time.Time       `json:"validUntil"`
+	Targets    []ethgo.Address `json:"targets"`
+	// 4 byte hex, or function signatures such as "transfer(address,uint256)"
+	Selectors []string `json:"selectors,omitempty"`
+	// unlimited when nil
+	SpendCap *hexutil.Big `json:"spendCap,omitempty"`
+}
+
+// a session is pending until the op enabling its key on chain is included
+const (
+	StatusPending = "pending"
+	StatusActive  = "active"
+)
+
+type Session struct {
+	Account   ethgo.Address `json:"account"`
+	Owner     ethgo.Address `json:"owner"`
+	Key       ethgo.Address `json:"key"`
+	Scope     Scope         `json:"scope"`
+	Spent     *hexutil.Big  `json:"spent"`
+	CreatedAt time.Time     `json:"createdAt"`
+	RevokedAt *time.Time    `json:"revokedAt,omitempty"`
+
+	Status string `json:"status"`
+	// hash of the op enabling the key, set once it's built
+	EnableOpHash string `json:"enableOpHash,omitempty"`
+}
+
+// Rejection is an op outside its session key's scope.
+type Rejection struct {
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return "session key rejected: " + r.Reason
+}
+
+func reject(format string, args ...any) *Rejection {
+	return &Rejection{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Manager records session keys and checks ops signed by them.
+type Manager struct {
+	plugin ethgo.Address
+	// the plugin's enableSessionKey, called by the enabling op
+	enable *abi.Method
+	store  *store.Store
+	now    func() time.Time
+
+	// serializes session updates
+	mu sync.Mutex
+}
+
+// LoadPluginABI returns the ABI of the session key plugin the accounts install.
+func LoadPluginABI() (*abi.ABI, error) {
+	abiBytes, err := abiSessionKeyPlugin.ReadFile("abi/ISessionKeyPlugin.json")
+	if err != nil {
+		return nil, err
+	}
+	return abi.NewABI(string(abiBytes))
+}
+
+func NewManager(plugin ethgo.Address, st *store.Store) (*Manager, error) {
+	pluginAbi, err := LoadPluginABI()
+	if err != nil {
+		return nil, err
+	}
+	enable := pluginAbi.GetMethod("enableSessionKey")
+	if enable == nil {
+		return nil, fmt.Errorf("the session key plugin ABI has no enableSessionKey")
+	}
+	return &Manager{plugin: plugin, enable: enable, store: st, now: time.Now}, nil
+}
+
+func (m *Manager) Plugin() ethgo.Address {
+	return m.plugin
+}
+
+func sessionKey(account, key ethgo.Address) string {
+	return sessionPrefix + account.String() + "/" + key.String()
+}
+
+func (m *Manager) put(s *Session) error {
+	ttl := s.Scope.ValidUntil.Add(expiredTTL).Sub(m.now())
+	return m.store.PutWithTTL(sessionKey(s.Account, s.Key), s, ttl)
+}
+
+// Register records a pending session key for the account, replacing any previous one
+// for the same key, which is returned as prev. The spend booked against a previous
+// session carries over, so re-registering doesn't reset the cap.
+func (m *Manager) Register(account, owner, key ethgo.Address, scope Scope) (s, prev *Session, err error) {
+	if key == ethgo.ZeroAddress {
+		return nil, nil, fmt.Errorf("missing session key")
+	}
+	if !scope.ValidUntil.After(m.now()) || !scope.ValidUntil.After(scope.ValidAfter) {
+		return nil, nil, fmt.Errorf("the session must end in the future and after it starts")
+	}
+	if len(scope.Targets) == 0 {
+		return nil, nil, fmt.Errorf("a session needs at least one target")
+	}
+	for i, sel := range scope.Selectors {
+		if scope.Selectors[i], err = policy.ParseSelector(sel); err != nil {
+			return nil, nil, err
+		}
+	}
+	if scope.SpendCap != nil && scope.SpendCap.ToInt().Sign() < 0 {
+		return nil, nil, fmt.Errorf("the spend cap can't be negative")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, found, err := m.Get(account, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	spent := new(big.Int)
+	if !found {
+		prev = nil
+	} else if prev.Spent != nil {
+		spent.Set(prev.Spent.ToInt())
+	}
+
+	s = &Session{
+		Account:   account,
+		Owner:     owner,
+		Key:       key,
+		Scope:     scope,
+		Spent:     (*hexutil.Big)(spent),
+		CreatedAt: m.now().UTC(),
+		Status:    StatusPending,
+	}
+	if err = m.put(s); err != nil {
+		return nil, nil, err
+	}
+	return s, prev, nil
+}
+
+// Restore undoes the registration of s: prev, the session it replaced, is put back, or
+// the key forgotten when there was none. Nothing changes if s was registered over since.
+func (m *Manager) Restore(s, prev *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, found, err := m.Get(s.Account, s.Key)
+	if err != nil || !found || !cur.CreatedAt.Equal(s.CreatedAt) {
+		return err
+	}
+	if prev != nil {
+		return m.put(prev)
+	}
+	return m.store.Delete(sessionKey(s.Account, s.Key))
+}
+
+// update applies fn to the stored session of key on the account.
+func (m *Manager) update(account, key ethgo.Address, fn func(s *Session) error) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, found, err := m.Get(account, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, reject("no session key %v for %v", key.String(), account.String())
+	}
+	if err = fn(s); err != nil {
+		return nil, err
+	}
+	return s, m.put(s)
+}
+
+// SetEnableOp records the hash of the op enabling the pending session's key.
+func (m *Manager) SetEnableOp(account, key ethgo.Address, opHash string) (*Session, error) {
+	return m.update(account, key, func(s *Session) error {
+		if s.Status != StatusPending {
+			return fmt.Errorf("the session key %v is already enabled", key.String())
+		}
+		s.EnableOpHash = opHash
+		return nil
+	})
+}
+
+// Activate marks the session active once its enabling op, opHash, is included.
+func (m *Manager) Activate(account, key ethgo.Address, opHash string) (*Session, error) {
+	return m.update(account, key, func(s *Session) error {
+		// re-registered meanwhile, and waiting for another op
+		if s.Status == StatusPending && s.EnableOpHash != opHash {
+			return reject("the session key is waiting for op %v to be included", s.EnableOpHash)
+		}
+		s.Status = StatusActive
+		return nil
+	})
+}
+
+// EnableData is the call to the plugin that enables the session key on chain,
+// for the account to execute.
+func (m *Manager) EnableData(s *Session) ([]byte, error) {
+	var selectors [][4]byte
+	for _, sel := range s.Scope.Selectors {
+		var b [4]byte
+		selBytes, _ := hex.DecodeString(sel)
+		copy(b[:], selBytes)
+		selectors = append(selectors, b)
+	}
+	spendCap := maxUint256
+	if s.Scope.SpendCap != nil {
+		spendCap = s.Scope.SpendCap.ToInt()
+	}
+	return m.enable.Encode([]interface{}{
+		s.Key,
+		uint64(s.Scope.ValidAfter.Unix()),
+		uint64(s.Scope.ValidUntil.Unix()),
+		s.Scope.Targets,
+		selectors,
+		spendCap,
+	})
+}
+
+// Get returns the session of key on the account.
+func (m *Manager) Get(account, key ethgo.Address) (s *Session, found bool, err error) {
+	s = &Session{}
+	found, err = m.store.Get(sessionKey(account, key), s)
+	return
+}
+
+// List returns the account's sessions.
+func (m *Manager) List(account ethgo.Address) (sessions []*Session, err error) {
+	err = m.store.List(sessionPrefix+account.String()+"/", func(_ string, val []byte) error {
+		s := &Session{}
+		if err := json.Unmarshal(val, s); err != nil {
+			return err
+		}
+		sessions = append(sessions, s)
+		return nil
+	})
+	return
+}
+
+// Revoke stops the server accepting the key; it stays enabled on chain until the
+// owner disables it there.
+func (m *Manager) Revoke(account, key ethgo.Address) error {
+	_, err := m.update(account, key, func(s *Session) error {
+		now := m.now().UTC()
+		s.RevokedAt = &now
+		return nil
+	})
+	return err
+}
+
+// check returns the native value the op sends, or a *Rejection if it's outside the
+// session's scope.
+func (m *Manager) check(s *Session, op *userop.UserOperation) (*big.Int, error) {
+	now := m.now()
+	switch {
+	case s.RevokedAt != nil:
+		return nil, reject("the session key was revoked")
+	case s.Status == StatusPending:
+		return nil, reject("the session key isn't enabled on chain yet")
+	case now.Before(s.Scope.ValidAfter):
+		return nil, reject("the session starts at %v", s.Scope.ValidAfter.Format(time.RFC3339))
+	case !now.Before(s.Scope.ValidUntil):
+		return nil, reject("the session expired at %v", s.Scope.ValidUntil.Format(time.RFC3339))
+	}
+	if len(op.InitCode) != 0 {
+		return nil, reject("session keys can't deploy the account")
+	}
+
+	calls, err := policy.DecodeCalls(op.CallData)
+	if err != nil {
+		return nil, reject("can't decode the op's calls: %v", err.Error())
+	}
+	value := new(big.Int)
+	for _, call := range calls {
+		allowed := false
+		for _, target := range s.Scope.Targets {
+			allowed = allowed || target == call.Target
+		}
+		if !allowed {
+			return nil, reject("target %v is not in the session's scope", call.Target.String())
+		}
+		if len(s.Scope.Selectors) != 0 {
+			allowed = false
+			for _, sel := range s.Scope.Selectors {
+				allowed = allowed || sel == hex.EncodeToString(call.Selector)
+			}
+			if !allowed {
+				return nil, reject("function 0x%x is not in the session's scope", call.Selector)
+			}
+		}
+		if call.Value != nil {
+			value.Add(value, call.Value)
+		}
+	}
+	if s.Scope.SpendCap != nil {
+		total := new(big.Int).Add(s.Spent.ToInt(), value)
+		if total.Cmp(s.Scope.SpendCap.ToInt()) > 0 {
+			return nil, reject("the op sends %v wei, the session has %v of its %v wei cap left", value.String(),
+				new(big.Int).Sub(s.Scope.SpendCap.ToInt(), s.Spent.ToInt()).String(), s.Scope.SpendCap.ToInt().String())
+		}
+	}
+	return value, nil
+}
+
+// Check returns a *Rejection if the op is outside the session's scope.
+func (m *Manager) Check(s *Session, op *userop.UserOperation) error {
+	_, err := m.check(s, op)
+	return err
+}
+
+// Spend checks the op, then books the value it sends against the session's cap.
+// If the op then isn't sent, Refund gives the value back.
+func (m *Manager) Spend(account, key ethgo.Address, op *userop.UserOperation) (*Session, error) {
+	return m.update(account, key, func(s *Session) error {
+		value, err := m.check(s, op)
+		if err != nil {
+			return err
+		}
+		s.Spent = (*hexutil.Big)(new(big.Int).Add(s.Spent.ToInt(), value))
+		return nil
+	})
+}
+
+// Refund takes the value of an op that wasn't sent off the session's spend.
+func (m *Manager) Refund(account, key ethgo.Address, op *userop.UserOperation) error {
+	calls, err := policy.DecodeCalls(op.CallData)
+	if err != nil {
+		return err
+	}
+	_, err = m.update(account, key, func(s *Session) error {
+		spent := new(big.Int).Set(s.Spent.ToInt())
+		for _, call := range calls {
+			if call.Value != nil {
+				spent.Sub(spent, call.Value)
+			}
+		}
+		if spent.Sign() < 0 {
+			spent.SetInt64(0)
+		}
+		s.Spent = (*hexutil.Big)(spent)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"errors"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/oneness/erc-4337-api/internal/testutil"
+	"github.com/oneness/erc-4337-api/store"
+	"github.com/stackup-wallet/stackup-bundler/pkg/userop"
+	"github.com/stretchr/testify/require"
+	"github.com/umbracle/ethgo"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var testPlugin = ethgo.HexToAddress("0x7a9f6C2a4b6bD0Bd7B2f0D0fA3e2C6E6d8b5f0c1")
+var testToken = ethgo.HexToAddress("0x58a2993A618Afee681DE23dECBCF535A58A080BA")
+var testAccount = ethgo.HexToAddress("0xfD6DD93dCc566f6E8C0A5FFb7322B1302c1d2CC0")
+var testOwner = ethgo.HexToAddress("0x3bF27b2B37345D08a980E273564473bC3744bB1e")
+var testKey = ethgo.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+
+func makeTestOp(t *testing.T, target ethgo.Address, method string, value int64) *userop.UserOperation {
+	return testutil.MakeOp(t, testAccount, testutil.ExecuteCallData(t, target, value, method, testOwner, big.NewInt(1)))
+}
+
+func makeTestManager(t *testing.T) *Manager {
+	st, err := store.Open("")
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+	m, err := NewManager(testPlugin, st)
+	require.NoError(t, err)
+	return m
+}
+
+func requireRejection(t *testing.T, err error) {
+	var rejection *Rejection
+	require.True(t, errors.As(err, &rejection), "expected a rejection, got %v", err)
+}
+
+func TestSessionScope(t *testing.T) {
+	m := makeTestManager(t)
+	now := time.Now()
+	s, prev, err := m.Register(testAccount, testOwner, testKey, Scope{
+		ValidAfter: now.Add(-time.Minute),
+		ValidUntil: now.Add(time.Hour),
+		Targets:    []ethgo.Address{testToken},
+		Selectors:  []string{"transfer(address,uint256)"},
+		SpendCap:   (*hexutil.Big)(big.NewInt(15)),
+	})
+	require.NoError(t, err)
+	require.Nil(t, prev)
+	require.Equal(t, []string{"a9059cbb"}, s.Scope.Selectors)
+
+	data, err := m.EnableData(s)
+	require.NoError(t, err)
+	require.Equal(t, ethgo.Keccak256([]byte("enableSessionKey(address,uint48,uint48,address[],bytes4[],uint256)"))[:4], data[:4])
+
+	// pending until the enabling op is included
+	transfer := "function transfer(address,uint256)"
+	requireRejection(t, m.Check(s, makeTestOp(t, testToken, transfer, 10)))
+	_, err = m.SetEnableOp(testAccount, testKey, "0x01")
+	require.NoError(t, err)
+	_, err = m.Activate(testAccount, testKey, "0x02")
+	requireRejection(t, err)
+	s, err = m.Activate(testAccount, testKey, "0x01")
+	require.NoError(t, err)
+
+	require.NoError(t, m.Check(s, makeTestOp(t, testToken, transfer, 10)))
+	requireRejection(t, m.Check(s, makeTestOp(t, testToken, "function approve(address,uint256)", 0)))
+	requireRejection(t, m.Check(s, makeTestOp(t, testOwner, transfer, 0)))
+	requireRejection(t, m.Check(s, makeTestOp(t, testToken, transfer, 20)))
+
+	// spends add up against the cap
+	_, err = m.Spend(testAccount, testKey, makeTestOp(t, testToken, transfer, 10))
+	require.NoError(t, err)
+	_, err = m.Spend(testAccount, testKey, makeTestOp(t, testToken, transfer, 10))
+	requireRejection(t, err)
+	s, err = m.Spend(testAccount, testKey, makeTestOp(t, testToken, transfer, 5))
+	require.NoError(t, err)
+	require.Equal(t, int64(15), s.Spent.ToInt().Int64())
+
+	// ops that weren't sent are refunded
+	require.NoError(t, m.Refund(testAccount, testKey, makeTestOp(t, testToken, transfer, 5)))
+	s, _, err = m.Get(testAccount, testKey)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), s.Spent.ToInt().Int64())
+
+	// re-registering keeps the spend, and waits for the new enabling op
+	s, prev, err = m.Register(testAccount, testOwner, testKey, s.Scope)
+	require.NoError(t, err)
+	require.Equal(t, StatusPending, s.Status)
+	require.Equal(t, StatusActive, prev.Status)
+	require.Equal(t, int64(10), s.Spent.ToInt().Int64())
+
+	// a registration without an enabling op is undone
+	require.NoError(t, m.Restore(s, prev))
+	restored, _, err := m.Get(testAccount, testKey)
+	require.NoError(t, err)
+	require.Equal(t, StatusActive, restored.Status)
+	s, _, err = m.Register(testAccount, testOwner, testKey, s.Scope)
+	require.NoError(t, err)
+	_, err = m.SetEnableOp(testAccount, testKey, "0x03")
+	require.NoError(t, err)
+	s, err = m.Activate(testAccount, testKey, "0x03")
+	require.NoError(t, err)
+
+	// a new key is forgotten again
+	other := ethgo.HexToAddress("0x00000000000000000000000000000000000000cc")
+	otherSession, prev, err := m.Register(testAccount, testOwner, other, s.Scope)
+	require.NoError(t, err)
+	require.NoError(t, m.Restore(otherSession, prev))
+	_, found, err := m.Get(testAccount, other)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	sessions, err := m.List(testAccount)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	// expired sessions and revoked keys are rejected
+	m.now = func() time.Time { return now.Add(2 * time.Hour) }
+	requireRejection(t, m.Check(s, makeTestOp(t, testToken, transfer, 0)))
+	m.now = time.Now
+	require.NoError(t, m.Revoke(testAccount, testKey))
+	_, err = m.Spend(testAccount, testKey, makeTestOp(t, testToken, transfer, 0))
+	requireRejection(t, err)
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dgraph-io/badger/v3"
+	"strconv"
+	"time"
+)
+
+// Store is the server's local key/value store - a thin JSON layer over badger. Keys are
+// namespaced by a prefix per subsystem, e.g. 'apikey/'.
+type Store struct {
+	db *badger.DB
+}
+
+// Open opens (or creates) the store in dir. An empty dir gives an in-memory store.
+func Open(dir string) (*Store, error) {
+	opts := badger.DefaultOptions(dir)
+	if len(dir) == 0 {
+		opts.InMemory = true
+	}
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// DB exposes the underlying badger instance for components (like the stackup mempool)
+// that manage their own keys.
+func (s *Store) DB() *badger.DB {
+	return s.db
+}
+
+func (s *Store) Put(key string, v any) error {
+	return s.PutWithTTL(key, v, 0)
+}
+
+// PutWithTTL stores v as JSON, expiring after ttl if it is positive.
+func (s *Store) PutWithTTL(key string, v any, ttl time.Duration) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry([]byte(key), val)
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		return txn.SetEntry(e)
+	})
+}
+
+// Get decodes the value at key into v, returning false if there is none.
+func (s *Store) Get(key string, v any) (found bool, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, v)
+		})
+	})
+	return
+}
+
+func (s *Store) Delete(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+// List calls fn with every key and raw JSON value under prefix, in key order.
+func (s *Store) List(prefix string, fn func(key string, val []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			item := it.Item()
+			if err := item.Value(func(val []byte) error {
+				return fn(string(item.Key()), val)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Incr atomically adds delta to the integer counter at key and returns the new value.
+// A new counter expires after ttl if it is positive.
+func (s *Store) Incr(key string, delta int64, ttl time.Duration) (n int64, err error) {
+	for {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			n = 0
+			e := badger.NewEntry([]byte(key), nil)
+			item, err := txn.Get([]byte(key))
+			if err == nil {
+				if err = item.Value(func(val []byte) (err error) {
+					n, err = strconv.ParseInt(string(val), 10, 64)
+					return
+				}); err != nil {
+					return err
+				}
+				if exp := item.ExpiresAt(); exp != 0 {
+					if remaining := time.Until(time.Unix(int64(exp), 0)); remaining > 0 {
+						e = e.WithTTL(remaining)
+					}
+				}
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			} else if ttl > 0 {
+				e = e.WithTTL(ttl)
+			}
+			n += delta
+			e.Value = []byte(strconv.FormatInt(n, 10))
+			return txn.SetEntry(e)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return
+		}
+	}
+}
+
+// Counter returns the current value of an Incr counter, or zero.
+func (s *Store) Counter(key string) (n int64, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) (err error) {
+			n, err = strconv.ParseInt(string(val), 10, 64)
+			return
+		})
+	})
+	return
+}
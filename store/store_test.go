@@ -0,0 +1,47 @@
+package store
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s, err := Open("")
+	require.NoError(t, err)
+	defer s.Close()
+
+	type rec struct {
+		Name string `json:"name"`
+	}
+	require.NoError(t, s.Put("a/1", rec{Name: "one"}))
+	require.NoError(t, s.Put("a/2", rec{Name: "two"}))
+	require.NoError(t, s.Put("b/1", rec{Name: "other"}))
+
+	var r rec
+	found, err := s.Get("a/2", &r)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "two", r.Name)
+
+	found, err = s.Get("a/3", &r)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	var keys []string
+	require.NoError(t, s.List("a/", func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	require.Equal(t, []string{"a/1", "a/2"}, keys)
+
+	n, err := s.Incr("count", 2, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+	n, err = s.Incr("count", 3, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	n, err = s.Counter("count")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+}
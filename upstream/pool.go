@@ -0,0 +1,522 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultProbeInterval = 15 * time.Second
+	DefaultProbeMethod   = "eth_chainId"
+	DefaultBackoff       = 200 * time.Millisecond
+)
+
+var (
+	callDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "erc4337_upstream_call_duration_seconds",
+		Help: "How long calls to an upstream took, with their retries.",
+	}, []string{"upstream", "method"})
+	callErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "erc4337_upstream_call_errors_total",
+		Help: "Calls to an upstream that failed on every attempt.",
+	}, []string{"upstream", "method"})
+)
+
+// endpoints start out assumed this fast, until they're probed
+var initialLatency = 100 * time.Millisecond
+
+// how much each new sample moves an endpoint's latency
+const latencyWeight = 0.3
+
+// sending these twice isn't the same as sending them once, so they're only retried
+// when the request never reached the endpoint
+var nonIdempotent = map[string]bool{
+	"eth_sendRawTransaction":  true,
+	"eth_sendTransaction":     true,
+	"eth_sendUserOperation":   true,
+	"pm_sponsorUserOperation": true,
+}
+
+type Config struct {
+	// how often every endpoint is probed
+	ProbeInterval time.Duration
+	// probed with this method, any JSON-RPC response counts as healthy
+	ProbeMethod string
+	// how many times a failed idempotent call is retried, on another endpoint when
+	// there is one
+	Retries int
+	// the wait before the first retry, doubled for each one after
+	Backoff time.Duration
+	// how long each attempt may take, no limit when 0
+	Timeout time.Duration
+}
+
+// CallTimeout is how long a call may take with its retries, no limit when 0.
+func (c Config) CallTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 0
+	}
+	total, backoff := c.Timeout, c.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	for i := 0; i < c.Retries; i++ {
+		total += backoff + c.Timeout
+		backoff *= 2
+	}
+	return total
+}
+
+type endpoint struct {
+	url      string
+	healthy  bool
+	latency  time.Duration
+	failures int
+	lastErr  string
+	checked  time.Time
+}
+
+// Pool sends JSON-RPC requests to one of a list of equivalent endpoints, preferring the
+// healthy and faster ones, and fails over to the others when one fails.
+type Pool struct {
+	name   string
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+func NewPool(name string, urls []string, cfg Config) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no %v endpoints configured", name)
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = DefaultProbeInterval
+	}
+	if len(cfg.ProbeMethod) == 0 {
+		cfg.ProbeMethod = DefaultProbeMethod
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	p := &Pool{name: name, cfg: cfg, client: &http.Client{}}
+	for _, u := range urls {
+		if !IsHTTP(u) {
+			return nil, fmt.Errorf("%v endpoint '%v' is not an http(s) url", name, redact(u))
+		}
+		p.endpoints = append(p.endpoints, &endpoint{url: u, healthy: true, latency: initialLatency})
+	}
+	return p, nil
+}
+
+func IsHTTP(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// redact drops everything past the host, where providers put API keys
+func redact(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || len(parsed.Host) == 0 {
+		return "(invalid url)"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// pick chooses a healthy endpoint not yet tried, weighted by how fast it is. When none
+// are healthy the fastest of the rest is tried anyway.
+func (p *Pool) pick(tried map[*endpoint]bool) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []*endpoint
+	for _, e := range p.endpoints {
+		if e.healthy && !tried[e] {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		var fastest *endpoint
+		for _, e := range p.endpoints {
+			if !tried[e] && (fastest == nil || e.latency < fastest.latency) {
+				fastest = e
+			}
+		}
+		if fastest == nil {
+			// everything was tried, start over
+			fastest = p.endpoints[0]
+			for _, e := range p.endpoints[1:] {
+				if e.latency < fastest.latency {
+					fastest = e
+				}
+			}
+		}
+		return fastest
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, e := range candidates {
+		latency := e.latency
+		if latency < time.Millisecond {
+			latency = time.Millisecond
+		}
+		weights[i] = 1 / latency.Seconds()
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (p *Pool) succeeded(e *endpoint, took time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !e.healthy {
+		log.Infof("upstream %v: %v is back", p.name, redact(e.url))
+	}
+	e.healthy = true
+	e.failures = 0
+	e.lastErr = ""
+	e.latency = time.Duration(float64(e.latency)*(1-latencyWeight) + float64(took)*latencyWeight)
+	e.checked = time.Now().UTC()
+}
+
+func (p *Pool) failed(e *endpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.healthy {
+		log.Warnf("upstream %v: %v is down: %v", p.name, redact(e.url), err.Error())
+	}
+	e.healthy = false
+	e.failures++
+	e.lastErr = err.Error()
+	e.checked = time.Now().UTC()
+}
+
+// endpointError keeps the endpoint's API key out of error messages
+type endpointError struct {
+	url string
+	err error
+}
+
+func (e *endpointError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.url, redact(e.url))
+}
+
+func (e *endpointError) Unwrap() error {
+	return e.err
+}
+
+// send posts the request body to the endpoint; server errors and rate limits count as
+// failures, JSON-RPC errors don't.
+func (p *Pool) send(ctx context.Context, e *endpoint, header http.Header, body []byte) (*http.Response, error) {
+	// a timeout is the endpoint's fault, the caller giving up isn't
+	parent := ctx
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(req.Header.Get("Content-Type")) == 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		err = &endpointError{url: e.url, err: err}
+		if parent.Err() == nil {
+			p.failed(e, err)
+		}
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		err = &endpointError{url: e.url, err: err}
+		if parent.Err() == nil {
+			p.failed(e, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		err = fmt.Errorf("%v responded %v", redact(e.url), resp.Status)
+		p.failed(e, err)
+		return nil, err
+	}
+	p.succeeded(e, time.Since(start))
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+type rpcCall struct {
+	Method string `json:"method"`
+}
+
+// requestMethods returns the methods called by a request, or batch of them; ok is false
+// when it isn't JSON-RPC.
+func requestMethods(body []byte) (methods []string, batch bool, ok bool) {
+	var calls []rpcCall
+	if err := json.Unmarshal(body, &calls); err == nil {
+		batch = true
+	} else {
+		var call rpcCall
+		if err = json.Unmarshal(body, &call); err != nil {
+			return nil, false, false
+		}
+		calls = append(calls, call)
+	}
+	for _, call := range calls {
+		methods = append(methods, call.Method)
+	}
+	return methods, batch, true
+}
+
+// isIdempotent reports whether every call in a request, or batch of them, is safe to
+// send again.
+func isIdempotent(body []byte) bool {
+	methods, _, ok := requestMethods(body)
+	if !ok {
+		return false
+	}
+	for _, method := range methods {
+		if nonIdempotent[method] {
+			return false
+		}
+	}
+	return true
+}
+
+// methodLabel is the method a request is counted under in the metrics.
+func methodLabel(body []byte) string {
+	methods, batch, ok := requestMethods(body)
+	switch {
+	case !ok:
+		return "unknown"
+	case batch:
+		return "batch"
+	}
+	return methods[0]
+}
+
+// notSent is true for errors where the request never reached the endpoint
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Do sends a JSON-RPC request, retrying with backoff on another endpoint when one fails.
+// Calls that aren't idempotent are only retried if they weren't sent.
+func (p *Pool) Do(ctx context.Context, header http.Header, body []byte) (*http.Response, error) {
+	method := methodLabel(body)
+	start := time.Now()
+	resp, err := p.do(ctx, header, body)
+	callDuration.WithLabelValues(p.name, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		callErrors.WithLabelValues(p.name, method).Inc()
+	}
+	return resp, err
+}
+
+func (p *Pool) do(ctx context.Context, header http.Header, body []byte) (*http.Response, error) {
+	idempotent := isIdempotent(body)
+	tried := map[*endpoint]bool{}
+	backoff := p.cfg.Backoff
+	for attempt := 0; ; attempt++ {
+		e := p.pick(tried)
+		tried[e] = true
+		resp, err := p.send(ctx, e, header, body)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= p.cfg.Retries || ctx.Err() != nil || !(idempotent || notSent(err)) {
+			return nil, fmt.Errorf("upstream %v: %w", p.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("upstream %v: %w", p.name, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// RoundTrip lets go-ethereum's rpc client send through the pool, whatever url it was
+// dialed with.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Do(req.Context(), req.Header.Clone(), body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// URL returns the first endpoint, for clients that need one to dial.
+func (p *Pool) URL() string {
+	return p.endpoints[0].url
+}
+
+// how long the relay waits for a client's request; it's on loopback, so a slow one is stuck
+const relayReadTimeout = 30 * time.Second
+
+// Listen serves the pool on a loopback port, for clients that can't be given a
+// transport, and returns its url. The relay is unauthenticated: anything that can
+// reach loopback on this host can call the upstream through it.
+func (p *Pool) Listen() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: p, ReadTimeout: relayReadTimeout}
+	// a call and its retries, with time to read the request; no limit if calls have none
+	if callTimeout := p.cfg.CallTimeout(); callTimeout > 0 {
+		srv.WriteTimeout = callTimeout + relayReadTimeout
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Errorf("upstream %v: relay stopped: %v", p.name, err.Error())
+		}
+	}()
+	return "http://" + l.Addr().String(), nil
+}
+
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := p.Do(r.Context(), http.Header{"Content-Type": r.Header.Values("Content-Type")}, body)
+	if err != nil {
+		// as a JSON-RPC error, so the client reports it rather than failing to decode
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      nil,
+			"error":   map[string]any{"code": -32603, "message": err.Error()},
+		})
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// Probe checks every endpoint once.
+func (p *Pool) Probe(ctx context.Context) {
+	body, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": 1, "method": p.cfg.ProbeMethod, "params": []any{}})
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, p.cfg.ProbeInterval)
+			defer cancel()
+			resp, err := p.send(ctx, e, nil, body)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			var res struct {
+				Result json.RawMessage `json:"result"`
+				Error  json.RawMessage `json:"error"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&res); err != nil || (res.Result == nil && res.Error == nil) {
+				p.failed(e, fmt.Errorf("not a JSON-RPC response to %v", p.cfg.ProbeMethod))
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Run probes the endpoints every interval until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	p.Probe(ctx)
+	ticker := time.NewTicker(p.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Probe(ctx)
+		}
+	}
+}
+
+type EndpointStatus struct {
+	// scheme and host only, the rest may hold an API key
+	Endpoint    string    `json:"endpoint"`
+	Healthy     bool      `json:"healthy"`
+	LatencyMs   int64     `json:"latencyMs"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastChecked time.Time `json:"lastChecked"`
+}
+
+type Status struct {
+	Name string `json:"name"`
+	// at least one endpoint is healthy
+	Healthy   bool             `json:"healthy"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+func (p *Pool) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := Status{Name: p.name}
+	for _, e := range p.endpoints {
+		status.Healthy = status.Healthy || e.healthy
+		status.Endpoints = append(status.Endpoints, EndpointStatus{
+			Endpoint:    redact(e.url),
+			Healthy:     e.healthy,
+			LatencyMs:   e.latency.Milliseconds(),
+			Failures:    e.failures,
+			LastError:   e.lastErr,
+			LastChecked: e.checked,
+		})
+	}
+	return status
+}
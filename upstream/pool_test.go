@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeTestEndpoint(t *testing.T, status int, calls *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPoolFailover(t *testing.T) {
+	var downCalls, upCalls int32
+	down := makeTestEndpoint(t, http.StatusBadGateway, &downCalls)
+	up := makeTestEndpoint(t, http.StatusOK, &upCalls)
+
+	p, err := NewPool("chain", []string{down.URL + "/v3/secret", up.URL}, Config{Retries: 1, Backoff: 1})
+	require.NoError(t, err)
+
+	// the probe finds the endpoint that's down, and calls skip it
+	p.Probe(context.Background())
+	status := p.Status()
+	require.True(t, status.Healthy)
+	require.False(t, status.Endpoints[0].Healthy)
+	require.NotContains(t, status.Endpoints[0].Endpoint, "secret")
+	require.True(t, status.Endpoints[1].Healthy)
+
+	downCalls = 0
+	for i := 0; i < 5; i++ {
+		resp, err := p.Do(context.Background(), nil, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		require.Contains(t, string(body), `"result":"0x1"`)
+	}
+	require.Equal(t, int32(0), downCalls)
+
+	// with every endpoint down, reads are retried but sends aren't
+	p, err = NewPool("bundler", []string{down.URL}, Config{Retries: 2, Backoff: 1})
+	require.NoError(t, err)
+	downCalls = 0
+	_, err = p.Do(context.Background(), nil, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getUserOperationReceipt"}`))
+	require.Error(t, err)
+	require.Equal(t, int32(3), downCalls)
+
+	downCalls = 0
+	_, err = p.Do(context.Background(), nil, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_sendUserOperation"}`))
+	require.Error(t, err)
+	require.Equal(t, int32(1), downCalls)
+	require.False(t, p.Status().Healthy)
+}
+
+func TestPoolTimeout(t *testing.T) {
+	blocked := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-blocked:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(blocked) })
+	var upCalls int32
+	up := makeTestEndpoint(t, http.StatusOK, &upCalls)
+
+	// an endpoint that hangs times out and the call is retried on the other one
+	p, err := NewPool("chain", []string{slow.URL, up.URL}, Config{Retries: 1, Backoff: 1, Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	p.endpoints[1].healthy = false
+	_, err = p.Do(context.Background(), nil, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), upCalls)
+	require.False(t, p.Status().Endpoints[0].Healthy)
+
+	// a cancelled call isn't the endpoint's fault
+	p, err = NewPool("chain", []string{slow.URL}, Config{Timeout: time.Minute})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.Do(ctx, nil, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, p.Status().Healthy)
+}